@@ -1,10 +1,12 @@
 package api
 
 import (
-	"errors"
+	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 
 	"github.com/codelity/gowebdis/internal/gowebdis"
 )
@@ -15,19 +17,65 @@ type ApiResponse struct {
 func StartServer() {
 
 	router := gin.Default()
+	RegisterRoutes(router)
+	server, err := newHttpServer(Handler(router))
+	if err != nil {
+		log.Error("[ERROR] " + err.Error())
+		gowebdis.CloseConnection()
+		return
+	}
+	serve(server)
+}
+
+// RegisterRoutes registers the API on a gin engine or group. The
+// middleware runs after authentication, before the commands.
+func RegisterRoutes(router gin.IRoutes, middleware ...gin.HandlerFunc) {
+	router.Use(authenticate)
+	router.Use(limitBodySize)
+	if len(middleware) > 0 {
+		router.Use(middleware...)
+	}
 	router.GET("/healthz", pingCommand)
+	router.GET("/readyz", readyCommand)
+	router.GET("/metrics", requireAdminRole("/metrics"), metricsCommand)
+	router.GET("/cache/stats", requireAdminRole("/cache/stats"), cacheStatsCommand)
+	router.GET("/openapi.json", requireAdminRole("/openapi.json"), openapiCommand)
+	router.GET("/docs", requireAdminRole("/docs"), docsCommand)
+	router.GET("/"+docsScriptPath, requireAdminRole("/docs"), docsScriptCommand)
+	router.GET("/read/:command/*key", readCommand)
+	router.GET("/subscribe/:channel", subscribeCommand)
+	router.GET("/doc/*key", getDocument)
+	router.PUT("/doc/*key", putDocument)
+	router.PATCH("/doc/*key", patchDocument)
+	router.DELETE("/doc/*key", deleteDocument)
 	router.POST("/:command", apiCommand)
-	router.Run()
 }
 
+// Handler serves the routes of router, selecting the backend of requests
+// under /backend/{name}.
+func Handler(router http.Handler) http.Handler {
+	return backendPrefixHandler(router)
+}
+
+// pingCommand serves /healthz. Probes carry no token, so the backend is
+// not restricted to its roles here: the reply tells nothing but whether
+// redis answers.
 func pingCommand(context *gin.Context) {
 	var jsonPayload gowebdis.JsonPayload
 	var commandResponse gowebdis.CommandResponse
-	commandResponse = gowebdis.RunRedisCommand("ping", jsonPayload)
+	backend, err := gowebdis.ResolveBackend(requestedBackend(context), "")
+	if err != nil {
+		context.JSON(404, gin.H{"errorMessage": err.Error()})
+		return
+	}
+	commandResponse = gowebdis.RunRedisCommand(backend, "ping", jsonPayload, gowebdis.CommandOptions{Route: gowebdis.RouteHealth})
 	if commandResponse.Success {
-		context.JSON(200, gin.H{"boolVal": true})
+		context.JSON(200, gin.H{"boolVal": true, "circuitBreaker": backend.CircuitBreakerState()})
 	} else {
-		context.JSON(400, gin.H{"errorMessage": commandResponse.ErrorMessage})
+		context.JSON(commandErrorStatus(commandResponse), gin.H{
+			"errorMessage":   commandResponse.ErrorMessage,
+			"circuitBreaker": backend.CircuitBreakerState(),
+		})
 	}
 	return
 }
@@ -39,7 +87,27 @@ func apiCommand(context *gin.Context) {
 	command, _ := context.Params.Get("command")
 	var commandResponse gowebdis.CommandResponse
 
-	err := context.BindJSON(&jsonPayload)
+	// gin cannot route static paths next to /:command.
+	switch command {
+	case "batch":
+		batchCommand(context)
+		return
+	case "transaction":
+		transactionCommand(context)
+		return
+	}
+
+	if gowebdis.IsInternalCommand(command) {
+		context.JSON(400, gin.H{"errorMessage": internalCommandError(command)})
+		return
+	}
+
+	err := context.ShouldBindJSON(&jsonPayload)
+	if err != nil && isBodyTooLarge(err) {
+		log.Error("[ERROR] " + err.Error())
+		context.JSON(413, bodyTooLarge(viper.GetInt64("max-body-size")))
+		return
+	}
 	if err != nil {
 		log.Error("[ERROR] " + err.Error())
 		context.JSON(400, gin.H{
@@ -57,63 +125,84 @@ func apiCommand(context *gin.Context) {
 		return
 	}
 
-	commandResponse = gowebdis.RunRedisCommand(command, jsonPayload)
+	status, limitError := checkPayloadLimits(jsonPayload)
+	if limitError != nil {
+		log.Error("[ERROR] " + limitError["errorMessage"].(string))
+		context.JSON(status, limitError)
+		return
+	}
+
+	backend := resolveBackend(context, jsonPayload.Key)
+	if backend == nil {
+		return
+	}
+
+	commandResponse = gowebdis.RunRedisCommand(backend, command, jsonPayload, commandOptions(context, gowebdis.RouteCommand))
+	commandReply(context, commandResponse)
+	return
+}
+
+// commandReply answers with the reply of a command, including the ETag of
+// versioned writes.
+func commandReply(context *gin.Context, commandResponse gowebdis.CommandResponse) {
+	if len(commandResponse.Version) > 0 {
+		context.Header("ETag", strconv.Quote("v"+commandResponse.Version))
+	}
+	if commandResponse.Replayed {
+		context.Header("Idempotent-Replayed", "true")
+	}
 	if commandResponse.Success {
-		var responsePayload map[string]interface{}
-		switch commandResponse.Name {
-		case "hset":
-			responsePayload = gin.H{
-				"boolValue": commandResponse.BoolVal,
-			}
-		case "hgetall":
-			responsePayload = gin.H{
-				"stringArrayValue": getStringArrayValue(commandResponse.MapVal),
-			}
-		case "hdel":
-			responsePayload = gin.H{
-				"intValue": commandResponse.IntVal,
-			}
-		}
-		context.JSON(200, responsePayload)
+		context.JSON(200, encodeResponse(commandResponse))
 	} else {
-		context.JSON(400, gin.H{
-			"errorMessage": commandResponse.ErrorMessage,
-		})
+		commandError(context, commandResponse)
 	}
-	return
 }
 
-func getStringArrayValue(m map[string]string) []string {
-	v := make([]string, len(m), len(m))
-	idx := 0
-	for _, value := range m {
-		v[idx] = value
-		idx++
+// errorStatus maps the error codes of gowebdis to HTTP statuses, failures
+// without a code are reported as 400.
+var errorStatus = map[string]int{
+	gowebdis.ErrorCodePreconditionFailed: 412,
+	gowebdis.ErrorCodeUnavailable:        503,
+	gowebdis.ErrorCodeConflict:           409,
+	gowebdis.ErrorCodeUnprocessable:      422,
+	gowebdis.ErrorCodeTooLarge:           413,
+	gowebdis.ErrorCodeForbidden:          403,
+	gowebdis.ErrorCodeInternal:           500,
+}
+
+func commandErrorStatus(commandResponse gowebdis.CommandResponse) int {
+	status, ok := errorStatus[commandResponse.ErrorCode]
+	if !ok {
+		status = 400
+	}
+	return status
+}
+
+func commandError(context *gin.Context, commandResponse gowebdis.CommandResponse) {
+	responsePayload := gin.H{"errorMessage": commandResponse.ErrorMessage}
+	if len(commandResponse.ErrorCode) > 0 {
+		responsePayload["errorCode"] = commandResponse.ErrorCode
 	}
-	return v
+	context.JSON(commandErrorStatus(commandResponse), responsePayload)
 }
 
+func encodeResponse(commandResponse gowebdis.CommandResponse) map[string]interface{} {
+	return gowebdis.EncodeResponse(commandResponse)
+}
+
+// internalCommandError refuses the internal commands, such as the document
+// commands, which can only be run by their routes.
+func internalCommandError(command string) string {
+	return "Does not support " + command + " command"
+}
+
+// validateJsonPayload checks the payload against the declaration of the
+// command in the registry. Unknown commands are refused by
+// gowebdis.RunRedisCommand.
 func validateJsonPayload(command string, jsonPayload gowebdis.JsonPayload) error {
-	var err error
-	switch command {
-	case "hset":
-		if len(jsonPayload.Key) == 0 {
-			err = errors.New("'key' attribute cannot be found in payload")
-		} else if len(jsonPayload.Field) == 0 {
-			err = errors.New("'field' attribute cannot be found in payload")
-		} else if len(jsonPayload.Value) == 0 {
-			err = errors.New("'value' attribute cannot be found in payload")
-		}
-	case "hgetall":
-		if len(jsonPayload.Key) == 0 {
-			err = errors.New("'key' attribute cannot be found in payload")
-		}
-	case "hdel":
-		if len(jsonPayload.Key) == 0 {
-			err = errors.New("'key' attribute cannot be found in payload")
-		} else if len(jsonPayload.Fields) == 0 {
-			err = errors.New("'fields' attribute is empty in payload")
-		}
-	}
-	return err
+	registered, ok := gowebdis.LookupCommand(command)
+	if !ok {
+		return nil
+	}
+	return registered.Validate(jsonPayload)
 }
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/codelity/gowebdis/internal/gowebdis"
+)
+
+type batchPayload struct {
+	Commands []gowebdis.BatchCommand `json:"commands"`
+}
+
+// bindBatch reads the commands of a batch or transaction, answering the
+// request itself when they cannot be run.
+func bindBatch(context *gin.Context) ([]gowebdis.BatchCommand, bool) {
+	var payload batchPayload
+	err := context.ShouldBindJSON(&payload)
+	if err != nil && isBodyTooLarge(err) {
+		log.Error("[ERROR] " + err.Error())
+		context.JSON(413, bodyTooLarge(viper.GetInt64("max-body-size")))
+		return nil, false
+	}
+	if err != nil {
+		log.Error("[ERROR] " + err.Error())
+		context.JSON(400, gin.H{"errorMessage": err.Error()})
+		return nil, false
+	}
+	if len(payload.Commands) == 0 {
+		context.JSON(400, gin.H{"errorMessage": "'commands' attribute is empty in payload"})
+		return nil, false
+	}
+	maxBatchLength := viper.GetInt("max-batch-length")
+	if maxBatchLength > 0 && len(payload.Commands) > maxBatchLength {
+		context.JSON(422, gin.H{
+			"errorMessage": fmt.Sprintf("'commands' has %v elements, more than %v", len(payload.Commands), maxBatchLength),
+			"errorCode":    gowebdis.ErrorCodeUnprocessable,
+		})
+		return nil, false
+	}
+	for _, command := range payload.Commands {
+		if gowebdis.IsInternalCommand(command.Command) {
+			context.JSON(400, gin.H{"errorMessage": internalCommandError(command.Command)})
+			return nil, false
+		}
+		status, limitError := checkPayloadLimits(command.JsonPayload)
+		if limitError != nil {
+			log.Error("[ERROR] " + limitError["errorMessage"].(string))
+			context.JSON(status, limitError)
+			return nil, false
+		}
+	}
+	if len(context.GetHeader("If-Match")) > 0 || len(context.GetHeader(viper.GetString("idempotency-header"))) > 0 {
+		context.JSON(400, gin.H{"errorMessage": "If-Match and Idempotency-Key are not supported by batches and transactions"})
+		return nil, false
+	}
+	return payload.Commands, true
+}
+
+// batchResult encodes the response of one command of a batch like the
+// reply of the command endpoint, with its status.
+func batchResult(commandResponse gowebdis.CommandResponse) gin.H {
+	if !commandResponse.Success {
+		result := gin.H{
+			"status":       commandErrorStatus(commandResponse),
+			"errorMessage": commandResponse.ErrorMessage,
+		}
+		if len(commandResponse.ErrorCode) > 0 {
+			result["errorCode"] = commandResponse.ErrorCode
+		}
+		return result
+	}
+	result := gin.H(encodeResponse(commandResponse))
+	if result == nil {
+		result = gin.H{}
+	}
+	result["status"] = 200
+	if len(commandResponse.Version) > 0 {
+		result["etag"] = strconv.Quote("v" + commandResponse.Version)
+	}
+	return result
+}
+
+// batchCommand runs the commands of POST /batch one after the other, each
+// routed to its own backend. The batch is not atomic: every command
+// succeeds or fails on its own.
+func batchCommand(context *gin.Context) {
+	commands, ok := bindBatch(context)
+	if !ok {
+		return
+	}
+	options := commandOptions(context, gowebdis.RouteBatch)
+	results := make([]gin.H, len(commands))
+	for idx, command := range commands {
+		err := validateJsonPayload(command.Command, command.JsonPayload)
+		if err != nil {
+			results[idx] = gin.H{"status": 400, "errorMessage": err.Error()}
+			continue
+		}
+		backend, status, errorPayload := selectBackend(context, command.Key)
+		if backend == nil {
+			errorPayload["status"] = status
+			results[idx] = errorPayload
+			continue
+		}
+		results[idx] = batchResult(gowebdis.RunRedisCommand(backend, command.Command, command.JsonPayload, options))
+	}
+	context.JSON(200, gin.H{"results": results})
+}
+
+// transactionCommand runs the commands of POST /transaction atomically on
+// a single backend.
+func transactionCommand(context *gin.Context) {
+	commands, ok := bindBatch(context)
+	if !ok {
+		return
+	}
+	var backend *gowebdis.Backend
+	for _, command := range commands {
+		commandBackend := resolveBackend(context, command.Key)
+		if commandBackend == nil {
+			return
+		}
+		if backend != nil && commandBackend != backend {
+			context.JSON(422, gin.H{
+				"errorMessage": "Commands of a transaction must use the same backend",
+				"errorCode":    gowebdis.ErrorCodeUnprocessable,
+			})
+			return
+		}
+		backend = commandBackend
+	}
+
+	responses, failure := gowebdis.RunTransaction(backend, commands, commandOptions(context, gowebdis.RouteTransaction))
+	if !failure.Success {
+		commandError(context, failure)
+		return
+	}
+	results := make([]gin.H, len(responses))
+	for idx, commandResponse := range responses {
+		results[idx] = batchResult(commandResponse)
+	}
+	context.JSON(200, gin.H{"results": results})
+}
+
+// subscribeCommand streams the messages published on a channel as
+// Server-Sent Events until the client disconnects or the server shuts
+// down. The channel name routes the subscription like a key.
+func subscribeCommand(context *gin.Context) {
+	channel := context.Param("channel")
+	backend := resolveBackend(context, channel)
+	if backend == nil {
+		return
+	}
+	subscription, commandResponse := gowebdis.Subscribe(backend, channel, commandOptions(context, gowebdis.RouteSubscribe))
+	if !commandResponse.Success {
+		commandError(context, commandResponse)
+		return
+	}
+	defer subscription.Close()
+
+	context.Header("Content-Type", "text/event-stream")
+	context.Header("Cache-Control", "no-cache")
+	context.Header("X-Accel-Buffering", "no")
+	context.Status(200)
+	context.Writer.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	messages := subscription.Messages()
+	shutdown := shutdownChannel()
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(gin.H{"channel": message.Channel, "payload": message.Payload})
+			_, err := context.Writer.Write([]byte("event: message\ndata: " + string(data) + "\n\n"))
+			if err != nil {
+				return
+			}
+		case <-keepalive.C:
+			_, err := context.Writer.Write([]byte(": keepalive\n\n"))
+			if err != nil {
+				return
+			}
+		case <-context.Request.Context().Done():
+			return
+		case <-shutdown:
+			return
+		}
+		context.Writer.Flush()
+	}
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/codelity/gowebdis/internal/gowebdis"
+)
+
+// The document API stores JSON objects in hashes, see
+// gowebdis.FlattenDocument: GET /doc/user:1 returns the object, PUT
+// replaces it, PATCH applies a JSON Merge Patch and DELETE removes it.
+// Reads go through hgetall and writes through the docput, docpatch and
+// docdel commands, so the policy, hooks and audit log of these apply.
+
+func documentKey(context *gin.Context) (string, bool) {
+	key := strings.TrimPrefix(context.Param("key"), "/")
+	if len(key) == 0 {
+		context.JSON(400, gin.H{"errorMessage": "'key' cannot be empty"})
+		return "", false
+	}
+	return key, true
+}
+
+// readDocument reads the JSON object of the request body.
+func readDocument(context *gin.Context) (map[string]interface{}, bool) {
+	body, err := ioutil.ReadAll(context.Request.Body)
+	if err != nil && isBodyTooLarge(err) {
+		log.Error("[ERROR] " + err.Error())
+		context.JSON(413, bodyTooLarge(viper.GetInt64("max-body-size")))
+		return nil, false
+	}
+	if err == nil {
+		var document map[string]interface{}
+		document, err = gowebdis.DecodeDocument(body)
+		if err == nil {
+			return document, true
+		}
+	}
+	log.Error("[ERROR] " + err.Error())
+	context.JSON(400, gin.H{"errorMessage": err.Error()})
+	return nil, false
+}
+
+func getDocument(context *gin.Context) {
+	key, ok := documentKey(context)
+	if !ok {
+		return
+	}
+	backend := resolveBackend(context, key)
+	if backend == nil {
+		return
+	}
+	options := commandOptions(context, gowebdis.RouteDocument)
+	commandResponse := gowebdis.RunRedisCommand(backend, "hgetall", gowebdis.JsonPayload{Key: key}, options)
+	if !commandResponse.Success {
+		commandError(context, commandResponse)
+		return
+	}
+	if len(commandResponse.MapVal) == 0 {
+		context.JSON(404, gin.H{"errorMessage": key + " does not exist"})
+		return
+	}
+	document, err := gowebdis.AssembleDocument(commandResponse.MapVal)
+	if err != nil {
+		log.Error("[ERROR] " + key + ": " + err.Error())
+		context.JSON(422, gin.H{"errorMessage": err.Error(), "errorCode": gowebdis.ErrorCodeUnprocessable})
+		return
+	}
+
+	etag, err := responseEtag(commandResponse, document)
+	if err != nil {
+		context.JSON(500, gin.H{"errorMessage": err.Error()})
+		return
+	}
+	context.Header("ETag", etag)
+	context.Header("Cache-Control", cacheControl(context, backend, key, options))
+	if etagMatches(context.GetHeader("If-None-Match"), etag) {
+		context.Status(304)
+		return
+	}
+	context.JSON(200, document)
+}
+
+func putDocument(context *gin.Context) {
+	key, ok := documentKey(context)
+	if !ok {
+		return
+	}
+	document, ok := readDocument(context)
+	if !ok {
+		return
+	}
+	values, err := gowebdis.FlattenDocument(document)
+	if err != nil {
+		log.Error("[ERROR] " + err.Error())
+		context.JSON(400, gin.H{"errorMessage": err.Error()})
+		return
+	}
+	writeDocument(context, "docput", gowebdis.JsonPayload{Key: key, Values: values})
+}
+
+func patchDocument(context *gin.Context) {
+	key, ok := documentKey(context)
+	if !ok {
+		return
+	}
+	patch, ok := readDocument(context)
+	if !ok {
+		return
+	}
+	values, deleted, err := gowebdis.CompileMergePatch(patch)
+	if err != nil {
+		log.Error("[ERROR] " + err.Error())
+		context.JSON(400, gin.H{"errorMessage": err.Error()})
+		return
+	}
+	writeDocument(context, "docpatch", gowebdis.JsonPayload{Key: key, Values: values, Fields: deleted})
+}
+
+func deleteDocument(context *gin.Context) {
+	key, ok := documentKey(context)
+	if !ok {
+		return
+	}
+	writeDocument(context, "docdel", gowebdis.JsonPayload{Key: key})
+}
+
+func writeDocument(context *gin.Context, command string, jsonPayload gowebdis.JsonPayload) {
+	status, limitError := checkPayloadLimits(jsonPayload)
+	if limitError != nil {
+		log.Error("[ERROR] " + limitError["errorMessage"].(string))
+		context.JSON(status, limitError)
+		return
+	}
+	backend := resolveBackend(context, jsonPayload.Key)
+	if backend == nil {
+		return
+	}
+	commandResponse := gowebdis.RunRedisCommand(backend, command, jsonPayload, commandOptions(context, gowebdis.RouteDocument))
+	commandReply(context, commandResponse)
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+
+	"github.com/codelity/gowebdis/internal/gowebdis"
+)
+
+// limitBodySize refuses request bodies larger than --max-body-size with
+// 413, whether their length is announced or not.
+func limitBodySize(context *gin.Context) {
+	maxBodySize := viper.GetInt64("max-body-size")
+	if maxBodySize <= 0 || context.Request.Body == nil {
+		return
+	}
+	if context.Request.ContentLength > maxBodySize {
+		context.AbortWithStatusJSON(413, bodyTooLarge(maxBodySize))
+		return
+	}
+	context.Request.Body = http.MaxBytesReader(context.Writer, context.Request.Body, maxBodySize)
+}
+
+func bodyTooLarge(maxBodySize int64) gin.H {
+	return gin.H{
+		"errorMessage": fmt.Sprintf("Request body is larger than %v bytes", maxBodySize),
+		"errorCode":    gowebdis.ErrorCodeTooLarge,
+	}
+}
+
+// isBodyTooLarge reports whether reading the body failed because it
+// exceeded the limit set by limitBodySize.
+func isBodyTooLarge(err error) bool {
+	return strings.Contains(err.Error(), "http: request body too large")
+}
+
+// checkPayloadLimits enforces --max-args and --max-value-size and returns
+// the status to answer with when the payload exceeds them.
+func checkPayloadLimits(jsonPayload gowebdis.JsonPayload) (int, gin.H) {
+	maxArgs := viper.GetInt("max-args")
+	if maxArgs > 0 && len(jsonPayload.Fields) > maxArgs {
+		return 422, gin.H{
+			"errorMessage": fmt.Sprintf("'fields' has %v elements, more than %v", len(jsonPayload.Fields), maxArgs),
+			"errorCode":    gowebdis.ErrorCodeUnprocessable,
+		}
+	}
+	if maxArgs > 0 && len(jsonPayload.Values) > maxArgs {
+		return 422, gin.H{
+			"errorMessage": fmt.Sprintf("'values' has %v fields, more than %v", len(jsonPayload.Values), maxArgs),
+			"errorCode":    gowebdis.ErrorCodeUnprocessable,
+		}
+	}
+
+	maxValueSize := viper.GetInt("max-value-size")
+	if maxValueSize <= 0 {
+		return 0, nil
+	}
+	values := map[string]string{
+		"key":   jsonPayload.Key,
+		"field": jsonPayload.Field,
+		"value": jsonPayload.Value,
+	}
+	for idx, field := range jsonPayload.Fields {
+		values[fmt.Sprintf("fields[%v]", idx)] = field
+	}
+	for field, value := range jsonPayload.Values {
+		values[fmt.Sprintf("values[%v]", field)] = value
+	}
+	for name, value := range values {
+		if len(value) > maxValueSize {
+			return 413, gin.H{
+				"errorMessage": fmt.Sprintf("'%v' is larger than %v bytes", name, maxValueSize),
+				"errorCode":    gowebdis.ErrorCodeTooLarge,
+			}
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,464 @@
+package api
+
+import (
+	"html"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+
+	"github.com/codelity/gowebdis/internal/gowebdis"
+)
+
+const openapiVersion = "1.0"
+
+// errorDescriptions are the error statuses documented for commands, see
+// errorStatus.
+var errorDescriptions = map[string]string{
+	"400": "Invalid payload or command error.",
+	"401": "Missing or invalid bearer token.",
+	"403": "Command or backend not allowed for the caller.",
+	"404": "Unknown backend.",
+	"409": "Request with the same Idempotency-Key in progress, or emulated json write racing with other writes.",
+	"412": "Version of the key does not match If-Match.",
+	"413": "Request body or value too large.",
+	"422": "Argument or reply limit exceeded, or Idempotency-Key reused.",
+	"500": "Stored value cannot be decoded.",
+	"503": "Backend unavailable or circuit breaker open.",
+}
+
+var readErrors = []string{"400", "401", "403", "404", "413", "422", "500", "503"}
+var writeErrors = []string{"400", "401", "403", "404", "409", "412", "413", "422", "500", "503"}
+
+func openapiCommand(context *gin.Context) {
+	context.JSON(200, openapiDocument())
+}
+
+// docsScriptPath is where /docs loads the Redoc bundle of --docs-script-file
+// from, relative to the page.
+const docsScriptPath = "docs/redoc.standalone.js"
+
+// docsCommand serves a Redoc page rendering /openapi.json. The Redoc bundle
+// is served from --docs-script-file when set, otherwise loaded from the
+// pinned --docs-script-url, checked against --docs-script-integrity.
+func docsCommand(context *gin.Context) {
+	script := `<script src="` + docsScriptPath + `"></script>`
+	if len(viper.GetString("docs-script-file")) == 0 {
+		script = `<script src="` + html.EscapeString(viper.GetString("docs-script-url")) + `"`
+		if integrity := viper.GetString("docs-script-integrity"); len(integrity) > 0 {
+			script += ` integrity="` + html.EscapeString(integrity) + `" crossorigin="anonymous"`
+		}
+		script += `></script>`
+	}
+	page := `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>gowebdis API</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+</head>
+<body>
+<redoc spec-url="openapi.json"></redoc>
+` + script + `
+</body>
+</html>
+`
+	context.Data(200, "text/html; charset=utf-8", []byte(page))
+}
+
+// docsScriptCommand serves the Redoc bundle of --docs-script-file.
+func docsScriptCommand(context *gin.Context) {
+	file := viper.GetString("docs-script-file")
+	if len(file) == 0 {
+		context.JSON(404, gin.H{"errorMessage": "--docs-script-file is not set"})
+		return
+	}
+	context.Header("Cache-Control", "max-age=86400")
+	context.File(file)
+}
+
+func schemaRef(name string) gin.H {
+	return gin.H{"$ref": "#/components/schemas/" + name}
+}
+
+func parameterRef(name string) gin.H {
+	return gin.H{"$ref": "#/components/parameters/" + name}
+}
+
+// schemaName turns a command name into a component name, e.g. hgetall into
+// Hgetall.
+func schemaName(command string) string {
+	return strings.ToUpper(command[:1]) + command[1:]
+}
+
+func typeSchema(typeName string) gin.H {
+	if typeName == gowebdis.TypeArray {
+		return gin.H{"type": "array", "items": gin.H{"type": "string"}}
+	}
+	if typeName == gowebdis.TypeObject {
+		return gin.H{"type": "object", "additionalProperties": gin.H{"type": "string"}}
+	}
+	if typeName == gowebdis.TypeJSON {
+		return gin.H{}
+	}
+	return gin.H{"type": typeName}
+}
+
+func requestSchema(spec gowebdis.CommandSpec) gin.H {
+	properties := gin.H{}
+	required := []string{}
+	for _, argument := range spec.Arguments {
+		property := typeSchema(argument.Type)
+		property["description"] = argument.Description
+		properties[argument.Name] = property
+		if argument.Required {
+			required = append(required, argument.Name)
+		}
+	}
+	schema := gin.H{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func responseSchema(spec gowebdis.CommandSpec) gin.H {
+	property := typeSchema(spec.Response.Type)
+	property["description"] = spec.Response.Description
+	return gin.H{
+		"type":       "object",
+		"properties": gin.H{spec.Response.Name: property},
+		"required":   []string{spec.Response.Name},
+	}
+}
+
+func errorResponses(responses gin.H, statuses []string) gin.H {
+	for _, status := range statuses {
+		responses[status] = gin.H{"$ref": "#/components/responses/Error" + status}
+	}
+	return responses
+}
+
+func commandOperation(spec gowebdis.CommandSpec) gin.H {
+	parameters := []gin.H{parameterRef("Backend")}
+	errors := readErrors
+	if spec.ReadOnly {
+		parameters = append(parameters, parameterRef("ReadFrom"))
+	} else {
+		parameters = append(parameters, parameterRef("IfMatch"), parameterRef("IdempotencyKey"))
+		errors = writeErrors
+	}
+	success := gin.H{
+		"description": "Reply of the command.",
+		"content":     gin.H{"application/json": gin.H{"schema": schemaRef(schemaName(spec.Name) + "Response")}},
+	}
+	if !spec.ReadOnly {
+		success["headers"] = gin.H{
+			"ETag":                gin.H{"description": "Version of the key after a versioned write.", "schema": gin.H{"type": "string"}},
+			"Idempotent-Replayed": gin.H{"description": "Set when the reply is the stored result of an earlier request.", "schema": gin.H{"type": "string"}},
+		}
+	}
+	operation := gin.H{
+		"operationId": spec.Name,
+		"summary":     spec.Summary,
+		"tags":        []string{"commands"},
+		"parameters":  parameters,
+		"requestBody": gin.H{
+			"required": true,
+			"content":  gin.H{"application/json": gin.H{"schema": schemaRef(schemaName(spec.Name) + "Request")}},
+		},
+		"responses": errorResponses(gin.H{"200": success}, errors),
+	}
+	if len(spec.Description) > 0 {
+		operation["description"] = spec.Description
+	}
+	return operation
+}
+
+func readOperation(spec gowebdis.CommandSpec) gin.H {
+	return gin.H{
+		"operationId": "read" + schemaName(spec.Name),
+		"summary":     spec.Summary + " Cacheable over GET.",
+		"tags":        []string{"reads"},
+		"parameters": []gin.H{
+			{"name": "key", "in": "path", "required": true, "schema": gin.H{"type": "string"}},
+			parameterRef("Backend"),
+			parameterRef("ReadFrom"),
+			{"name": "If-None-Match", "in": "header", "schema": gin.H{"type": "string"}},
+		},
+		"responses": errorResponses(gin.H{
+			"200": gin.H{
+				"description": "Reply of the command.",
+				"headers": gin.H{
+					"ETag":          gin.H{"schema": gin.H{"type": "string"}},
+					"Cache-Control": gin.H{"schema": gin.H{"type": "string"}},
+				},
+				"content": gin.H{"application/json": gin.H{"schema": schemaRef(schemaName(spec.Name) + "Response")}},
+			},
+			"304": gin.H{"description": "Reply unchanged since the ETag of If-None-Match."},
+		}, readErrors),
+	}
+}
+
+func batchRequestSchema() gin.H {
+	names := []string{}
+	properties := gin.H{}
+	for _, spec := range gowebdis.CommandSpecs() {
+		if spec.Internal {
+			continue
+		}
+		names = append(names, spec.Name)
+		for _, argument := range spec.Arguments {
+			properties[argument.Name] = typeSchema(argument.Type)
+		}
+	}
+	properties["command"] = gin.H{"type": "string", "enum": names}
+	return gin.H{
+		"type": "object",
+		"properties": gin.H{
+			"commands": gin.H{
+				"type":  "array",
+				"items": gin.H{"type": "object", "properties": properties, "required": []string{"command", "key"}},
+			},
+		},
+		"required": []string{"commands"},
+	}
+}
+
+func batchOperation(operationId string, summary string) gin.H {
+	return gin.H{
+		"operationId": operationId,
+		"summary":     summary,
+		"tags":        []string{"commands"},
+		"parameters":  []gin.H{parameterRef("Backend")},
+		"requestBody": gin.H{
+			"required": true,
+			"content":  gin.H{"application/json": gin.H{"schema": schemaRef("BatchRequest")}},
+		},
+		"responses": errorResponses(gin.H{
+			"200": gin.H{
+				"description": "Replies of the commands.",
+				"content":     gin.H{"application/json": gin.H{"schema": schemaRef("BatchResponse")}},
+			},
+		}, writeErrors),
+	}
+}
+
+func subscribeOperation() gin.H {
+	return gin.H{
+		"operationId": "subscribe",
+		"summary":     "Stream the messages published on a channel as Server-Sent Events.",
+		"tags":        []string{"pubsub"},
+		"parameters": []gin.H{
+			{"name": "channel", "in": "path", "required": true, "schema": gin.H{"type": "string"}},
+			parameterRef("Backend"),
+		},
+		"responses": errorResponses(gin.H{
+			"200": gin.H{
+				"description": "Stream of message events whose data is {\"channel\", \"payload\"}.",
+				"content":     gin.H{"text/event-stream": gin.H{"schema": gin.H{"type": "string"}}},
+			},
+		}, readErrors),
+	}
+}
+
+// documentOperations describes the document API, see getDocument.
+func documentOperations() gin.H {
+	key := gin.H{"name": "key", "in": "path", "required": true, "schema": gin.H{"type": "string"}}
+	document := gin.H{"application/json": gin.H{"schema": schemaRef("Document")}}
+	written := gin.H{
+		"description": "Number of fields set.",
+		"headers": gin.H{
+			"ETag":                gin.H{"description": "Version of the key after a versioned write.", "schema": gin.H{"type": "string"}},
+			"Idempotent-Replayed": gin.H{"description": "Set when the reply is the stored result of an earlier request.", "schema": gin.H{"type": "string"}},
+		},
+		"content": gin.H{"application/json": gin.H{"schema": schemaRef("DocputResponse")}},
+	}
+	writeParameters := []gin.H{key, parameterRef("Backend"), parameterRef("IfMatch"), parameterRef("IdempotencyKey")}
+	return gin.H{
+		"get": gin.H{
+			"operationId": "getDocument",
+			"summary":     "Get the JSON document stored in a hash.",
+			"tags":        []string{"documents"},
+			"parameters": []gin.H{
+				key,
+				parameterRef("Backend"),
+				parameterRef("ReadFrom"),
+				{"name": "If-None-Match", "in": "header", "schema": gin.H{"type": "string"}},
+			},
+			"responses": errorResponses(gin.H{
+				"200": gin.H{
+					"description": "The document.",
+					"headers": gin.H{
+						"ETag":          gin.H{"schema": gin.H{"type": "string"}},
+						"Cache-Control": gin.H{"schema": gin.H{"type": "string"}},
+					},
+					"content": document,
+				},
+				"304": gin.H{"description": "Document unchanged since the ETag of If-None-Match."},
+			}, readErrors),
+		},
+		"put": gin.H{
+			"operationId": "putDocument",
+			"summary":     "Replace the hash with a JSON document, nested objects flattened into dotted fields.",
+			"tags":        []string{"documents"},
+			"parameters":  writeParameters,
+			"requestBody": gin.H{"required": true, "content": document},
+			"responses":   errorResponses(gin.H{"200": written}, writeErrors),
+		},
+		"patch": gin.H{
+			"operationId": "patchDocument",
+			"summary":     "Apply a JSON Merge Patch to the document atomically.",
+			"tags":        []string{"documents"},
+			"parameters":  writeParameters,
+			"requestBody": gin.H{
+				"required": true,
+				"content":  gin.H{"application/merge-patch+json": gin.H{"schema": schemaRef("Document")}},
+			},
+			"responses": errorResponses(gin.H{"200": written}, writeErrors),
+		},
+		"delete": gin.H{
+			"operationId": "deleteDocument",
+			"summary":     "Delete the document.",
+			"tags":        []string{"documents"},
+			"parameters":  writeParameters,
+			"responses": errorResponses(gin.H{
+				"200": gin.H{
+					"description": "Number of documents deleted.",
+					"content":     gin.H{"application/json": gin.H{"schema": schemaRef("DocdelResponse")}},
+				},
+			}, writeErrors),
+		},
+	}
+}
+
+func healthOperation(operationId string, summary string) gin.H {
+	return gin.H{
+		"get": gin.H{
+			"operationId": operationId,
+			"summary":     summary,
+			"tags":        []string{"health"},
+			"responses": gin.H{
+				"200": gin.H{"description": "Healthy."},
+				"503": gin.H{"description": "Unhealthy."},
+			},
+		},
+	}
+}
+
+// openapiDocument describes the API in OpenAPI 3 from the command registry
+// and the current configuration.
+func openapiDocument() gin.H {
+	schemas := gin.H{
+		"Error": gin.H{
+			"type": "object",
+			"properties": gin.H{
+				"errorMessage": gin.H{"type": "string"},
+				"errorCode":    gin.H{"type": "string"},
+			},
+			"required": []string{"errorMessage"},
+		},
+	}
+	paths := gin.H{
+		"/healthz": healthOperation("healthz", "Ping the backend."),
+		"/readyz":  healthOperation("readyz", "Report whether the server accepts requests."),
+	}
+	for _, spec := range gowebdis.CommandSpecs() {
+		if spec.Internal {
+			continue
+		}
+		schemas[schemaName(spec.Name)+"Request"] = requestSchema(spec)
+		schemas[schemaName(spec.Name)+"Response"] = responseSchema(spec)
+		paths["/"+spec.Name] = gin.H{"post": commandOperation(spec)}
+		if spec.ReadOnly {
+			paths["/read/"+spec.Name+"/{key}"] = gin.H{"get": readOperation(spec)}
+		}
+	}
+
+	schemas["BatchRequest"] = batchRequestSchema()
+	schemas["BatchResponse"] = gin.H{
+		"type": "object",
+		"properties": gin.H{
+			"results": gin.H{
+				"type":        "array",
+				"description": "Reply of every command as returned by its endpoint, with its HTTP status.",
+				"items":       gin.H{"type": "object", "additionalProperties": true},
+			},
+		},
+	}
+	paths["/batch"] = gin.H{"post": batchOperation("batch", "Run commands one after the other, each on its own backend. Not atomic.")}
+	paths["/transaction"] = gin.H{"post": batchOperation("transaction", "Run commands atomically with MULTI/EXEC on a single backend.")}
+	paths["/subscribe/{channel}"] = gin.H{"get": subscribeOperation()}
+	schemas["Document"] = gin.H{"type": "object", "additionalProperties": true}
+	paths["/doc/{key}"] = documentOperations()
+
+	responses := gin.H{}
+	for status, description := range errorDescriptions {
+		responses["Error"+status] = gin.H{
+			"description": description,
+			"content":     gin.H{"application/json": gin.H{"schema": schemaRef("Error")}},
+		}
+	}
+
+	backends := gowebdis.BackendNames()
+	defaultBackend := viper.GetString("default-backend")
+	if len(backends) > 0 && !containsString(backends, defaultBackend) {
+		defaultBackend = backends[0]
+	}
+
+	return gin.H{
+		"openapi": "3.0.3",
+		"info": gin.H{
+			"title":       "gowebdis",
+			"description": "HTTP API for redis.",
+			"version":     openapiVersion,
+		},
+		"servers": []gin.H{
+			{"url": "/"},
+			{
+				"url":       "/backend/{backend}",
+				"variables": gin.H{"backend": gin.H{"default": defaultBackend, "enum": backends}},
+			},
+		},
+		"security": []gin.H{{}, {"bearerAuth": []string{}}},
+		"paths":    paths,
+		"components": gin.H{
+			"schemas":   schemas,
+			"responses": responses,
+			"parameters": gin.H{
+				"Backend": gin.H{
+					"name": viper.GetString("backend-header"), "in": "header",
+					"description": "Backend serving the request.",
+					"schema":      gin.H{"type": "string"},
+				},
+				"ReadFrom": gin.H{
+					"name": viper.GetString("read-from-header"), "in": "header",
+					"description": "Set to master to read your own writes.",
+					"schema":      gin.H{"type": "string", "enum": []string{"master"}},
+				},
+				"IfMatch": gin.H{
+					"name": "If-Match", "in": "header",
+					"description": "ETag of the version the write expects, requires --version-field.",
+					"schema":      gin.H{"type": "string"},
+				},
+				"IdempotencyKey": gin.H{
+					"name": viper.GetString("idempotency-header"), "in": "header",
+					"description": "Replays the result of an earlier write with the same key.",
+					"schema":      gin.H{"type": "string"},
+				},
+			},
+			"securitySchemes": gin.H{
+				"bearerAuth": gin.H{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/codelity/gowebdis/internal/gowebdis"
+)
+
+// readCommand serves read-only commands over GET so that replies can be
+// cached by browsers and CDNs, e.g. GET /read/hgetall/user:1. Replies carry
+// an ETag, If-None-Match is answered with 304 and Cache-Control is derived
+// from --cache-control-max-age or the remaining TTL of the key.
+func readCommand(context *gin.Context) {
+	command := context.Param("command")
+	if !gowebdis.IsReadCommand(command) {
+		context.JSON(404, gin.H{"errorMessage": command + " is not a read command"})
+		return
+	}
+
+	var jsonPayload gowebdis.JsonPayload
+	jsonPayload.Key = strings.TrimPrefix(context.Param("key"), "/")
+	jsonPayload.Path = context.Query("path")
+	err := validateJsonPayload(command, jsonPayload)
+	if err != nil {
+		log.Error("[ERROR] " + err.Error())
+		context.JSON(400, gin.H{"errorMessage": err.Error()})
+		return
+	}
+
+	backend := resolveBackend(context, jsonPayload.Key)
+	if backend == nil {
+		return
+	}
+	options := commandOptions(context, gowebdis.RouteRead)
+	commandResponse := gowebdis.RunRedisCommand(backend, command, jsonPayload, options)
+	if !commandResponse.Success {
+		commandError(context, commandResponse)
+		return
+	}
+
+	responsePayload := encodeResponse(commandResponse)
+	etag, err := responseEtag(commandResponse, responsePayload)
+	if err != nil {
+		context.JSON(500, gin.H{"errorMessage": err.Error()})
+		return
+	}
+	context.Header("ETag", etag)
+	context.Header("Cache-Control", cacheControl(context, backend, jsonPayload.Key, options))
+	if etagMatches(context.GetHeader("If-None-Match"), etag) {
+		context.Status(304)
+		return
+	}
+	context.JSON(200, responsePayload)
+}
+
+// responseEtag uses the version of a hash read when --version-field is
+// set and the hash has one, and a digest of the payload otherwise.
+func responseEtag(commandResponse gowebdis.CommandResponse, responsePayload map[string]interface{}) (string, error) {
+	if len(commandResponse.Version) > 0 {
+		return strconv.Quote("v" + commandResponse.Version), nil
+	}
+	body, err := json.Marshal(responsePayload)
+	if err != nil {
+		return "", err
+	}
+	digest := sha1.Sum(body)
+	return strconv.Quote(hex.EncodeToString(digest[:])), nil
+}
+
+// etagMatches implements the weak comparison of If-None-Match.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if len(ifNoneMatch) == 0 {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func cacheControl(context *gin.Context, backend *gowebdis.Backend, key string, options gowebdis.CommandOptions) string {
+	maxAge := viper.GetInt("cache-control-max-age")
+	if viper.GetBool("cache-control-from-ttl") {
+		ttl, err := gowebdis.KeyTTL(backend, key, options)
+		if err != nil {
+			log.Error("[ERROR] " + err.Error())
+		} else if ttl > 0 {
+			maxAge = int(ttl.Seconds())
+		}
+	}
+	if maxAge <= 0 {
+		return "no-cache"
+	}
+	// Replies to authenticated callers must not be shared by CDNs.
+	visibility := "public"
+	if len(context.GetHeader("Authorization")) > 0 {
+		visibility = "private"
+	}
+	return visibility + ", max-age=" + strconv.Itoa(maxAge)
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+
+	"github.com/codelity/gowebdis/internal/gowebdis"
+)
+
+type contextKey string
+
+const backendContextKey = contextKey("backend")
+const identityContextKey = "identity"
+
+const backendPathPrefix = "/backend/"
+
+// backendPrefixHandler strips a /backend/{name} prefix from the request
+// path before it reaches the router, so /backend/sessions/hgetall is served
+// by the same handler as /hgetall but against the "sessions" backend.
+func backendPrefixHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if strings.HasPrefix(request.URL.Path, backendPathPrefix) {
+			rest := strings.TrimPrefix(request.URL.Path, backendPathPrefix)
+			name := rest
+			path := "/"
+			if idx := strings.Index(rest, "/"); idx > -1 {
+				name = rest[:idx]
+				path = rest[idx:]
+			}
+			ctx := context.WithValue(request.Context(), backendContextKey, name)
+			request = request.WithContext(ctx)
+			request.URL.Path = path
+			request.URL.RawPath = ""
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// requestedBackend returns the backend named by the URL prefix or, failing
+// that, by the backend header.
+func requestedBackend(context *gin.Context) string {
+	if name, ok := context.Request.Context().Value(backendContextKey).(string); ok {
+		return name
+	}
+	return context.GetHeader(viper.GetString("backend-header"))
+}
+
+// resolveBackend selects and authorizes the backend of a request. It writes
+// the error response itself and returns nil when the request must stop.
+func resolveBackend(context *gin.Context, key string) *gowebdis.Backend {
+	backend, status, errorPayload := selectBackend(context, key)
+	if backend == nil {
+		context.JSON(status, errorPayload)
+	}
+	return backend
+}
+
+// selectBackend selects and authorizes the backend of a key, returning the
+// status and payload of the error response when it cannot be used.
+func selectBackend(context *gin.Context, key string) (*gowebdis.Backend, int, gin.H) {
+	backend, err := gowebdis.ResolveBackend(requestedBackend(context), key)
+	if err != nil {
+		return nil, 404, gin.H{"errorMessage": err.Error()}
+	}
+	identity := requestIdentity(context)
+	if !backend.Authorize(identity) {
+		if identity.Name == gowebdis.AnonymousIdentity.Name {
+			return nil, 401, gin.H{"errorMessage": "Authentication required for backend " + backend.Name}
+		}
+		return nil, 403, gin.H{"errorMessage": identity.Name + " is not allowed to use backend " + backend.Name}
+	}
+	return backend, 0, nil
+}
+
+// authenticate resolves the bearer token of the request into an identity.
+// Unknown tokens are rejected, requests without a token run anonymously.
+func authenticate(context *gin.Context) {
+	identity := gowebdis.AnonymousIdentity
+	authorization := context.GetHeader("Authorization")
+	if len(authorization) > 0 {
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			context.AbortWithStatusJSON(401, gin.H{"errorMessage": "Unsupported authorization scheme"})
+			return
+		}
+		var ok bool
+		identity, ok = gowebdis.Authenticate(strings.TrimPrefix(authorization, "Bearer "))
+		if !ok {
+			context.AbortWithStatusJSON(401, gin.H{"errorMessage": "Invalid token"})
+			return
+		}
+	}
+	context.Set(identityContextKey, identity)
+	context.Next()
+}
+
+// requireAdminRole restricts a route listed in --admin-routes to the
+// identities with the --admin-role role.
+func requireAdminRole(route string) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if !isAdminRoute(route) {
+			return
+		}
+		identity := requestIdentity(context)
+		adminRole := viper.GetString("admin-role")
+		if identity.HasRole(adminRole) {
+			return
+		}
+		if identity.Name == gowebdis.AnonymousIdentity.Name {
+			context.AbortWithStatusJSON(401, gin.H{"errorMessage": "Authentication required for " + route})
+			return
+		}
+		context.AbortWithStatusJSON(403, gin.H{"errorMessage": route + " requires the " + adminRole + " role"})
+	}
+}
+
+func isAdminRoute(route string) bool {
+	for _, adminRoute := range strings.Split(viper.GetString("admin-routes"), ",") {
+		if strings.TrimSpace(adminRoute) == route {
+			return true
+		}
+	}
+	return false
+}
+
+func requestIdentity(context *gin.Context) gowebdis.Identity {
+	if value, ok := context.Get(identityContextKey); ok {
+		return value.(gowebdis.Identity)
+	}
+	return gowebdis.AnonymousIdentity
+}
+
+func commandOptions(context *gin.Context, route string) gowebdis.CommandOptions {
+	var options gowebdis.CommandOptions
+	options.Route = route
+	options.ReadFromMaster = strings.EqualFold(context.GetHeader(viper.GetString("read-from-header")), "master")
+	options.IfMatch = ifMatchVersion(context.GetHeader("If-Match"))
+	options.IdempotencyKey = context.GetHeader(viper.GetString("idempotency-header"))
+	options.Identity = requestIdentity(context)
+	options.SourceIP = context.ClientIP()
+	return options
+}
+
+// ifMatchVersion extracts the version from an If-Match header carrying an
+// ETag such as "v3". Any other ETag is passed on as is and never matches.
+func ifMatchVersion(ifMatch string) string {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "*" {
+		return ifMatch
+	}
+	return strings.TrimPrefix(strings.Trim(ifMatch, `"`), "v")
+}
+
+func metricsCommand(context *gin.Context) {
+	context.Header("Content-Type", "text/plain; version=0.0.4")
+	context.Status(200)
+	gowebdis.WriteMetrics(context.Writer)
+}
+
+func cacheStatsCommand(context *gin.Context) {
+	context.JSON(200, gowebdis.CacheStatistics())
+}
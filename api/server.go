@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/codelity/gowebdis/internal/gowebdis"
+)
+
+// ready is 1 while the server accepts traffic and is flipped to 0 as soon as
+// a shutdown signal is received so that /readyz starts failing.
+var ready int32
+
+// shutdownCh is closed when the server starts shutting down. Long-lived
+// handlers (long-polls, SSE streams) must select on shutdownChannel and
+// return so that they can be drained within the grace period.
+var shutdownCh = make(chan struct{})
+var draining bool
+var shutdownMutex sync.Mutex
+
+func shutdownChannel() <-chan struct{} {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	return shutdownCh
+}
+
+// MarkReady makes /readyz succeed, for applications serving the API
+// themselves, including after Drain.
+func MarkReady() {
+	shutdownMutex.Lock()
+	if draining {
+		shutdownCh = make(chan struct{})
+		draining = false
+	}
+	shutdownMutex.Unlock()
+	atomic.StoreInt32(&ready, 1)
+}
+
+// Drain makes /readyz fail and ends long-lived handlers until MarkReady.
+func Drain() {
+	atomic.StoreInt32(&ready, 0)
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if !draining {
+		close(shutdownCh)
+		draining = true
+	}
+}
+
+func newHttpServer(handler http.Handler) (*http.Server, error) {
+	tlsConfig, err := newServerTlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil && viper.GetBool("h2c") {
+		// Plaintext HTTP/2 for internal callers; TLS connections negotiate
+		// HTTP/2 through ALPN instead.
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	server := &http.Server{
+		Addr:      listenAddress(),
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+
+	readTimeout := viper.GetInt("server-read-timeout")
+	readHeaderTimeout := viper.GetInt("server-read-header-timeout")
+	writeTimeout := viper.GetInt("server-write-timeout")
+	idleTimeout := viper.GetInt("server-idle-timeout")
+
+	if readTimeout > -1 {
+		server.ReadTimeout = time.Duration(readTimeout) * time.Second
+	}
+	if readHeaderTimeout > -1 {
+		server.ReadHeaderTimeout = time.Duration(readHeaderTimeout) * time.Second
+	}
+	if writeTimeout > -1 {
+		server.WriteTimeout = time.Duration(writeTimeout) * time.Second
+	}
+	if idleTimeout > -1 {
+		server.IdleTimeout = time.Duration(idleTimeout) * time.Second
+	}
+	server.RegisterOnShutdown(Drain)
+	return server, nil
+}
+
+// listenAddress returns either a host:port pair or a unix:/path/to/socket
+// address. Without --listen the PORT environment variable is honoured.
+func listenAddress() string {
+	address := viper.GetString("listen")
+	if len(address) > 0 {
+		return address
+	}
+	port := os.Getenv("PORT")
+	if len(port) == 0 {
+		port = "8080"
+	}
+	return ":" + port
+}
+
+func listen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix:") {
+		socketPath := strings.TrimPrefix(address, "unix:")
+		// Remove a stale socket left behind by a previous process.
+		if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(socketPath)
+		}
+		return net.Listen("unix", socketPath)
+	}
+	return net.Listen("tcp", address)
+}
+
+func serve(server *http.Server) {
+	listener, err := listen(server.Addr)
+	if err != nil {
+		log.Error("[ERROR] " + err.Error())
+		gowebdis.CloseConnection()
+		return
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			log.Info("[INFO] Listening on " + server.Addr + " (TLS)")
+			errCh <- server.ServeTLS(listener, "", "")
+		} else {
+			log.Info("[INFO] Listening on " + server.Addr)
+			errCh <- server.Serve(listener)
+		}
+	}()
+	MarkReady()
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signalCh)
+
+	select {
+	case err := <-errCh:
+		if err != nil && err != http.ErrServerClosed {
+			log.Error("[ERROR] " + err.Error())
+		}
+	case sig := <-signalCh:
+		log.Info("[INFO] Received " + sig.String() + ", shutting down")
+		shutdown(server)
+	}
+	gowebdis.CloseConnection()
+}
+
+func shutdown(server *http.Server) {
+	atomic.StoreInt32(&ready, 0)
+
+	// Give load balancers a chance to observe the failing readiness probe
+	// before we stop accepting new connections.
+	shutdownDelay := viper.GetInt("shutdown-delay")
+	if shutdownDelay > 0 {
+		time.Sleep(time.Duration(shutdownDelay) * time.Second)
+	}
+
+	gracePeriod := time.Duration(viper.GetInt("shutdown-grace-period")) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Error("[ERROR] Graceful shutdown did not complete: " + err.Error())
+		server.Close()
+	} else {
+		log.Info("[INFO] All in-flight requests drained")
+	}
+}
+
+func readyCommand(context *gin.Context) {
+	if atomic.LoadInt32(&ready) == 1 {
+		context.JSON(200, gin.H{"boolVal": true, "circuitBreakers": gowebdis.CircuitBreakerStates()})
+	} else {
+		context.JSON(503, gin.H{"errorMessage": "Server is shutting down"})
+	}
+	return
+}
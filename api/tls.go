@@ -0,0 +1,161 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// certReloader serves the configured key pair and reloads it whenever the
+// certificate or key file changes on disk, so rotated certificates are
+// picked up without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex       sync.RWMutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	err := reloader.reload()
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (reloader *certReloader) reload() error {
+	certInfo, err := os.Stat(reloader.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(reloader.keyFile)
+	if err != nil {
+		return err
+	}
+
+	reloader.mutex.RLock()
+	unchanged := reloader.cert != nil &&
+		certInfo.ModTime().Equal(reloader.certModTime) &&
+		keyInfo.ModTime().Equal(reloader.keyModTime)
+	reloader.mutex.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+	reloader.mutex.Lock()
+	reloader.cert = &cert
+	reloader.certModTime = certInfo.ModTime()
+	reloader.keyModTime = keyInfo.ModTime()
+	reloader.mutex.Unlock()
+	log.Info("[INFO] Loaded TLS certificate " + reloader.certFile)
+	return nil
+}
+
+func (reloader *certReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	err := reloader.reload()
+	if err != nil {
+		// Keep serving the last good certificate while files are being
+		// replaced.
+		log.Error("[ERROR] Cannot reload TLS certificate: " + err.Error())
+	}
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+	return reloader.cert, nil
+}
+
+// newServerTlsConfig returns nil when no certificate is configured.
+func newServerTlsConfig() (*tls.Config, error) {
+	certFile := viper.GetString("tls-cert")
+	keyFile := viper.GetString("tls-key")
+	if len(certFile) == 0 && len(keyFile) == 0 {
+		return nil, nil
+	}
+	if len(certFile) == 0 || len(keyFile) == 0 {
+		return nil, errors.New("both --tls-cert and --tls-key must be set")
+	}
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		GetCertificate: reloader.getCertificate,
+	}
+
+	minVersion := viper.GetString("tls-min-version")
+	if len(minVersion) > 0 {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS version %v", minVersion)
+		}
+		config.MinVersion = version
+	}
+
+	cipherSuites := viper.GetString("tls-cipher-suites")
+	if len(cipherSuites) > 0 {
+		for _, name := range strings.Split(cipherSuites, ",") {
+			suite, ok := tlsCipherSuites[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unsupported TLS cipher suite %v", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, suite)
+		}
+	}
+
+	clientCaFile := viper.GetString("tls-client-ca")
+	if len(clientCaFile) > 0 {
+		caBundle, err := ioutil.ReadFile(clientCaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificates found in %v", clientCaFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// Batch queues commands that Exec sends in a single request. A batch from
+// Client.Batch runs the commands one after the other, each succeeding or
+// failing on its own; one from Client.Transaction runs them atomically with
+// MULTI/EXEC on a single backend. Batches are never retried.
+type Batch struct {
+	client   *Client
+	path     string
+	commands []batchCommand
+}
+
+type batchCommand struct {
+	Command string `json:"command"`
+	payload
+}
+
+// Result is the reply of one command of a batch.
+type Result struct {
+	Status           int      `json:"status"`
+	ErrorMessage     string   `json:"errorMessage"`
+	ErrorCode        string   `json:"errorCode"`
+	ETag             string   `json:"etag"`
+	BoolValue        bool     `json:"boolValue"`
+	IntValue         int64    `json:"intValue"`
+	StringValue      string   `json:"stringValue"`
+	StringArrayValue []string `json:"stringArrayValue"`
+}
+
+// Err returns the error of the command, nil when it succeeded.
+func (result Result) Err() error {
+	if result.Status >= 200 && result.Status <= 299 {
+		return nil
+	}
+	return &Error{StatusCode: result.Status, Code: result.ErrorCode, Message: result.ErrorMessage}
+}
+
+// Batch starts a batch of independent commands.
+func (c *Client) Batch() *Batch {
+	return &Batch{client: c, path: "/batch"}
+}
+
+// Transaction starts a batch of commands applied atomically.
+func (c *Client) Transaction() *Batch {
+	return &Batch{client: c, path: "/transaction"}
+}
+
+func (b *Batch) HSet(key string, field string, value string) *Batch {
+	b.commands = append(b.commands, batchCommand{Command: "hset", payload: payload{Key: key, Field: field, Value: value}})
+	return b
+}
+
+func (b *Batch) HDel(key string, fields ...string) *Batch {
+	b.commands = append(b.commands, batchCommand{Command: "hdel", payload: payload{Key: key, Fields: fields}})
+	return b
+}
+
+func (b *Batch) HGetAll(key string) *Batch {
+	b.commands = append(b.commands, batchCommand{Command: "hgetall", payload: payload{Key: key}})
+	return b
+}
+
+// Len returns the number of queued commands.
+func (b *Batch) Len() int {
+	return len(b.commands)
+}
+
+// Exec sends the queued commands and returns their results in order. The
+// error is set when the batch as a whole failed; failures of single
+// commands are reported by Result.Err.
+func (b *Batch) Exec(ctx context.Context) ([]Result, error) {
+	var r struct {
+		Results []Result `json:"results"`
+	}
+	_, err := b.client.do(ctx, call{
+		method: http.MethodPost,
+		path:   b.path,
+		body:   map[string]interface{}{"commands": b.commands},
+	}, &r)
+	if err != nil {
+		return nil, err
+	}
+	return r.Results, nil
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	redisServer.FlushAll()
+	ctx, cancel := testContext()
+	defer cancel()
+	c := newTestClient(t, apiServer.URL)
+	results, err := c.Batch().
+		HSet("batch:1", "name", "ada").
+		HSet("batch:1", "_v", "7").
+		HGetAll("batch:1").
+		Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Exec returned %v results", len(results))
+	}
+	if err := results[0].Err(); err != nil || !results[0].BoolValue {
+		t.Errorf("hset = %+v", results[0])
+	}
+	if err := results[1].Err(); err == nil {
+		t.Error("hset of the version field succeeded")
+	} else if apiErr := err.(*Error); apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("hset of the version field = %v", err)
+	}
+	if err := results[2].Err(); err != nil || !reflect.DeepEqual(results[2].StringArrayValue, []string{"ada"}) {
+		t.Errorf("hgetall = %+v", results[2])
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	redisServer.FlushAll()
+	ctx, cancel := testContext()
+	defer cancel()
+	c := newTestClient(t, apiServer.URL)
+	transaction := c.Transaction().
+		HSet("transaction:1", "name", "ada").
+		HSet("transaction:1", "email", "ada@example.com").
+		HGetAll("transaction:1")
+	if transaction.Len() != 3 {
+		t.Errorf("Len = %v", transaction.Len())
+	}
+	results, err := transaction.Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, result := range results {
+		if err := result.Err(); err != nil {
+			t.Errorf("command %v: %v", idx, err)
+		}
+	}
+	if len(results) != 3 || !reflect.DeepEqual(results[2].StringArrayValue, []string{"ada@example.com", "ada"}) {
+		t.Errorf("transaction results = %+v", results)
+	}
+
+	_, err = c.Transaction().
+		HSet("transaction:2", "name", "ada").
+		HDel("transaction:2", "_v").
+		Exec(ctx)
+	if apiErr, ok := err.(*Error); !ok || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("transaction deleting the version field = %v, want 400", err)
+	}
+	if redisServer.Exists("transaction:2") {
+		t.Error("refused transaction ran some of its commands")
+	}
+}
@@ -0,0 +1,233 @@
+// Package client is a Go client of the gowebdis HTTP API.
+//
+//	c, err := client.New("http://gowebdis:8080", client.WithToken(token))
+//	ok, err := c.HSet(ctx, "user:1", "name", "ann")
+//	values, err := c.HGetAll(ctx, "user:1")
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Default header names of the gowebdis server.
+const (
+	readFromHeader       = "X-Gowebdis-Read-From"
+	idempotencyKeyHeader = "Idempotency-Key"
+)
+
+// Client calls a gowebdis server. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	token      string
+	backend    string
+
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used to send requests, by default
+// http.DefaultClient. Timeouts are best set through the context of each
+// call since subscriptions are long-lived.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithToken authenticates requests with a bearer token.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithBackend sends every request to a named backend of the server.
+func WithBackend(name string) Option {
+	return func(c *Client) {
+		c.backend = name
+	}
+}
+
+// WithRetries sets how often a request is retried after a network error or
+// a 503, waiting from minBackoff doubling up to maxBackoff in between.
+// Reads are always safe to retry; writes are retried with an
+// Idempotency-Key so that they are applied once. The default is 3 retries
+// from 50ms to 1s, 0 disables retries.
+func WithRetries(maxRetries int, minBackoff time.Duration, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.minBackoff = minBackoff
+		c.maxBackoff = maxBackoff
+	}
+}
+
+// New returns a client of the gowebdis server at baseURL.
+func New(baseURL string, options ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("gowebdis: unsupported URL scheme %v", u.Scheme)
+	}
+	c := &Client{
+		baseURL:    strings.TrimSuffix(u.String(), "/"),
+		httpClient: http.DefaultClient,
+		maxRetries: 3,
+		minBackoff: 50 * time.Millisecond,
+		maxBackoff: time.Second,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c, nil
+}
+
+func (c *Client) url(path string) string {
+	if len(c.backend) > 0 {
+		return c.baseURL + "/backend/" + url.PathEscape(c.backend) + path
+	}
+	return c.baseURL + path
+}
+
+// call is one API request. Retryable requests are sent again after a
+// network error or a 503.
+type call struct {
+	method    string
+	path      string
+	body      interface{}
+	headers   map[string]string
+	retryable bool
+}
+
+func (c *Client) newRequest(ctx context.Context, method string, path string, body []byte, headers map[string]string) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequest(method, c.url(path), reader)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if len(c.token) > 0 {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	for name, value := range headers {
+		if len(value) > 0 {
+			request.Header.Set(name, value)
+		}
+	}
+	return request, nil
+}
+
+// do sends the call and decodes the reply into reply, returning the
+// headers of the response.
+func (c *Client) do(ctx context.Context, cl call, reply interface{}) (http.Header, error) {
+	var body []byte
+	if cl.body != nil {
+		var err error
+		body, err = json.Marshal(cl.body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	attempts := 1
+	if cl.retryable && c.maxRetries > 0 {
+		attempts += c.maxRetries
+	}
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			err := c.sleep(ctx, attempt)
+			if err != nil {
+				return nil, err
+			}
+		}
+		request, err := c.newRequest(ctx, cl.method, cl.path, body, cl.headers)
+		if err != nil {
+			return nil, err
+		}
+		response, err := c.httpClient.Do(request)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		header, err := decodeResponse(response, reply)
+		if apiErr, ok := err.(*Error); ok && apiErr.StatusCode == http.StatusServiceUnavailable {
+			lastErr = err
+			continue
+		}
+		return header, err
+	}
+	return nil, lastErr
+}
+
+// sleep waits before a retry, doubling the backoff on each attempt.
+func (c *Client) sleep(ctx context.Context, attempt int) error {
+	backoff := c.minBackoff
+	for i := 1; i < attempt && backoff < c.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > c.maxBackoff {
+		backoff = c.maxBackoff
+	}
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func decodeResponse(response *http.Response, reply interface{}) (http.Header, error) {
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.Header, newError(response.StatusCode, body)
+	}
+	if reply != nil {
+		err = json.Unmarshal(body, reply)
+		if err != nil {
+			return response.Header, fmt.Errorf("gowebdis: invalid reply: %v", err)
+		}
+	}
+	return response.Header, nil
+}
+
+// newIdempotencyKey returns a random key making a write safe to retry.
+func newIdempotencyKey() string {
+	buffer := make([]byte, 16)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buffer)
+}
@@ -0,0 +1,258 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+
+	"github.com/codelity/gowebdis/server"
+)
+
+// The tests run the API of the server package over miniredis. The secure
+// backend is restricted to the ops role and denies hdel, the flaky one is
+// stopped by TestUnavailableBackend. Tests writing to redis flush it first.
+var (
+	redisServer *miniredis.Miniredis
+	flakyRedis  *miniredis.Miniredis
+	apiServer   *httptest.Server
+	apiHandler  http.Handler
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	var err error
+	redisServer, err = miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	flakyRedis, err = miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	srv, err := server.New(server.Options{
+		Backends: map[string]server.Backend{
+			"default": {RedisURL: "redis://" + redisServer.Addr() + "/0"},
+			"secure": {
+				RedisURL: "redis://" + redisServer.Addr() + "/1",
+				Roles:    []string{"ops"},
+				Settings: map[string]interface{}{"command-deny": "hdel"},
+			},
+			"flaky": {RedisURL: "redis://" + flakyRedis.Addr() + "/0"},
+		},
+		DefaultBackend: "default",
+		Tokens: []server.Token{
+			{Token: "web-token", Identity: "web"},
+			{Token: "ops-token", Identity: "ops", Roles: []string{"ops"}},
+		},
+		Settings: map[string]interface{}{"version-field": "_v"},
+	})
+	if err != nil {
+		panic(err)
+	}
+	apiHandler = srv.Handler()
+	apiServer = httptest.NewServer(apiHandler)
+
+	code := m.Run()
+	apiServer.Close()
+	srv.Close()
+	redisServer.Close()
+	flakyRedis.Close()
+	os.Exit(code)
+}
+
+func newTestClient(t *testing.T, baseURL string, options ...Option) *Client {
+	c, err := New(baseURL, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 10*time.Second)
+}
+
+// failingHandler answers the first failures requests with 503 before
+// passing requests to the API, recording their Idempotency-Key.
+type failingHandler struct {
+	mutex           sync.Mutex
+	failures        int
+	requests        int
+	idempotencyKeys []string
+}
+
+func (h *failingHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	h.mutex.Lock()
+	h.requests++
+	h.idempotencyKeys = append(h.idempotencyKeys, request.Header.Get(idempotencyKeyHeader))
+	failing := h.requests <= h.failures
+	h.mutex.Unlock()
+	if failing {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		writer.Write([]byte(`{"errorMessage":"circuit breaker open","errorCode":"unavailable"}`))
+		return
+	}
+	apiHandler.ServeHTTP(writer, request)
+}
+
+func TestRetries(t *testing.T) {
+	redisServer.FlushAll()
+	ctx, cancel := testContext()
+	defer cancel()
+	handler := &failingHandler{failures: 2}
+	failing := httptest.NewServer(handler)
+	defer failing.Close()
+
+	c := newTestClient(t, failing.URL, WithRetries(2, time.Millisecond, 2*time.Millisecond))
+	added, err := c.HSet(ctx, "retry:1", "name", "ada")
+	if err != nil || !added {
+		t.Fatalf("HSet after two 503 = %v, %v", added, err)
+	}
+	if handler.requests != 3 {
+		t.Errorf("HSet sent %v requests, want 3", handler.requests)
+	}
+	for _, key := range handler.idempotencyKeys {
+		if len(key) == 0 || key != handler.idempotencyKeys[0] {
+			t.Errorf("retries sent Idempotency-Keys %q, want one key", handler.idempotencyKeys)
+			break
+		}
+	}
+
+	handler = &failingHandler{failures: 10}
+	failing.Config.Handler = handler
+	_, err = c.HGetAll(ctx, "retry:1")
+	if !IsUnavailable(err) {
+		t.Errorf("HGetAll after exhausted retries = %v, want unavailable", err)
+	}
+	if handler.requests != 3 {
+		t.Errorf("HGetAll sent %v requests, want 3", handler.requests)
+	}
+
+	handler = &failingHandler{failures: 1}
+	failing.Config.Handler = handler
+	c = newTestClient(t, failing.URL, WithRetries(0, 0, 0))
+	_, err = c.HSet(ctx, "retry:1", "name", "grace")
+	if !IsUnavailable(err) || handler.requests != 1 || len(handler.idempotencyKeys[0]) > 0 {
+		t.Errorf("HSet without retries = %v after %v requests with key %q", err, handler.requests, handler.idempotencyKeys[0])
+	}
+}
+
+func TestAuthOptions(t *testing.T) {
+	redisServer.FlushAll()
+	ctx, cancel := testContext()
+	defer cancel()
+	_, err := newTestClient(t, apiServer.URL, WithToken("unknown")).HGetAll(ctx, "user:1")
+	if apiErr, ok := err.(*Error); !ok || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unknown token = %v, want 401", err)
+	}
+
+	_, err = newTestClient(t, apiServer.URL, WithBackend("secure")).HSet(ctx, "user:1", "name", "ada")
+	if apiErr, ok := err.(*Error); !ok || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous on a restricted backend = %v, want 401", err)
+	}
+	_, err = newTestClient(t, apiServer.URL, WithBackend("secure"), WithToken("web-token")).HSet(ctx, "user:1", "name", "ada")
+	if !IsForbidden(err) {
+		t.Errorf("identity without the role of the backend = %v, want forbidden", err)
+	}
+
+	ops := newTestClient(t, apiServer.URL, WithBackend("secure"), WithToken("ops-token"))
+	if _, err := ops.HSet(ctx, "user:1", "name", "ada"); err != nil {
+		t.Fatalf("identity with the role of the backend: %v", err)
+	}
+	if values, err := ops.HGetAll(ctx, "user:1"); err != nil || len(values) != 1 || values[0] != "ada" {
+		t.Errorf("HGetAll on secure = %v, %v", values, err)
+	}
+	if got := redisServer.DB(1).HGet("user:1", "name"); got != "ada" {
+		t.Errorf("secure backend wrote %q to its database", got)
+	}
+	_, err = ops.HDel(ctx, "user:1", []string{"name"})
+	if apiErr, ok := err.(*Error); !IsForbidden(err) || !ok || apiErr.Code != CodeForbidden {
+		t.Errorf("denied command = %v, want forbidden with code %v", err, CodeForbidden)
+	}
+}
+
+// TestHealthWithoutToken probes a backend restricted to a role, which
+// only its commands require.
+func TestHealthWithoutToken(t *testing.T) {
+	for path, status := range map[string]int{
+		"/backend/secure/healthz":  http.StatusOK,
+		"/backend/unknown/healthz": http.StatusNotFound,
+	} {
+		response, err := http.Get(apiServer.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != status {
+			t.Errorf("%v without token = %v, want %v", path, response.StatusCode, status)
+		}
+	}
+	ctx, cancel := testContext()
+	defer cancel()
+	err := newTestClient(t, apiServer.URL, WithBackend("secure")).Ping(ctx, "user:1")
+	if apiErr, ok := err.(*Error); !ok || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous ping command on a restricted backend = %v, want 401", err)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	redisServer.FlushAll()
+	ctx, cancel := testContext()
+	defer cancel()
+	c := newTestClient(t, apiServer.URL)
+	var etag string
+	if _, err := c.HSet(ctx, "account:1", "balance", "10", ETag(&etag)); err != nil {
+		t.Fatal(err)
+	}
+	if etag != `"v1"` {
+		t.Errorf("ETag of the first versioned write is %v", etag)
+	}
+	_, err := c.HSet(ctx, "account:1", "balance", "20", IfMatch(`"v7"`))
+	if apiErr, ok := err.(*Error); !IsPreconditionFailed(err) || !ok || apiErr.Code != CodePreconditionFailed {
+		t.Errorf("stale If-Match = %v, want precondition failed", err)
+	}
+	if _, err := c.HSet(ctx, "account:1", "balance", "20", IfMatch(etag)); err != nil {
+		t.Errorf("current If-Match: %v", err)
+	}
+
+	var document map[string]interface{}
+	err = c.GetDocument(ctx, "missing:1", &document)
+	if !IsNotFound(err) || IsForbidden(err) {
+		t.Errorf("missing document = %v, want not found", err)
+	}
+	_, err = newTestClient(t, apiServer.URL, WithBackend("unknown")).HGetAll(ctx, "user:1")
+	if !IsNotFound(err) {
+		t.Errorf("unknown backend = %v, want not found", err)
+	}
+
+	_, err = c.HSet(ctx, "account:1", "_v", "9")
+	if apiErr, ok := err.(*Error); !ok || apiErr.StatusCode != http.StatusBadRequest || len(apiErr.Code) > 0 {
+		t.Errorf("write of the version field = %v, want a plain 400", err)
+	}
+}
+
+// TestUnavailableBackend stops the redis of the flaky backend until it
+// returns.
+func TestUnavailableBackend(t *testing.T) {
+	ctx, cancel := testContext()
+	defer cancel()
+	retrying := newTestClient(t, apiServer.URL, WithBackend("flaky"), WithRetries(3, time.Millisecond, 10*time.Millisecond))
+	if err := retrying.Ping(ctx, "user:1"); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, apiServer.URL, WithBackend("flaky"), WithRetries(0, 0, 0))
+	flakyRedis.Close()
+	defer flakyRedis.Restart()
+	_, err := c.HSet(ctx, "user:1", "name", "ada")
+	if apiErr, ok := err.(*Error); !IsUnavailable(err) || !ok || apiErr.Code != CodeUnavailable {
+		t.Errorf("HSet on a stopped redis = %v, want unavailable", err)
+	}
+}
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// CommandOption changes how a single command is sent. Options that do not
+// apply to a command are ignored.
+type CommandOption func(*commandOptions)
+
+type commandOptions struct {
+	ifMatch        string
+	idempotencyKey string
+	fromMaster     bool
+	etag           *string
+}
+
+// IfMatch makes a write apply only when the key is at the version of the
+// ETag, e.g. one captured with ETag on an earlier read or write. The server
+// must run with --version-field; a stale version fails with an error for
+// which IsPreconditionFailed is true.
+func IfMatch(etag string) CommandOption {
+	return func(options *commandOptions) {
+		options.ifMatch = etag
+	}
+}
+
+// IdempotencyKey sets the Idempotency-Key of a write instead of a random
+// one, so that it is applied once across retries of the caller.
+func IdempotencyKey(key string) CommandOption {
+	return func(options *commandOptions) {
+		options.idempotencyKey = key
+	}
+}
+
+// FromMaster reads from the master rather than a replica, e.g. to read
+// one's own writes.
+func FromMaster() CommandOption {
+	return func(options *commandOptions) {
+		options.fromMaster = true
+	}
+}
+
+// ETag stores the ETag of the reply in etag: the version of the key after
+// a versioned write, or the ETag of a read.
+func ETag(etag *string) CommandOption {
+	return func(options *commandOptions) {
+		options.etag = etag
+	}
+}
+
+func applyOptions(options []CommandOption) commandOptions {
+	var applied commandOptions
+	for _, option := range options {
+		option(&applied)
+	}
+	return applied
+}
+
+func (options commandOptions) captureETag(header http.Header) {
+	if options.etag != nil && header != nil {
+		*options.etag = header.Get("ETag")
+	}
+}
+
+type payload struct {
+	Key    string   `json:"key"`
+	Field  string   `json:"field,omitempty"`
+	Fields []string `json:"fields,omitempty"`
+	Value  string   `json:"value,omitempty"`
+	Path   string   `json:"path,omitempty"`
+}
+
+type reply struct {
+	BoolValue        bool     `json:"boolValue"`
+	IntValue         int64    `json:"intValue"`
+	StringValue      string   `json:"stringValue"`
+	StringArrayValue []string `json:"stringArrayValue"`
+	// JSONValue is left undecoded for the caller, see JSONGet.
+	JSONValue json.RawMessage `json:"jsonValue"`
+}
+
+// write sends a write request, with an Idempotency-Key when it may be
+// retried.
+func (c *Client) write(ctx context.Context, method string, path string, body interface{}, options []CommandOption) (reply, error) {
+	applied := applyOptions(options)
+	idempotencyKey := applied.idempotencyKey
+	if len(idempotencyKey) == 0 && c.maxRetries > 0 {
+		idempotencyKey = newIdempotencyKey()
+	}
+	var r reply
+	header, err := c.do(ctx, call{
+		method: method,
+		path:   path,
+		body:   body,
+		headers: map[string]string{
+			"If-Match":           applied.ifMatch,
+			idempotencyKeyHeader: idempotencyKey,
+		},
+		retryable: len(idempotencyKey) > 0,
+	}, &r)
+	applied.captureETag(header)
+	return r, err
+}
+
+// Ping checks that the server reaches redis, routing by key when the
+// server routes keys to backends.
+func (c *Client) Ping(ctx context.Context, key string) error {
+	_, err := c.do(ctx, call{
+		method:    http.MethodPost,
+		path:      "/ping",
+		body:      payload{Key: key},
+		retryable: true,
+	}, nil)
+	return err
+}
+
+// HSet sets a field of a hash.
+func (c *Client) HSet(ctx context.Context, key string, field string, value string, options ...CommandOption) (bool, error) {
+	r, err := c.write(ctx, http.MethodPost, "/hset", payload{Key: key, Field: field, Value: value}, options)
+	return r.BoolValue, err
+}
+
+// HDel deletes fields of a hash and returns how many existed.
+func (c *Client) HDel(ctx context.Context, key string, fields []string, options ...CommandOption) (int64, error) {
+	r, err := c.write(ctx, http.MethodPost, "/hdel", payload{Key: key, Fields: fields}, options)
+	return r.IntValue, err
+}
+
+// HGetAll returns the values of all fields of a hash ordered by field. It
+// is served over GET, so replies may come from HTTP caches.
+func (c *Client) HGetAll(ctx context.Context, key string, options ...CommandOption) ([]string, error) {
+	applied := applyOptions(options)
+	headers := map[string]string{}
+	if applied.fromMaster {
+		headers[readFromHeader] = "master"
+	}
+	var r reply
+	header, err := c.do(ctx, call{
+		method:    http.MethodGet,
+		path:      "/read/hgetall/" + url.PathEscape(key),
+		headers:   headers,
+		retryable: true,
+	}, &r)
+	applied.captureETag(header)
+	return r.StringArrayValue, err
+}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHSetAndHGetAll(t *testing.T) {
+	redisServer.FlushAll()
+	ctx, cancel := testContext()
+	defer cancel()
+	c := newTestClient(t, apiServer.URL)
+	added, err := c.HSet(ctx, "user:42", "name", "ada")
+	if err != nil || !added {
+		t.Fatalf("HSet of a new field = %v, %v", added, err)
+	}
+	added, err = c.HSet(ctx, "user:42", "name", "Ada")
+	if err != nil || !added {
+		t.Errorf("HSet of an existing field = %v, %v", added, err)
+	}
+	if _, err := c.HSet(ctx, "user:42", "email", "ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	var etag string
+	values, err := c.HGetAll(ctx, "user:42", FromMaster(), ETag(&etag))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ada@example.com", "Ada"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("HGetAll = %q, want %q without the version field", values, want)
+	}
+	if etag != `"v3"` {
+		t.Errorf("ETag of HGetAll is %v, want the version", etag)
+	}
+
+	removed, err := c.HDel(ctx, "user:42", []string{"email", "phone"})
+	if err != nil || removed != 1 {
+		t.Errorf("HDel = %v, %v", removed, err)
+	}
+	values, err = c.HGetAll(ctx, "user:42")
+	if err != nil || !reflect.DeepEqual(values, []string{"Ada"}) {
+		t.Errorf("HGetAll after HDel = %q, %v", values, err)
+	}
+}
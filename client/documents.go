@@ -0,0 +1,47 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// GetDocument reads the JSON document stored at key into document, e.g. a
+// pointer to a struct or a map. A missing document fails with an error for
+// which IsNotFound is true.
+func (c *Client) GetDocument(ctx context.Context, key string, document interface{}, options ...CommandOption) error {
+	applied := applyOptions(options)
+	headers := map[string]string{}
+	if applied.fromMaster {
+		headers[readFromHeader] = "master"
+	}
+	header, err := c.do(ctx, call{
+		method:    http.MethodGet,
+		path:      "/doc/" + url.PathEscape(key),
+		headers:   headers,
+		retryable: true,
+	}, document)
+	applied.captureETag(header)
+	return err
+}
+
+// PutDocument replaces the document stored at key. The document must
+// encode to a JSON object whose names hold no dots.
+func (c *Client) PutDocument(ctx context.Context, key string, document interface{}, options ...CommandOption) error {
+	_, err := c.write(ctx, http.MethodPut, "/doc/"+url.PathEscape(key), document, options)
+	return err
+}
+
+// PatchDocument applies a JSON Merge Patch to the document stored at key:
+// null values delete, objects merge and other values replace.
+func (c *Client) PatchDocument(ctx context.Context, key string, patch interface{}, options ...CommandOption) error {
+	_, err := c.write(ctx, http.MethodPatch, "/doc/"+url.PathEscape(key), patch, options)
+	return err
+}
+
+// DeleteDocument deletes the document stored at key and reports whether it
+// existed.
+func (c *Client) DeleteDocument(ctx context.Context, key string, options ...CommandOption) (bool, error) {
+	r, err := c.write(ctx, http.MethodDelete, "/doc/"+url.PathEscape(key), nil, options)
+	return r.IntValue > 0, err
+}
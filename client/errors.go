@@ -0,0 +1,78 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Error codes of the gowebdis error envelope.
+const (
+	CodePreconditionFailed = "precondition_failed"
+	CodeUnavailable        = "unavailable"
+	CodeConflict           = "conflict"
+	CodeUnprocessable      = "unprocessable"
+	CodeTooLarge           = "too_large"
+	CodeForbidden          = "forbidden"
+	CodeInternal           = "internal"
+)
+
+// Error is a failure reported by the server through its error envelope
+// {"errorMessage": ..., "errorCode": ...}. Code is empty for plain command
+// errors.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (err *Error) Error() string {
+	if len(err.Code) > 0 {
+		return fmt.Sprintf("gowebdis: %v (%v %v)", err.Message, err.StatusCode, err.Code)
+	}
+	return fmt.Sprintf("gowebdis: %v (%v)", err.Message, err.StatusCode)
+}
+
+func newError(statusCode int, body []byte) *Error {
+	var envelope struct {
+		ErrorMessage string `json:"errorMessage"`
+		ErrorCode    string `json:"errorCode"`
+	}
+	err := json.Unmarshal(body, &envelope)
+	if err != nil || len(envelope.ErrorMessage) == 0 {
+		envelope.ErrorMessage = strings.TrimSpace(string(body))
+		if len(envelope.ErrorMessage) == 0 {
+			envelope.ErrorMessage = http.StatusText(statusCode)
+		}
+	}
+	return &Error{StatusCode: statusCode, Code: envelope.ErrorCode, Message: envelope.ErrorMessage}
+}
+
+func hasStatus(err error, statusCode int) bool {
+	apiErr, ok := err.(*Error)
+	return ok && apiErr.StatusCode == statusCode
+}
+
+// IsPreconditionFailed reports whether a write was refused because the key
+// was not at the version given with IfMatch.
+func IsPreconditionFailed(err error) bool {
+	return hasStatus(err, http.StatusPreconditionFailed)
+}
+
+// IsUnavailable reports whether redis could not be reached, including
+// while the circuit breaker of the backend is open.
+func IsUnavailable(err error) bool {
+	return hasStatus(err, http.StatusServiceUnavailable)
+}
+
+// IsNotFound reports whether the document or the backend does not exist.
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// IsForbidden reports whether the caller may not run the command or use
+// the backend.
+func IsForbidden(err error) bool {
+	return hasStatus(err, http.StatusForbidden)
+}
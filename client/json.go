@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// The JSON methods run the RedisJSON commands on documents stored as JSON
+// strings, emulated by servers whose redis lacks the module. Paths are
+// JSONPaths such as $.address.city, an empty path is the root. Replies
+// that depend on the path syntax, a list of matches for a JSONPath and the
+// value for a legacy path such as .address.city, are returned as raw JSON.
+
+// JSONSet sets the value at path of the document stored at key, encoded as
+// JSON, and reports whether it was set: false when the parent of path does
+// not exist.
+func (c *Client) JSONSet(ctx context.Context, key string, path string, value interface{}, options ...CommandOption) (bool, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	r, err := c.write(ctx, http.MethodPost, "/jsonset", payload{Key: key, Path: path, Value: string(encoded)}, options)
+	return r.BoolValue, err
+}
+
+// JSONGet returns the value at path of the document stored at key, null
+// when the document does not exist. It is served over GET, so replies may
+// come from HTTP caches.
+func (c *Client) JSONGet(ctx context.Context, key string, path string, options ...CommandOption) (json.RawMessage, error) {
+	applied := applyOptions(options)
+	headers := map[string]string{}
+	if applied.fromMaster {
+		headers[readFromHeader] = "master"
+	}
+	var r reply
+	header, err := c.do(ctx, call{
+		method:    http.MethodGet,
+		path:      "/read/jsonget/" + url.PathEscape(key) + "?path=" + url.QueryEscape(path),
+		headers:   headers,
+		retryable: true,
+	}, &r)
+	applied.captureETag(header)
+	return r.JSONValue, err
+}
+
+// JSONDel deletes the value at path of the document stored at key, or the
+// document when path is the root, and returns how many values it deleted.
+func (c *Client) JSONDel(ctx context.Context, key string, path string, options ...CommandOption) (int64, error) {
+	r, err := c.write(ctx, http.MethodPost, "/jsondel", payload{Key: key, Path: path}, options)
+	return r.IntValue, err
+}
+
+// JSONArrAppend appends value, encoded as JSON, to the array at path and
+// returns the new length of the array.
+func (c *Client) JSONArrAppend(ctx context.Context, key string, path string, value interface{}, options ...CommandOption) (json.RawMessage, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.write(ctx, http.MethodPost, "/jsonarrappend", payload{Key: key, Path: path, Value: string(encoded)}, options)
+	return r.JSONValue, err
+}
+
+// JSONNumIncrBy adds increment to the number at path and returns the new
+// value.
+func (c *Client) JSONNumIncrBy(ctx context.Context, key string, path string, increment json.Number, options ...CommandOption) (json.RawMessage, error) {
+	r, err := c.write(ctx, http.MethodPost, "/jsonnumincrby", payload{Key: key, Path: path, Value: string(increment)}, options)
+	return r.JSONValue, err
+}
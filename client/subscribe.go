@@ -0,0 +1,78 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Message is a message published on a channel.
+type Message struct {
+	Channel string `json:"channel"`
+	Payload string `json:"payload"`
+}
+
+// Subscription receives the messages published on a channel, streamed by
+// the server as Server-Sent Events. It ends when the context of Subscribe
+// is done, Close is called or the server shuts down.
+type Subscription struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+}
+
+// Subscribe subscribes to a channel. Subscribing is not retried.
+func (c *Client) Subscribe(ctx context.Context, channel string) (*Subscription, error) {
+	request, err := c.newRequest(ctx, http.MethodGet, "/subscribe/"+url.PathEscape(channel), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "text/event-stream")
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		return nil, newError(response.StatusCode, body)
+	}
+	return &Subscription{body: response.Body, reader: bufio.NewReader(response.Body)}, nil
+}
+
+// Receive blocks until the next message arrives. It returns io.EOF once
+// the stream has ended.
+func (s *Subscription) Receive() (Message, error) {
+	var data []string
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return Message{}, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case len(line) == 0:
+			if len(data) == 0 {
+				continue
+			}
+			var message Message
+			err = json.Unmarshal([]byte(strings.Join(data, "\n")), &message)
+			return message, err
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		// Comments keep the connection alive, event names are all
+		// "message".
+	}
+}
+
+func (s *Subscription) Close() error {
+	return s.body.Close()
+}
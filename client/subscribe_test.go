@@ -0,0 +1,44 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	ctx, cancel := testContext()
+	defer cancel()
+	c := newTestClient(t, apiServer.URL)
+	subscription, err := c.Subscribe(ctx, "news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+
+	// The server subscribes to redis after answering, publish until it
+	// listens.
+	for redisServer.Publish("news", "hello") == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("server did not subscribe")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	message, err := subscription.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Channel != "news" || message.Payload != "hello" {
+		t.Errorf("Receive = %+v", message)
+	}
+}
+
+func TestSubscribeForbidden(t *testing.T) {
+	c := newTestClient(t, apiServer.URL, WithBackend("secure"), WithToken("web-token"))
+	ctx, cancel := testContext()
+	defer cancel()
+	_, err := c.Subscribe(ctx, "news")
+	if !IsForbidden(err) {
+		t.Errorf("Subscribe on a forbidden backend = %v", err)
+	}
+}
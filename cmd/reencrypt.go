@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/codelity/gowebdis/internal/gowebdis"
+	"github.com/codelity/gowebdis/server"
+)
+
+// reencryptCmd re-encrypts the encrypted hash fields of every backend with
+// the primary key of the keyring, e.g. after adding a new key:
+//
+//	gowebdis reencrypt --encryption-keyring keyring.yaml --encrypted-fields 'user:*=email'
+var reencryptCmd = &cobra.Command{
+	Use:    "reencrypt",
+	Short:  "Re-encrypt encrypted hash fields with the primary key",
+	PreRun: bindFlags,
+	Run:    runReencryptCmd,
+}
+
+func init() {
+	rootCmd.AddCommand(reencryptCmd)
+	server.AddFlags(reencryptCmd.Flags())
+	reencryptCmd.Flags().Bool("dry-run", false, "Count the fields to re-encrypt without writing them")
+	reencryptCmd.Flags().Int64("scan-count", 100, "Number of keys requested by each SCAN")
+}
+
+func runReencryptCmd(cmd *cobra.Command, args []string) {
+	err := gowebdis.InitConnectionSetting()
+	if err != nil {
+		log.Error("[ERROR] " + err.Error())
+		os.Exit(1)
+	}
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	count, _ := cmd.Flags().GetInt64("scan-count")
+	results, err := gowebdis.Reencrypt(count, dryRun)
+	gowebdis.CloseConnection()
+	if err != nil {
+		log.Error("[ERROR] " + err.Error())
+		os.Exit(1)
+	}
+	for _, stats := range results {
+		if stats.Errors > 0 {
+			os.Exit(1)
+		}
+	}
+}
@@ -23,43 +23,34 @@ import (
 
 	"github.com/codelity/gowebdis/api"
 	"github.com/codelity/gowebdis/internal/gowebdis"
+	"github.com/codelity/gowebdis/server"
 )
 
 // startCmd represents the start command
 var startCmd = &cobra.Command{
-	Use:   "start",
-	Short: "Start gowebdis",
-	Run:   runStartCmd,
+	Use:    "start",
+	Short:  "Start gowebdis",
+	PreRun: bindFlags,
+	Run:    runStartCmd,
 }
 
 func init() {
 	rootCmd.AddCommand(startCmd)
-	startCmd.Flags().String("host", "", "Redis host list (format <host>:<port> seperated by comma")
-	startCmd.Flags().String("master-name", "", "master name of sentinel")
-	startCmd.Flags().String("sentinel-address", "", "master name of sentinel")
-	startCmd.Flags().String("password", "", "Conection password")
-	startCmd.Flags().Int("db", 0, "Database number")
-	startCmd.Flags().Int("max-retries", -1, "Maximum retries")
-	startCmd.Flags().Int("pool-size", 10, "Pool size")
-	startCmd.Flags().Int("min-idle-conns", 3, "Minimum pool size")
-	startCmd.Flags().Int("min-retry-backoff", -1, "Minimum retry backoff")
-	startCmd.Flags().Int("max-retry-backoff", -1, "Maximum retry backoff")
-	startCmd.Flags().Int("dial-timeout", -1, "Dial timeout in seconds")
-	startCmd.Flags().Int("read-timeout", -1, "Read timeout in seconds")
-	startCmd.Flags().Int("write-timeout", -1, "Write timeout")
-	startCmd.Flags().Int("max-conn-age", -1, "Maximum connection age")
-	startCmd.Flags().Int("pool-timeout", -1, "Pool timeout")
-	startCmd.Flags().Int("idle-timeout", 900, "Idle timeout")
-	startCmd.Flags().Int("idle-check-frequency", 900, "Idle check frequency")
-	viper.BindPFlag("host", startCmd.Flags().Lookup("host"))
-	startCmd.Flags().VisitAll(func(flag *pflag.Flag) {
+	server.AddFlags(startCmd.Flags())
+}
+
+// bindFlags binds the flags of the command being run to viper. Commands
+// define the same settings, binding them all at init would leave viper
+// with the flags of the last one.
+func bindFlags(cmd *cobra.Command, args []string) {
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
 		viper.BindEnv(flag.Name)
 		viper.BindPFlag(flag.Name, flag)
 	})
 }
 
 func runStartCmd(cmd *cobra.Command, args []string) {
-	err := gowebdis.InitConnectionSetting(cmd)
+	err := gowebdis.InitConnectionSetting()
 	if err != nil {
 		log.Error("[ERROR] " + err.Error())
 	} else {
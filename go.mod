@@ -3,8 +3,11 @@ module github.com/codelity/gowebdis
 go 1.12
 
 require (
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/gin-gonic/gin v1.5.0
-	github.com/go-redis/redis v6.15.7+incompatible
+	github.com/go-redis/redis/v7 v7.4.1
+	github.com/golang/snappy v1.0.0
+	github.com/klauspost/compress v1.11.13
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/onsi/ginkgo v1.12.0 // indirect
 	github.com/onsi/gomega v1.9.0 // indirect
@@ -12,4 +15,6 @@ require (
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.6.2
+	golang.org/x/net v0.0.0-20200202094626-16171245cfb2
+	gopkg.in/yaml.v2 v2.2.4
 )
@@ -0,0 +1,280 @@
+package gowebdis
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const redactedValue = "[REDACTED]"
+
+var auditRecordsTotal = newCounter("gowebdis_audit_records_total", "Number of write commands recorded in the audit log.", "sink", "result")
+
+// AuditRecord describes one write command. Changes lists, for hset and hdel
+// with --audit-diff, the value of every field written before and after the
+// command; a nil value means the field does not exist. Before values are
+// read just ahead of the write, not atomically with it.
+type AuditRecord struct {
+	Time     string   `json:"time"`
+	Identity string   `json:"identity"`
+	SourceIP string   `json:"sourceIp"`
+	Backend  string   `json:"backend"`
+	Command  string   `json:"command"`
+	Keys     []string `json:"keys"`
+	Field    string   `json:"field,omitempty"`
+	Fields   []string `json:"fields,omitempty"`
+	Value    string   `json:"value,omitempty"`
+	// Values are the fields written by document commands.
+	Values map[string]string `json:"values,omitempty"`
+	// Path is the JSONPath written by json commands.
+	Path    string        `json:"path,omitempty"`
+	Changes []FieldChange `json:"changes,omitempty"`
+	Success bool          `json:"success"`
+	Error   string        `json:"error,omitempty"`
+}
+
+type FieldChange struct {
+	Field  string  `json:"field"`
+	Before *string `json:"before"`
+	After  *string `json:"after"`
+}
+
+// auditLog writes records of write commands to a JSON-lines file rotated
+// by size and/or a capped stream on the backend of the command.
+type auditLog struct {
+	keyPatterns    []string
+	redactPatterns []string
+	diff           bool
+
+	stream       string
+	streamMaxLen int64
+
+	mutex      sync.Mutex
+	file       *os.File
+	filePath   string
+	fileSize   int64
+	maxSize    int64
+	maxBackups int
+}
+
+var audit *auditLog
+
+// initAuditLog enables the audit log when --audit-file or --audit-stream is
+// set.
+func initAuditLog() error {
+	filePath := viper.GetString("audit-file")
+	stream := viper.GetString("audit-stream")
+	if len(filePath) == 0 && len(stream) == 0 {
+		return nil
+	}
+	a := &auditLog{
+		keyPatterns:    splitList(viper.GetString("audit-key-patterns")),
+		redactPatterns: splitList(viper.GetString("audit-redact-fields")),
+		diff:           viper.GetBool("audit-diff"),
+		stream:         stream,
+		streamMaxLen:   viper.GetInt64("audit-stream-max-len"),
+		filePath:       filePath,
+		maxSize:        viper.GetInt64("audit-file-max-size") * 1024 * 1024,
+		maxBackups:     viper.GetInt("audit-file-max-backups"),
+	}
+	if len(filePath) > 0 {
+		err := a.openFile()
+		if err != nil {
+			return err
+		}
+	}
+	audit = a
+	log.Info("[INFO] Audit log of write commands enabled")
+	return nil
+}
+
+func (a *auditLog) openFile() error {
+	file, err := os.OpenFile(a.filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open audit file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cannot open audit file: %v", err)
+	}
+	a.file = file
+	a.fileSize = info.Size()
+	return nil
+}
+
+// rotate renames the audit file to .1, shifting older files up to
+// --audit-file-max-backups, and starts a new one. It must be called with
+// the mutex held.
+func (a *auditLog) rotate() error {
+	a.file.Close()
+	if a.maxBackups <= 0 {
+		os.Remove(a.filePath)
+	} else {
+		os.Remove(fmt.Sprintf("%v.%v", a.filePath, a.maxBackups))
+		for idx := a.maxBackups - 1; idx > 0; idx-- {
+			os.Rename(fmt.Sprintf("%v.%v", a.filePath, idx), fmt.Sprintf("%v.%v", a.filePath, idx+1))
+		}
+		os.Rename(a.filePath, a.filePath+".1")
+	}
+	return a.openFile()
+}
+
+func (a *auditLog) writeFile(line []byte) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.file == nil {
+		return os.ErrClosed
+	}
+	if a.maxSize > 0 && a.fileSize+int64(len(line)) > a.maxSize && a.fileSize > 0 {
+		err := a.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(line)
+	a.fileSize += int64(n)
+	return err
+}
+
+func (a *auditLog) close() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+func matchesPattern(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// audits reports whether the command is a write on a key selected by
+// --audit-key-patterns.
+func (a *auditLog) audits(redisCommand string, key string) bool {
+	if a == nil || commandFlags(redisCommand, "")&flagWrite == 0 {
+		return false
+	}
+	return len(a.keyPatterns) == 0 || matchesPattern(a.keyPatterns, key)
+}
+
+// redact returns the value recorded for a field, decompressed so that the
+// log stays readable. Values that cannot be decompressed are redacted.
+func (a *auditLog) redact(key string, field string, value string) string {
+	if matchesPattern(a.redactPatterns, field) {
+		return redactedValue
+	}
+	decompressed, err := compression.decompress(key, field, value)
+	if err != nil {
+		return redactedValue
+	}
+	return decompressed
+}
+
+// changedFields lists the fields the command writes.
+func changedFields(redisCommand string, jsonPayload JsonPayload) []string {
+	switch redisCommand {
+	case "hset":
+		return []string{jsonPayload.Field}
+	case "hdel":
+		return jsonPayload.Fields
+	}
+	return nil
+}
+
+// before reads the current value of the fields the command writes.
+func (a *auditLog) before(backend *Backend, redisCommand string, jsonPayload JsonPayload) []FieldChange {
+	fields := changedFields(redisCommand, jsonPayload)
+	if !a.diff || len(fields) == 0 || backend.client == nil {
+		return nil
+	}
+	values, err := backend.client.HMGet(jsonPayload.Key, fields...).Result()
+	if err != nil {
+		log.Error("[ERROR] Cannot read audit diff of " + jsonPayload.Key + ": " + err.Error())
+		return nil
+	}
+	changes := make([]FieldChange, len(fields))
+	for idx, field := range fields {
+		changes[idx].Field = field
+		if value, ok := values[idx].(string); ok {
+			value = a.redact(jsonPayload.Key, field, value)
+			changes[idx].Before = &value
+		}
+	}
+	return changes
+}
+
+func (a *auditLog) record(backend *Backend, redisCommand string, jsonPayload JsonPayload, options CommandOptions, changes []FieldChange, commandResponse CommandResponse) {
+	record := AuditRecord{
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+		Identity: options.Identity.Name,
+		SourceIP: options.SourceIP,
+		Backend:  backend.Name,
+		Command:  redisCommand,
+		Keys:     []string{jsonPayload.Key},
+		Field:    jsonPayload.Field,
+		Fields:   jsonPayload.Fields,
+		Path:     jsonPayload.Path,
+		Success:  commandResponse.Success,
+		Error:    commandResponse.ErrorMessage,
+	}
+	if len(jsonPayload.Value) > 0 {
+		record.Value = a.redact(jsonPayload.Key, jsonPayload.Field, jsonPayload.Value)
+	}
+	if len(jsonPayload.Values) > 0 {
+		record.Values = make(map[string]string, len(jsonPayload.Values))
+		for field, value := range jsonPayload.Values {
+			record.Values[field] = a.redact(jsonPayload.Key, field, value)
+		}
+	}
+	if commandResponse.Success && redisCommand == "hset" {
+		for idx := range changes {
+			after := a.redact(jsonPayload.Key, changes[idx].Field, jsonPayload.Value)
+			changes[idx].After = &after
+		}
+	} else if !commandResponse.Success {
+		for idx := range changes {
+			changes[idx].After = changes[idx].Before
+		}
+	}
+	record.Changes = changes
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Error("[ERROR] Cannot encode audit record: " + err.Error())
+		return
+	}
+	if len(a.filePath) > 0 {
+		a.write("file", a.writeFile(append(line, '\n')))
+	}
+	if len(a.stream) > 0 && backend.client != nil {
+		args := &redis.XAddArgs{
+			Stream:       a.stream,
+			MaxLenApprox: a.streamMaxLen,
+			Values:       map[string]interface{}{"record": string(line)},
+		}
+		a.write("stream", backend.client.XAdd(args).Err())
+	}
+}
+
+func (a *auditLog) write(sink string, err error) {
+	if err != nil {
+		auditRecordsTotal.inc(sink, "error")
+		log.Error("[ERROR] Cannot write audit record to " + sink + ": " + err.Error())
+		return
+	}
+	auditRecordsTotal.inc(sink, "success")
+}
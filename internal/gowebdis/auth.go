@@ -0,0 +1,61 @@
+package gowebdis
+
+import (
+	"crypto/subtle"
+
+	"github.com/spf13/viper"
+)
+
+// Identity is the caller resolved from a bearer token. Requests without a
+// known token run as the anonymous identity, which has no roles.
+type Identity struct {
+	Name  string
+	Roles []string
+}
+
+var AnonymousIdentity = Identity{Name: "anonymous"}
+
+type tokenConfig struct {
+	Token    string   `mapstructure:"token"`
+	Identity string   `mapstructure:"identity"`
+	Roles    []string `mapstructure:"roles"`
+}
+
+var authTokens []tokenConfig
+
+// loadAuthTokens reads the "auth.tokens" list of the config file:
+//
+//	auth:
+//	  tokens:
+//	    - token: <secret>
+//	      identity: billing-service
+//	      roles: [sessions, cache]
+func loadAuthTokens() error {
+	var tokens []tokenConfig
+	err := viper.UnmarshalKey("auth.tokens", &tokens)
+	if err != nil {
+		return err
+	}
+	authTokens = tokens
+	return nil
+}
+
+func Authenticate(token string) (Identity, bool) {
+	for _, config := range authTokens {
+		if len(config.Token) > 0 && subtle.ConstantTimeCompare([]byte(config.Token), []byte(token)) == 1 {
+			return Identity{Name: config.Identity, Roles: config.Roles}, true
+		}
+	}
+	return AnonymousIdentity, false
+}
+
+func (identity Identity) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		for _, identityRole := range identity.Roles {
+			if role == identityRole {
+				return true
+			}
+		}
+	}
+	return false
+}
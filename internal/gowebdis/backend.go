@@ -0,0 +1,361 @@
+package gowebdis
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Backend is one Redis deployment served by gowebdis. The backend
+// configured through command line flags is called "default", others are
+// declared in the "backends" section of the config file:
+//
+//	backends:
+//	  sessions:
+//	    redis-url: redis://sessions:6379/0
+//	    pool-size: 50
+//	    auth:
+//	      roles: [sessions]
+//	  cache:
+//	    host: cache-1:6379,cache-2:6379
+//	    mode: cluster
+//	routes:
+//	  - key-prefix: "session:"
+//	    backend: sessions
+type Backend struct {
+	Name     string
+	connType string
+	client   redis.UniversalClient
+	replicas *replicaSet
+	cache    *localCache
+	breaker  *circuitBreaker
+	retry    retryPolicy
+	policy   commandPolicy
+	roles    []string
+
+	idempotencyPrefix  string
+	idempotencyWindow  time.Duration
+	idempotencyPending time.Duration
+
+	coalesce        bool
+	coalesceExclude map[string]bool
+
+	// jsonModule is the --json-module setting, jsonNative whether the json
+	// commands use the RedisJSON module, see detectJSONModule.
+	jsonModule string
+	jsonNative bool
+}
+
+type routeRule struct {
+	KeyPrefix string `mapstructure:"key-prefix"`
+	Backend   string `mapstructure:"backend"`
+}
+
+const flagsBackendName = "default"
+
+var backends = map[string]*Backend{}
+var defaultBackendName string
+var routeRules []routeRule
+
+var backendUp = newGauge("gowebdis_backend_up", "Whether the last ping of the backend succeeded.", "backend")
+var poolTotalConns = newGauge("gowebdis_pool_total_conns", "Number of connections in the pool.", "backend")
+var poolIdleConns = newGauge("gowebdis_pool_idle_conns", "Number of idle connections in the pool.", "backend")
+var poolTimeouts = newGauge("gowebdis_pool_timeouts", "Number of times a wait for a pool connection timed out.", "backend")
+
+func init() {
+	registerMetricsCollector(collectPoolStats)
+}
+
+// InitConnectionSetting connects to the backends configured by the flags
+// and the config file and adds the hooks of the enabled features. On
+// failure it leaves neither backends nor hooks behind, so that it can run
+// again with a corrected configuration.
+func InitConnectionSetting() error {
+	saved := currentHooks()
+	err := initConnectionSetting()
+	if err != nil {
+		CloseConnection()
+		resetConnectionSetting(saved)
+		return err
+	}
+	hooksBeforeInit = saved
+	return nil
+}
+
+// hooksBeforeInit are the hooks added before the last successful
+// InitConnectionSetting, which ResetConnectionSetting brings back.
+var hooksBeforeInit []Hook
+
+// ResetConnectionSetting forgets the backends and features set up by
+// InitConnectionSetting, once CloseConnection closed them, along with the
+// hooks added since, so that InitConnectionSetting can run again.
+func ResetConnectionSetting() {
+	resetConnectionSetting(hooksBeforeInit)
+	hooksBeforeInit = nil
+}
+
+// resetConnectionSetting forgets the backends and features set up by
+// initConnectionSetting.
+func resetConnectionSetting(saved []Hook) {
+	backends = map[string]*Backend{}
+	defaultBackendName = ""
+	routeRules = nil
+	audit = nil
+	encryption = nil
+	compression = nil
+	schemaValidator = nil
+	restoreHooks(saved)
+}
+
+func initConnectionSetting() error {
+
+	err := loadAuthTokens()
+	if err != nil {
+		return err
+	}
+	err = initAuditLog()
+	if err != nil {
+		return err
+	}
+	err = initFieldEncryption()
+	if err != nil {
+		return err
+	}
+	err = initValueCompression()
+	if err != nil {
+		return err
+	}
+	err = initSchemaValidation()
+	if err != nil {
+		return err
+	}
+
+	if len(viper.GetString("redis-url")) > 0 || len(viper.GetString("host")) > 0 || len(viper.GetString("sentinel-address")) > 0 {
+		backend, err := newBackend(flagsBackendName, settingSource{}, viper.GetStringSlice("auth.roles"))
+		if err != nil {
+			return err
+		}
+		backends[flagsBackendName] = backend
+	}
+	for name := range viper.GetStringMap("backends") {
+		if _, ok := backends[name]; ok {
+			return fmt.Errorf("backend %v is already configured", name)
+		}
+		config := viper.Sub("backends." + name)
+		if config == nil {
+			return fmt.Errorf("backend %v has no settings", name)
+		}
+		backend, err := newBackend(name, settingSource{config: config}, config.GetStringSlice("auth.roles"))
+		if err != nil {
+			return fmt.Errorf("backend %v: %v", name, err)
+		}
+		backends[name] = backend
+	}
+	if len(backends) == 0 {
+		return errors.New("no redis address configured, set --host, --sentinel-address, --redis-url or a backend in the config file")
+	}
+
+	defaultBackendName = viper.GetString("default-backend")
+	if _, ok := backends[defaultBackendName]; !ok {
+		log.Warn("[WARN] Default backend " + defaultBackendName + " is not configured, requests must select a backend")
+		defaultBackendName = ""
+	}
+
+	var rules []routeRule
+	err = viper.UnmarshalKey("routes", &rules)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if _, ok := backends[rule.Backend]; !ok {
+			return fmt.Errorf("route for key prefix %v refers to unknown backend %v", rule.KeyPrefix, rule.Backend)
+		}
+	}
+	routeRules = rules
+
+	for _, name := range BackendNames() {
+		var commandResponse = ping(backends[name])
+		if !commandResponse.Success {
+			return fmt.Errorf("backend %v: %v", name, commandResponse.ErrorMessage)
+		}
+		err = backends[name].detectJSONModule(backends[name].jsonModule)
+		if err != nil {
+			return fmt.Errorf("backend %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func newBackend(name string, source settingSource, roles []string) (*Backend, error) {
+	setting, err := loadConnectionSetting(source)
+	if err != nil {
+		return nil, err
+	}
+	replicas, err := newReplicaSet(name, source, setting)
+	if err != nil {
+		return nil, err
+	}
+	backend := &Backend{
+		Name:     name,
+		connType: setting.Mode,
+		replicas: replicas,
+		cache:    newLocalCache(name, source),
+		breaker:  newCircuitBreaker(name, source),
+		retry:    newRetryPolicy(setting),
+		policy:   newCommandPolicy(source, setting.Renames),
+		roles:    roles,
+
+		idempotencyPrefix:  source.getString("idempotency-key-prefix"),
+		idempotencyWindow:  seconds(source.getInt("idempotency-window")),
+		idempotencyPending: seconds(source.getInt("idempotency-pending-ttl")),
+
+		coalesce:        source.getBool("coalesce"),
+		coalesceExclude: map[string]bool{},
+
+		jsonModule: source.getString("json-module"),
+	}
+	for _, redisCommand := range splitList(source.getString("coalesce-exclude-commands")) {
+		backend.coalesceExclude[strings.ToLower(redisCommand)] = true
+	}
+	backend.client = startConnection(setting)
+	addRenameHook(backend.client, setting)
+	if backend.breaker != nil {
+		backend.client.AddHook(breakerHook{breaker: backend.breaker})
+	}
+	if replicas != nil {
+		replicas.start(backend.client, seconds(source.getInt("replica-check-interval")))
+	}
+	if backend.cache != nil && source.getBool("cache-tracking") {
+		backend.cache.startTracking(setting)
+	}
+	log.Info("[INFO] Configured " + setting.Mode + " backend " + name)
+	return backend, nil
+}
+
+func startConnection(setting connectionSetting) redis.UniversalClient {
+	var conn redis.UniversalClient
+	switch setting.Mode {
+	case "sentinel":
+		options := newFailoverOptions(setting)
+		conn = redis.NewFailoverClient(&options)
+	case "cluster":
+		options := newClusterOptions(setting)
+		conn = redis.NewClusterClient(&options)
+	case "host":
+		options := newHostOptions(setting)
+		conn = redis.NewClient(&options)
+	}
+	return conn
+}
+
+// BackendNames returns the names of all configured backends in order.
+func BackendNames() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ResolveBackend selects the backend of a request. An explicitly requested
+// backend wins, then the first route whose key prefix matches the key,
+// then the default backend.
+func ResolveBackend(name string, key string) (*Backend, error) {
+	if len(name) > 0 {
+		backend, ok := backends[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown backend %v", name)
+		}
+		return backend, nil
+	}
+	if len(key) > 0 {
+		for _, rule := range routeRules {
+			if strings.HasPrefix(key, rule.KeyPrefix) {
+				return backends[rule.Backend], nil
+			}
+		}
+	}
+	backend, ok := backends[defaultBackendName]
+	if !ok {
+		return nil, errors.New("no backend selected and no default backend configured")
+	}
+	return backend, nil
+}
+
+// readClient returns the client serving a read-only command: it may be a
+// replica according to the read policy of the backend unless the caller
+// asked to read from the master, e.g. to read its own writes.
+func (backend *Backend) readClient(options CommandOptions) redis.UniversalClient {
+	if backend.replicas == nil {
+		return backend.client
+	}
+	if options.ReadFromMaster {
+		readsTotal.inc(backend.Name, "master")
+		return backend.client
+	}
+	client, fromReplica := backend.replicas.pick(backend.client)
+	if fromReplica {
+		readsTotal.inc(backend.Name, "replica")
+	} else {
+		readsTotal.inc(backend.Name, "master")
+	}
+	return client
+}
+
+// KeyTTL returns the remaining time to live of the key, negative when the
+// key has no expiry or does not exist.
+func KeyTTL(backend *Backend, key string, options CommandOptions) (time.Duration, error) {
+	return backend.readClient(options).PTTL(key).Result()
+}
+
+// Authorize reports whether the identity may use the backend. Backends
+// without roles are open to everyone.
+func (backend *Backend) Authorize(identity Identity) bool {
+	return len(backend.roles) == 0 || identity.HasRole(backend.roles...)
+}
+
+func CloseConnection() error {
+	var lastErr error
+	for _, name := range BackendNames() {
+		backend := backends[name]
+		if backend.replicas != nil {
+			backend.replicas.stop()
+		}
+		if backend.cache != nil {
+			backend.cache.stop()
+		}
+		err := backend.client.Close()
+		if err != nil {
+			lastErr = err
+			log.Error("[ERROR] " + err.Error())
+		} else {
+			log.Info("[INFO] Redis connection of backend " + name + " closed")
+		}
+	}
+	if audit != nil {
+		audit.close()
+	}
+	return lastErr
+}
+
+type poolStatser interface {
+	PoolStats() *redis.PoolStats
+}
+
+func collectPoolStats() {
+	for name, backend := range backends {
+		if client, ok := backend.client.(poolStatser); ok {
+			stats := client.PoolStats()
+			poolTotalConns.set(float64(stats.TotalConns), name)
+			poolIdleConns.set(float64(stats.IdleConns), name)
+			poolTimeouts.set(float64(stats.Timeouts), name)
+		}
+	}
+}
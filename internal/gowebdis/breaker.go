@@ -0,0 +1,209 @@
+package gowebdis
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+var circuitStates = []string{circuitClosed, circuitOpen, circuitHalfOpen}
+
+var circuitBreakerState = newGauge("gowebdis_circuit_breaker_state", "Current state of the circuit breaker of the backend, 1 for the active state.", "backend", "state")
+var circuitBreakerTransitions = newCounter("gowebdis_circuit_breaker_transitions_total", "Number of times the circuit breaker changed state.", "backend", "state")
+var circuitBreakerRejected = newCounter("gowebdis_circuit_breaker_rejected_total", "Number of commands refused while the circuit breaker was open.", "backend")
+
+// circuitBreaker stops sending commands to a backend after
+// --circuit-breaker-failure-threshold consecutive connection failures so
+// that requests fail fast instead of waiting for dial and read timeouts.
+// Once --circuit-breaker-probe-interval has elapsed a single command is let
+// through as a probe: its success closes the breaker, its failure opens it
+// again for another interval.
+type circuitBreaker struct {
+	backend       string
+	threshold     int
+	probeInterval time.Duration
+
+	mutex        sync.Mutex
+	state        string
+	failures     int
+	openedAt     time.Time
+	probeStarted time.Time
+}
+
+func newCircuitBreaker(name string, source settingSource) *circuitBreaker {
+	threshold := source.getInt("circuit-breaker-failure-threshold")
+	if threshold <= 0 {
+		return nil
+	}
+	breaker := &circuitBreaker{
+		backend:       name,
+		threshold:     threshold,
+		probeInterval: seconds(source.getInt("circuit-breaker-probe-interval")),
+	}
+	breaker.setState(circuitClosed)
+	return breaker
+}
+
+// setState must be called with the mutex held.
+func (breaker *circuitBreaker) setState(state string) {
+	if breaker.state == state {
+		return
+	}
+	if len(breaker.state) > 0 {
+		log.Warn("[WARN] Circuit breaker of backend " + breaker.backend + " is " + state)
+		circuitBreakerTransitions.inc(breaker.backend, state)
+	}
+	breaker.state = state
+	for _, s := range circuitStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		circuitBreakerState.set(value, breaker.backend, s)
+	}
+}
+
+// allow reports whether a command may be sent to the backend.
+func (breaker *circuitBreaker) allow() bool {
+	if breaker == nil {
+		return true
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	now := time.Now()
+	switch breaker.state {
+	case circuitOpen:
+		if now.Sub(breaker.openedAt) < breaker.probeInterval {
+			break
+		}
+		breaker.setState(circuitHalfOpen)
+		breaker.probeStarted = now
+		return true
+	case circuitHalfOpen:
+		// A probe that never reported back must not keep the breaker
+		// half-open forever.
+		if now.Sub(breaker.probeStarted) < breaker.probeInterval {
+			break
+		}
+		breaker.probeStarted = now
+		return true
+	default:
+		return true
+	}
+	circuitBreakerRejected.inc(breaker.backend)
+	return false
+}
+
+func (breaker *circuitBreaker) record(err error) {
+	if err != nil && !isConnectionFailure(err) {
+		err = nil
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	if err == nil {
+		breaker.failures = 0
+		breaker.setState(circuitClosed)
+		return
+	}
+	breaker.failures++
+	if breaker.state == circuitHalfOpen || breaker.failures >= breaker.threshold {
+		breaker.openedAt = time.Now()
+		breaker.setState(circuitOpen)
+	}
+}
+
+func (breaker *circuitBreaker) currentState() string {
+	if breaker == nil {
+		return circuitClosed
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	return breaker.state
+}
+
+// unavailableErrors are replies of a server that cannot serve commands.
+var unavailableErrors = []string{"LOADING ", "MASTERDOWN ", "CLUSTERDOWN "}
+
+// isConnectionFailure tells failures of the backend apart from replies such
+// as WRONGTYPE, which prove that the backend is up.
+func isConnectionFailure(err error) bool {
+	if err == redis.Nil || err == context.Canceled {
+		return false
+	}
+	if _, ok := err.(redis.Error); ok {
+		for _, prefix := range unavailableErrors {
+			if strings.HasPrefix(err.Error(), prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// failureCode classifies connection failures as unavailable, they are
+// retried and answered with 503.
+func failureCode(err error) string {
+	if isConnectionFailure(err) {
+		return ErrorCodeUnavailable
+	}
+	return ""
+}
+
+// breakerHook feeds the outcome of every command sent by the client of a
+// backend to its circuit breaker.
+type breakerHook struct {
+	breaker *circuitBreaker
+}
+
+func (hook breakerHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (hook breakerHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	hook.breaker.record(cmd.Err())
+	return nil
+}
+
+func (hook breakerHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (hook breakerHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	for _, cmd := range cmds {
+		if cmd.Err() != nil {
+			hook.breaker.record(cmd.Err())
+			return nil
+		}
+	}
+	hook.breaker.record(nil)
+	return nil
+}
+
+// CircuitBreakerStates returns the state of the circuit breaker of every
+// backend.
+func CircuitBreakerStates() map[string]string {
+	states := map[string]string{}
+	for name, backend := range backends {
+		states[name] = backend.breaker.currentState()
+	}
+	return states
+}
+
+// CircuitBreakerState returns the state of the circuit breaker of the
+// backend, "closed" when it has none.
+func (backend *Backend) CircuitBreakerState() string {
+	return backend.breaker.currentState()
+}
@@ -0,0 +1,533 @@
+package gowebdis
+
+import (
+	"container/list"
+	"errors"
+	"hash/fnv"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	log "github.com/sirupsen/logrus"
+)
+
+const invalidateChannel = "__redis__:invalidate"
+
+// invalidationStripes spread per key invalidation counters so that a read
+// racing with an invalidation of the same key never stores a stale reply.
+const invalidationStripes = 1024
+
+var cacheHitsTotal = newCounter("gowebdis_cache_hits_total", "Number of reads served from the local cache.", "backend")
+var cacheMissesTotal = newCounter("gowebdis_cache_misses_total", "Number of cacheable reads sent to redis.", "backend")
+var cacheEvictionsTotal = newCounter("gowebdis_cache_evictions_total", "Number of entries evicted to honour the memory limit.", "backend")
+var cacheInvalidationsTotal = newCounter("gowebdis_cache_invalidations_total", "Number of keys invalidated.", "backend")
+var cacheEntries = newGauge("gowebdis_cache_entries", "Number of entries in the local cache.", "backend")
+var cacheBytes = newGauge("gowebdis_cache_bytes", "Estimated size of the local cache in bytes.", "backend")
+var cacheTracking = newGauge("gowebdis_cache_tracking", "Whether redis client tracking keeps the local cache coherent.", "backend")
+
+func init() {
+	registerMetricsCollector(collectCacheStats)
+}
+
+type cacheEntry struct {
+	cacheKey  string
+	redisKeys []string
+	response  CommandResponse
+	size      int
+	expires   time.Time
+}
+
+// localCache is an LRU cache of read replies bounded by memory. While
+// client tracking is active entries live for cache-ttl and are dropped as
+// soon as redis reports a change of their key; without tracking they only
+// live for cache-fallback-ttl.
+type localCache struct {
+	backendName     string
+	maxBytes        int
+	ttl             time.Duration
+	fallbackTtl     time.Duration
+	includePatterns []string
+	excludePatterns []string
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	byKey   map[string]map[string]bool
+	lru     *list.List
+	bytes   int
+
+	hits          int64
+	misses        int64
+	evictions     int64
+	invalidations int64
+
+	tracking int32
+	stripes  [invalidationStripes]uint64
+	stopCh   chan struct{}
+}
+
+type CacheStats struct {
+	Entries       int   `json:"entries"`
+	Bytes         int   `json:"bytes"`
+	MaxBytes      int   `json:"maxBytes"`
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Evictions     int64 `json:"evictions"`
+	Invalidations int64 `json:"invalidations"`
+	Tracking      bool  `json:"tracking"`
+}
+
+func newLocalCache(backendName string, source settingSource) *localCache {
+	if !source.getBool("cache") {
+		return nil
+	}
+	return &localCache{
+		backendName:     backendName,
+		maxBytes:        source.getInt("cache-max-memory") * 1024 * 1024,
+		ttl:             seconds(source.getInt("cache-ttl")),
+		fallbackTtl:     seconds(source.getInt("cache-fallback-ttl")),
+		includePatterns: splitList(source.getString("cache-key-patterns")),
+		excludePatterns: splitList(source.getString("cache-exclude-patterns")),
+		entries:         map[string]*list.Element{},
+		byKey:           map[string]map[string]bool{},
+		lru:             list.New(),
+		stopCh:          make(chan struct{}),
+	}
+}
+
+// cacheable reports whether replies reading the redis keys may be cached.
+func (cache *localCache) cacheable(redisKeys []string) bool {
+	if len(redisKeys) == 0 {
+		return false
+	}
+	for _, redisKey := range redisKeys {
+		if !cache.cacheableKey(redisKey) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cache *localCache) cacheableKey(redisKey string) bool {
+	for _, pattern := range cache.excludePatterns {
+		if matched, _ := path.Match(pattern, redisKey); matched {
+			return false
+		}
+	}
+	if len(cache.includePatterns) == 0 {
+		return true
+	}
+	for _, pattern := range cache.includePatterns {
+		if matched, _ := path.Match(pattern, redisKey); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheKey identifies a read by its command and whole payload, so that
+// reads of a key with other fields or paths never share a reply.
+func cacheKey(redisCommand string, jsonPayload JsonPayload) string {
+	return requestFingerprint(redisCommand, jsonPayload, CommandOptions{})
+}
+
+func invalidationStripe(redisKey string) int {
+	h := fnv.New32a()
+	h.Write([]byte(redisKey))
+	return int(h.Sum32() % invalidationStripes)
+}
+
+// begin returns tokens that put uses to detect invalidations of the keys
+// that happened while the reply was read from redis.
+func (cache *localCache) begin(redisKeys []string) []uint64 {
+	tokens := make([]uint64, len(redisKeys))
+	for idx, redisKey := range redisKeys {
+		tokens[idx] = atomic.LoadUint64(&cache.stripes[invalidationStripe(redisKey)])
+	}
+	return tokens
+}
+
+func (cache *localCache) get(cacheKey string) (CommandResponse, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[cacheKey]
+	if ok {
+		entry := element.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			cache.lru.MoveToFront(element)
+			cache.hits++
+			cacheHitsTotal.inc(cache.backendName)
+			return cloneResponse(entry.response), true
+		}
+		cache.remove(element)
+	}
+	cache.misses++
+	cacheMissesTotal.inc(cache.backendName)
+	return CommandResponse{}, false
+}
+
+// put caches the reply of a read of the keys, unless one of them was
+// invalidated since begin returned the tokens.
+func (cache *localCache) put(cacheKey string, redisKeys []string, tokens []uint64, response CommandResponse) {
+	size := responseSize(response) + len(cacheKey)
+	for _, redisKey := range redisKeys {
+		size += len(redisKey)
+	}
+	if size > cache.maxBytes {
+		return
+	}
+	ttl := cache.fallbackTtl
+	if atomic.LoadInt32(&cache.tracking) == 1 {
+		ttl = cache.ttl
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for idx, redisKey := range redisKeys {
+		if atomic.LoadUint64(&cache.stripes[invalidationStripe(redisKey)]) != tokens[idx] {
+			return
+		}
+	}
+	if element, ok := cache.entries[cacheKey]; ok {
+		cache.remove(element)
+	}
+	entry := &cacheEntry{
+		cacheKey:  cacheKey,
+		redisKeys: redisKeys,
+		response:  cloneResponse(response),
+		size:      size,
+		expires:   time.Now().Add(ttl),
+	}
+	cache.entries[cacheKey] = cache.lru.PushFront(entry)
+	for _, redisKey := range redisKeys {
+		if cache.byKey[redisKey] == nil {
+			cache.byKey[redisKey] = map[string]bool{}
+		}
+		cache.byKey[redisKey][cacheKey] = true
+	}
+	cache.bytes += size
+
+	for cache.bytes > cache.maxBytes {
+		cache.remove(cache.lru.Back())
+		cache.evictions++
+		cacheEvictionsTotal.inc(cache.backendName)
+	}
+}
+
+// remove must be called with the mutex held.
+func (cache *localCache) remove(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	cache.lru.Remove(element)
+	delete(cache.entries, entry.cacheKey)
+	for _, redisKey := range entry.redisKeys {
+		delete(cache.byKey[redisKey], entry.cacheKey)
+		if len(cache.byKey[redisKey]) == 0 {
+			delete(cache.byKey, redisKey)
+		}
+	}
+	cache.bytes -= entry.size
+}
+
+func (cache *localCache) invalidate(redisKey string) {
+	atomic.AddUint64(&cache.stripes[invalidationStripe(redisKey)], 1)
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for cacheKey := range cache.byKey[redisKey] {
+		cache.remove(cache.entries[cacheKey])
+	}
+	cache.invalidations++
+	cacheInvalidationsTotal.inc(cache.backendName)
+}
+
+func (cache *localCache) flush() {
+	for idx := range cache.stripes {
+		atomic.AddUint64(&cache.stripes[idx], 1)
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.entries = map[string]*list.Element{}
+	cache.byKey = map[string]map[string]bool{}
+	cache.lru.Init()
+	cache.bytes = 0
+}
+
+func (cache *localCache) stats() CacheStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return CacheStats{
+		Entries:       len(cache.entries),
+		Bytes:         cache.bytes,
+		MaxBytes:      cache.maxBytes,
+		Hits:          cache.hits,
+		Misses:        cache.misses,
+		Evictions:     cache.evictions,
+		Invalidations: cache.invalidations,
+		Tracking:      atomic.LoadInt32(&cache.tracking) == 1,
+	}
+}
+
+func cloneResponse(response CommandResponse) CommandResponse {
+	if response.MapVal != nil {
+		mapVal := make(map[string]string, len(response.MapVal))
+		for field, value := range response.MapVal {
+			mapVal[field] = value
+		}
+		response.MapVal = mapVal
+	}
+	return response
+}
+
+func responseSize(response CommandResponse) int {
+	size := 64 + len(response.Name) + len(response.StringVal)
+	for field, value := range response.MapVal {
+		size += len(field) + len(value) + 16
+	}
+	return size
+}
+
+// trackingPrefixes returns the BCAST prefixes matching the include
+// patterns, or nil when every key must be tracked.
+func (cache *localCache) trackingPrefixes() []string {
+	var prefixes []string
+	for _, pattern := range cache.includePatterns {
+		prefix := pattern
+		if idx := strings.IndexAny(pattern, "*?[\\"); idx > -1 {
+			prefix = pattern[:idx]
+		}
+		if len(prefix) == 0 {
+			return nil
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	// Redis rejects overlapping prefixes, keep the shortest ones.
+	var result []string
+	for _, prefix := range prefixes {
+		overlaps := false
+		for _, other := range prefixes {
+			if other != prefix && strings.HasPrefix(prefix, other) {
+				overlaps = true
+			}
+		}
+		if !overlaps && !containsString(result, prefix) {
+			result = append(result, prefix)
+		}
+	}
+	return result
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+var errTrackingUnsupported = errors.New("client tracking is not supported")
+
+// startTracking keeps the cache coherent with CLIENT TRACKING in broadcast
+// mode: one connection subscribes to the invalidation channel and another
+// one enables tracking with its invalidations redirected to the first.
+// Whenever either connection is lost the cache is flushed and falls back
+// to short TTLs until tracking is re-established.
+func (cache *localCache) startTracking(setting connectionSetting) {
+	if setting.Mode == "cluster" {
+		log.Warn("[WARN] Client tracking is not available in cluster mode, cache of backend " + cache.backendName + " relies on cache-fallback-ttl")
+		return
+	}
+	go func() {
+		backoff := time.Second
+		for {
+			err := cache.track(setting)
+			cache.setTracking(false)
+			cache.flush()
+			select {
+			case <-cache.stopCh:
+				return
+			default:
+			}
+			if err == errTrackingUnsupported {
+				log.Warn("[WARN] Redis does not support client tracking, cache of backend " + cache.backendName + " relies on cache-fallback-ttl")
+				return
+			}
+			log.Error("[ERROR] Cache invalidation of backend " + cache.backendName + " interrupted: " + err.Error())
+			select {
+			case <-time.After(backoff):
+			case <-cache.stopCh:
+				return
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+		}
+	}()
+}
+
+func (cache *localCache) setTracking(tracking bool) {
+	if tracking {
+		atomic.StoreInt32(&cache.tracking, 1)
+	} else {
+		atomic.StoreInt32(&cache.tracking, 0)
+	}
+}
+
+func (cache *localCache) stop() {
+	close(cache.stopCh)
+}
+
+func (cache *localCache) track(setting connectionSetting) error {
+	network, addr, err := masterAddress(setting)
+	if err != nil {
+		return err
+	}
+
+	subscriber, err := dialResp(setting, network, addr)
+	if err != nil {
+		return err
+	}
+	defer subscriber.close()
+	reply, err := subscriber.do("CLIENT", "ID")
+	if err != nil {
+		if _, ok := err.(respError); ok {
+			return errTrackingUnsupported
+		}
+		return err
+	}
+	id, ok := reply.(int64)
+	if !ok {
+		return errors.New("unexpected reply to CLIENT ID")
+	}
+	_, err = subscriber.do("SUBSCRIBE", invalidateChannel)
+	if err != nil {
+		return err
+	}
+
+	tracker, err := dialResp(setting, network, addr)
+	if err != nil {
+		return err
+	}
+	defer tracker.close()
+	args := []string{"CLIENT", "TRACKING", "on", "REDIRECT", strconv.FormatInt(id, 10), "BCAST"}
+	for _, prefix := range cache.trackingPrefixes() {
+		args = append(args, "PREFIX", prefix)
+	}
+	_, err = tracker.do(args...)
+	if err != nil {
+		if _, ok := err.(respError); ok {
+			return errTrackingUnsupported
+		}
+		return err
+	}
+
+	cache.flush()
+	cache.setTracking(true)
+	log.Info("[INFO] Client tracking enabled for cache of backend " + cache.backendName)
+
+	// Tracking ends with the tracker connection: watch it and unblock the
+	// subscriber when it fails or the cache is stopped.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, err := tracker.do("PING")
+				if err != nil {
+					subscriber.close()
+					return
+				}
+			case <-cache.stopCh:
+				subscriber.close()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		reply, err := subscriber.read()
+		if err != nil {
+			return err
+		}
+		message, ok := reply.([]interface{})
+		if !ok || len(message) != 3 || message[0] != "message" || message[1] != invalidateChannel {
+			continue
+		}
+		switch keys := message[2].(type) {
+		case nil:
+			// FLUSHALL / FLUSHDB invalidate every key.
+			cache.flush()
+		case string:
+			cache.invalidate(keys)
+		case []interface{}:
+			for _, key := range keys {
+				if redisKey, ok := key.(string); ok {
+					cache.invalidate(redisKey)
+				}
+			}
+		}
+	}
+}
+
+// masterAddress resolves the address of the master, asking the sentinels
+// in sentinel mode.
+func masterAddress(setting connectionSetting) (string, string, error) {
+	if setting.Mode != "sentinel" {
+		return setting.Network, setting.Addrs[0], nil
+	}
+	var lastErr error
+	for _, sentinelAddr := range setting.Addrs {
+		sentinel := redis.NewSentinelClient(&redis.Options{
+			Addr:        sentinelAddr,
+			Password:    setting.SentinelPassword,
+			DialTimeout: 5 * time.Second,
+			TLSConfig:   setting.TLSConfig,
+		})
+		addr, err := sentinel.GetMasterAddrByName(setting.MasterName).Result()
+		sentinel.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return "tcp", net.JoinHostPort(addr[0], addr[1]), nil
+	}
+	return "", "", lastErr
+}
+
+// CacheStatistics returns the statistics of every backend with a cache.
+func CacheStatistics() map[string]CacheStats {
+	stats := map[string]CacheStats{}
+	for name, backend := range backends {
+		if backend.cache != nil {
+			stats[name] = backend.cache.stats()
+		}
+	}
+	return stats
+}
+
+func collectCacheStats() {
+	for name, stats := range CacheStatistics() {
+		cacheEntries.set(float64(stats.Entries), name)
+		cacheBytes.set(float64(stats.Bytes), name)
+		if stats.Tracking {
+			cacheTracking.set(1, name)
+		} else {
+			cacheTracking.set(0, name)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package gowebdis
+
+import (
+	"sync"
+)
+
+var coalescedTotal = newCounter("gowebdis_coalesced_total", "Number of reads that shared the reply of an identical read in flight.", "backend", "command")
+
+type flight struct {
+	wait     sync.WaitGroup
+	response CommandResponse
+}
+
+// flightGroup lets concurrent identical reads share a single round trip to
+// redis: the first caller executes the command, the others wait for and
+// receive a copy of its reply.
+type flightGroup struct {
+	mutex   sync.Mutex
+	flights map[string]*flight
+}
+
+var readFlights = flightGroup{flights: map[string]*flight{}}
+
+func (group *flightGroup) do(key string, fn func() CommandResponse) (CommandResponse, bool) {
+	group.mutex.Lock()
+	if f, ok := group.flights[key]; ok {
+		group.mutex.Unlock()
+		f.wait.Wait()
+		return cloneResponse(f.response), true
+	}
+	f := &flight{}
+	f.wait.Add(1)
+	group.flights[key] = f
+	group.mutex.Unlock()
+
+	defer func() {
+		group.mutex.Lock()
+		delete(group.flights, key)
+		group.mutex.Unlock()
+		f.wait.Done()
+	}()
+	f.response = fn()
+	return f.response, false
+}
+
+// coalesces reports whether identical concurrent calls of the command on
+// the backend are merged, which requires a read command declaring the keys
+// it reads.
+func (backend *Backend) coalesces(redisCommand string) bool {
+	if !backend.coalesce || backend.coalesceExclude[redisCommand] {
+		return false
+	}
+	command, ok := LookupCommand(redisCommand)
+	return ok && command.Spec().ReadOnly && command.Spec().ReadKeys != nil
+}
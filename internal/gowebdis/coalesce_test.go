@@ -0,0 +1,55 @@
+package gowebdis
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSharedReplyNotCached has a read join a flight that read the hash
+// before a write invalidated it, and checks that the stale reply it shares
+// is not cached.
+func TestSharedReplyNotCached(t *testing.T) {
+	testRedis.HSet("flight:1", "state", "old")
+	backend, err := ResolveBackend("", "flight:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := JsonPayload{Key: "flight:1"}
+	flightKey := backend.Name + "\x00false\x00" + cacheKey("hgetall", payload)
+	release := make(chan struct{})
+	leaderDone := make(chan struct{})
+	go func() {
+		readFlights.do(flightKey, func() CommandResponse {
+			<-release
+			return CommandResponse{Name: "hgetall", Success: true, MapVal: map[string]string{"state": "old"}}
+		})
+		close(leaderDone)
+	}()
+	for {
+		readFlights.mutex.Lock()
+		_, started := readFlights.flights[flightKey]
+		readFlights.mutex.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if commandResponse := RunRedisCommand(backend, "hset", JsonPayload{Key: "flight:1", Field: "state", Value: "new"}, CommandOptions{}); !commandResponse.Success {
+		t.Fatal(commandResponse.ErrorMessage)
+	}
+	joined := make(chan CommandResponse)
+	go func() {
+		joined <- RunRedisCommand(backend, "hgetall", payload, CommandOptions{})
+	}()
+	// Let the read join the flight.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	<-joined
+	<-leaderDone
+
+	commandResponse := RunRedisCommand(backend, "hgetall", payload, CommandOptions{})
+	if state := commandResponse.MapVal["state"]; !commandResponse.Success || state != "new" {
+		t.Errorf("hgetall after the write returned %q", state)
+	}
+}
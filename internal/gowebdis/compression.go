@@ -0,0 +1,366 @@
+package gowebdis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// compressionHeader starts every compressed value and is followed by the
+// ID of the algorithm. Text and JSON values never start with a NUL byte;
+// values that do are stored escaped, after the header and escapedValueID.
+const compressionHeader = "\x00Z"
+
+const escapedValueID = 'n'
+
+// compressionHookOrder runs compression right before field encryption, so
+// that values are compressed before they are encrypted and decompressed
+// after they are decrypted.
+const compressionHookOrder = encryptionHookOrder - 1
+
+var compressedValuesTotal = newCounter("gowebdis_compressed_values_total", "Number of values compressed, stored uncompressed because compression did not pay off, decompressed, or refused for exceeding --max-reply-size.", "algorithm", "result")
+var compressionInputBytes = newCounter("gowebdis_compression_input_bytes_total", "Size of the values compressed before compression.", "algorithm")
+var compressionOutputBytes = newCounter("gowebdis_compression_output_bytes_total", "Size of the values compressed after compression.", "algorithm")
+var compressionRatio = newGauge("gowebdis_compression_ratio", "Compressed size of all values compressed divided by their original size.", "algorithm")
+
+// compressionAlgorithm compresses values into the format stored after the
+// header.
+type compressionAlgorithm struct {
+	name       string
+	id         byte
+	compress   func(value []byte) ([]byte, error)
+	decompress func(data []byte, limit int) ([]byte, error)
+}
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+var errDecompressedTooLarge = errors.New("decompressed value is too large")
+
+var compressionAlgorithms = []*compressionAlgorithm{
+	{
+		name: "zstd",
+		id:   'z',
+		compress: func(value []byte) ([]byte, error) {
+			return zstdEncoder.EncodeAll(value, nil), nil
+		},
+		decompress: func(data []byte, limit int) ([]byte, error) {
+			// Frames need not announce their size and a value may hold
+			// several frames, so the value is streamed through the limit
+			// rather than decoded at once.
+			options := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+			if limit > 0 {
+				options = append(options, zstd.WithDecoderMaxMemory(uint64(limit)))
+			}
+			decoder, err := zstd.NewReader(bytes.NewReader(data), options...)
+			if err != nil {
+				return nil, err
+			}
+			defer decoder.Close()
+			value, err := readLimited(decoder, limit)
+			if err == zstd.ErrWindowSizeExceeded || err == zstd.ErrDecoderSizeExceeded {
+				err = errDecompressedTooLarge
+			}
+			return value, err
+		},
+	},
+	{
+		name: "snappy",
+		id:   's',
+		compress: func(value []byte) ([]byte, error) {
+			return snappy.Encode(nil, value), nil
+		},
+		decompress: func(data []byte, limit int) ([]byte, error) {
+			size, err := snappy.DecodedLen(data)
+			if err != nil {
+				return nil, err
+			}
+			if limit > 0 && size > limit {
+				return nil, errDecompressedTooLarge
+			}
+			return snappy.Decode(nil, data)
+		},
+	},
+	{
+		name: "gzip",
+		id:   'g',
+		compress: func(value []byte) ([]byte, error) {
+			var buffer bytes.Buffer
+			writer := gzip.NewWriter(&buffer)
+			_, err := writer.Write(value)
+			if err == nil {
+				err = writer.Close()
+			}
+			return buffer.Bytes(), err
+		},
+		decompress: func(data []byte, limit int) ([]byte, error) {
+			reader, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			return readLimited(reader, limit)
+		},
+	},
+}
+
+// readLimited reads a decompressed value, failing once it exceeds limit
+// bytes when limit is positive.
+func readLimited(reader io.Reader, limit int) ([]byte, error) {
+	if limit <= 0 {
+		return ioutil.ReadAll(reader)
+	}
+	value, err := ioutil.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err == nil && len(value) > limit {
+		err = errDecompressedTooLarge
+	}
+	return value, err
+}
+
+func compressionAlgorithmNamed(name string) (*compressionAlgorithm, bool) {
+	for _, algorithm := range compressionAlgorithms {
+		if algorithm.name == name {
+			return algorithm, true
+		}
+	}
+	return nil, false
+}
+
+func compressionAlgorithmWithID(id byte) (*compressionAlgorithm, bool) {
+	for _, algorithm := range compressionAlgorithms {
+		if algorithm.id == id {
+			return algorithm, true
+		}
+	}
+	return nil, false
+}
+
+type compressionRule struct {
+	keyPattern string
+	algorithm  *compressionAlgorithm
+}
+
+// valueCompression compresses the values hset and documents store in the
+// hashes matching its rules once they reach minSize, and decompresses the
+// values hgetall reads from these hashes only. Values that do not shrink
+// are stored as is, values starting with compressionHeader escaped so that
+// clients cannot store values read as compressed. Hashes that no longer
+// match a rule are read as stored.
+type valueCompression struct {
+	rules   []compressionRule
+	minSize int
+
+	mutex       sync.Mutex
+	inputBytes  map[string]float64
+	outputBytes map[string]float64
+}
+
+var compression *valueCompression
+
+// initValueCompression enables compression when --compression names an
+// algorithm for some key patterns.
+func initValueCompression() error {
+	rules, err := loadCompressionRules(viper.GetString("compression"))
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+	compression = &valueCompression{
+		rules:       rules,
+		minSize:     viper.GetInt("compression-min-size"),
+		inputBytes:  map[string]float64{},
+		outputBytes: map[string]float64{},
+	}
+	return AddHook(Hook{
+		Order:    compressionHookOrder,
+		Commands: []string{"hset", "hgetall", "docput", "docpatch"},
+		Before:   compression,
+		After:    compression,
+	})
+}
+
+// loadCompressionRules reads "key-pattern=algorithm" pairs separated by
+// comma, the first matching pattern wins.
+func loadCompressionRules(value string) ([]compressionRule, error) {
+	var rules []compressionRule
+	for _, pair := range splitList(value) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return nil, fmt.Errorf("invalid compression entry %v, expected key-pattern=algorithm", pair)
+		}
+		algorithm, ok := compressionAlgorithmNamed(strings.ToLower(parts[1]))
+		if !ok {
+			return nil, fmt.Errorf("unknown compression algorithm %v, expected zstd, snappy or gzip", parts[1])
+		}
+		rules = append(rules, compressionRule{keyPattern: parts[0], algorithm: algorithm})
+	}
+	return rules, nil
+}
+
+func (c *valueCompression) algorithm(key string) *compressionAlgorithm {
+	for _, rule := range c.rules {
+		if matchesPattern([]string{rule.keyPattern}, key) {
+			return rule.algorithm
+		}
+	}
+	return nil
+}
+
+func (c *valueCompression) BeforeExecute(call *Call) *CommandResponse {
+	payload := &call.JsonPayload
+	algorithm := c.algorithm(payload.Key)
+	if algorithm == nil {
+		return nil
+	}
+	if call.Command == "hset" {
+		payload.Value = c.compress(algorithm, payload.Key, payload.Field, payload.Value)
+	} else if len(payload.Values) > 0 {
+		// Documents, whose values may be shared with the caller.
+		values := make(map[string]string, len(payload.Values))
+		for field, value := range payload.Values {
+			values[field] = c.compress(algorithm, payload.Key, field, value)
+		}
+		payload.Values = values
+	}
+	return nil
+}
+
+// compress returns the value to store for a field, compressed when it
+// reaches the minimum size and shrinks.
+func (c *valueCompression) compress(algorithm *compressionAlgorithm, key string, field string, value string) string {
+	if field == versionField() || field == docTypesField() {
+		return value
+	}
+	if len(value) < c.minSize {
+		return escapeValue(value)
+	}
+	compressed, err := algorithm.compress([]byte(value))
+	if err != nil {
+		compressedValuesTotal.inc(algorithm.name, "error")
+		log.Error("[ERROR] Cannot compress field " + field + " of " + key + ": " + err.Error())
+		return escapeValue(value)
+	}
+	if len(compressionHeader)+1+len(compressed) >= len(value) {
+		compressedValuesTotal.inc(algorithm.name, "skipped")
+		return escapeValue(value)
+	}
+	compressedValuesTotal.inc(algorithm.name, "compressed")
+	c.record(algorithm.name, len(value), len(compressionHeader)+1+len(compressed))
+	return compressionHeader + string(algorithm.id) + string(compressed)
+}
+
+// escapeValue stores a value starting with compressionHeader behind the
+// header, so that it is not read as compressed.
+func escapeValue(value string) string {
+	if !strings.HasPrefix(value, compressionHeader) {
+		return value
+	}
+	return compressionHeader + string(escapedValueID) + value
+}
+
+func (c *valueCompression) record(algorithm string, inputSize int, outputSize int) {
+	compressionInputBytes.add(float64(inputSize), algorithm)
+	compressionOutputBytes.add(float64(outputSize), algorithm)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.inputBytes[algorithm] += float64(inputSize)
+	c.outputBytes[algorithm] += float64(outputSize)
+	compressionRatio.set(c.outputBytes[algorithm]/c.inputBytes[algorithm], algorithm)
+}
+
+func (c *valueCompression) AfterExecute(call *Call, commandResponse *CommandResponse) {
+	if call.Command != "hgetall" || !commandResponse.Success || c.algorithm(call.JsonPayload.Key) == nil {
+		return
+	}
+	var values map[string]string
+	for field, value := range commandResponse.MapVal {
+		if !isCompressed(value) {
+			continue
+		}
+		if values == nil {
+			// The map may be shared with the cache and concurrent
+			// requests.
+			values = make(map[string]string, len(commandResponse.MapVal))
+			for f, v := range commandResponse.MapVal {
+				values[f] = v
+			}
+		}
+		decompressed, err := c.decompress(call.JsonPayload.Key, field, value)
+		if err != nil {
+			*commandResponse = decompressionFailure(commandResponse.Name, err)
+			return
+		}
+		values[field] = decompressed
+	}
+	if values != nil {
+		commandResponse.MapVal = values
+	}
+}
+
+func isCompressed(value string) bool {
+	return len(value) > len(compressionHeader) && strings.HasPrefix(value, compressionHeader)
+}
+
+// decompress returns the original of a value read from a hash matching
+// the rules. It fails for values that cannot be decompressed or would
+// exceed --max-reply-size, which are never returned as stored. Values of
+// other hashes, and values naming no known algorithm, which gowebdis did
+// not write, are returned as stored.
+func (c *valueCompression) decompress(key string, field string, value string) (string, error) {
+	if c == nil || !isCompressed(value) || c.algorithm(key) == nil {
+		return value, nil
+	}
+	id := value[len(compressionHeader)]
+	if id == escapedValueID {
+		return value[len(compressionHeader)+1:], nil
+	}
+	algorithm, ok := compressionAlgorithmWithID(id)
+	if !ok {
+		log.Warn("[WARN] Field " + field + " of " + key + " names no known compression algorithm, returned as stored")
+		return value, nil
+	}
+	maxSize := viper.GetInt("max-reply-size")
+	decompressed, err := algorithm.decompress([]byte(value[len(compressionHeader)+1:]), maxSize)
+	if err == errDecompressedTooLarge {
+		compressedValuesTotal.inc(algorithm.name, "too_large")
+		log.Error("[ERROR] Field " + field + " of " + key + " is too large to decompress")
+		return "", &decompressionError{code: ErrorCodeTooLarge, message: fmt.Sprintf("Field %v of %v is larger than %v bytes decompressed", field, key, maxSize)}
+	}
+	if err != nil {
+		compressedValuesTotal.inc(algorithm.name, "error")
+		log.Error("[ERROR] Cannot decompress field " + field + " of " + key + ": " + err.Error())
+		return "", &decompressionError{code: ErrorCodeInternal, message: fmt.Sprintf("Cannot decompress field %v of %v", field, key)}
+	}
+	compressedValuesTotal.inc(algorithm.name, "decompressed")
+	return string(decompressed), nil
+}
+
+// decompressionError fails a read whose values cannot be returned: too
+// large for --max-reply-size, or internal for corrupted values.
+type decompressionError struct {
+	code    string
+	message string
+}
+
+func (err *decompressionError) Error() string {
+	return err.message
+}
+
+func decompressionFailure(redisCommand string, err error) CommandResponse {
+	commandResponse := CommandResponse{Name: redisCommand}
+	commandResponse.Success = false
+	commandResponse.ErrorCode = ErrorCodeInternal
+	if decompressionErr, ok := err.(*decompressionError); ok {
+		commandResponse.ErrorCode = decompressionErr.code
+	}
+	commandResponse.ErrorMessage = err.Error()
+	return commandResponse
+}
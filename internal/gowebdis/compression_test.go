@@ -0,0 +1,114 @@
+package gowebdis
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/viper"
+)
+
+func newTestCompression(t *testing.T, rules string) *valueCompression {
+	loaded, err := loadCompressionRules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &valueCompression{rules: loaded, inputBytes: map[string]float64{}, outputBytes: map[string]float64{}}
+}
+
+func TestDecompress(t *testing.T) {
+	c := newTestCompression(t, "doc:*=zstd")
+	original := strings.Repeat("gowebdis ", 100)
+	for _, algorithm := range compressionAlgorithms {
+		compressed, err := algorithm.compress([]byte(original))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored := compressionHeader + string(algorithm.id) + string(compressed)
+		value, err := c.decompress("doc:1", "body", stored)
+		if err != nil || value != original {
+			t.Errorf("%v: decompressed %q, %v", algorithm.name, value, err)
+		}
+		if value, err := c.decompress("user:1", "body", stored); err != nil || value != stored {
+			t.Errorf("%v: value of a hash without rule decompressed to %q, %v", algorithm.name, value, err)
+		}
+
+		viper.Set("max-reply-size", len(original)-1)
+		value, err = c.decompress("doc:1", "body", stored)
+		viper.Set("max-reply-size", 0)
+		if err == nil || len(value) > 0 {
+			t.Errorf("%v: value over --max-reply-size returned %q", algorithm.name, value)
+		} else if code := decompressionFailure("hgetall", err).ErrorCode; code != ErrorCodeTooLarge {
+			t.Errorf("%v: value over --max-reply-size failed with %v", algorithm.name, code)
+		}
+
+		value, err = c.decompress("doc:1", "body", stored[:len(stored)/2])
+		if err == nil || len(value) > 0 {
+			t.Errorf("%v: corrupted value returned %q", algorithm.name, value)
+		} else if code := decompressionFailure("hgetall", err).ErrorCode; code != ErrorCodeInternal {
+			t.Errorf("%v: corrupted value failed with %v", algorithm.name, code)
+		}
+	}
+	if value, err := c.decompress("doc:1", "body", "plain"); err != nil || value != "plain" {
+		t.Errorf("plain value decompressed to %q, %v", value, err)
+	}
+	unknown := compressionHeader + "?data"
+	if value, err := c.decompress("doc:1", "body", unknown); err != nil || value != unknown {
+		t.Errorf("value of an unknown algorithm decompressed to %q, %v", value, err)
+	}
+	var disabled *valueCompression
+	if value, err := disabled.decompress("doc:1", "body", unknown); err != nil || value != unknown {
+		t.Errorf("value decompressed to %q, %v without compression", value, err)
+	}
+}
+
+// TestDecompressFrames checks that the size limit holds for zstd values
+// made of several frames that do not announce their size.
+func TestDecompressFrames(t *testing.T) {
+	c := newTestCompression(t, "doc:*=zstd")
+	var frames bytes.Buffer
+	frames.Write(zstdEncoder.EncodeAll([]byte("small"), nil))
+	writer, err := zstd.NewWriter(&frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(make([]byte, 1<<20))
+	writer.Close()
+	stored := compressionHeader + "z" + frames.String()
+
+	viper.Set("max-reply-size", 1<<16)
+	value, err := c.decompress("doc:1", "body", stored)
+	viper.Set("max-reply-size", 0)
+	if err == nil || len(value) > 0 {
+		t.Fatalf("frames of %v bytes over --max-reply-size returned %v bytes", frames.Len(), len(value))
+	}
+	if code := decompressionFailure("hgetall", err).ErrorCode; code != ErrorCodeTooLarge {
+		t.Errorf("frames over --max-reply-size failed with %v", code)
+	}
+	if value, err := c.decompress("doc:1", "body", stored); err != nil || len(value) != 1<<20+len("small") {
+		t.Errorf("frames decompressed to %v bytes, %v", len(value), err)
+	}
+}
+
+func TestCompressEscapesHeader(t *testing.T) {
+	c := newTestCompression(t, "doc:*=zstd")
+	c.minSize = 16
+	algorithm := c.algorithm("doc:1")
+	for _, value := range []string{
+		compressionHeader + "z",
+		compressionHeader + "zdata that cannot be decompressed",
+		compressionHeader + strings.Repeat("z", 100),
+	} {
+		stored := c.compress(algorithm, "doc:1", "body", value)
+		if stored == value {
+			t.Errorf("%q stored as is", value)
+		}
+		if read, err := c.decompress("doc:1", "body", stored); err != nil || read != value {
+			t.Errorf("%q read back as %q, %v", value, read, err)
+		}
+	}
+	if stored := c.compress(algorithm, "doc:1", "body", "short"); stored != "short" {
+		t.Errorf("short value stored as %q", stored)
+	}
+}
@@ -0,0 +1,325 @@
+package gowebdis
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/spf13/viper"
+)
+
+// connectionSetting holds everything needed to build the options of one of
+// the three client types. Durations are in seconds and -1 keeps the
+// go-redis default.
+type connectionSetting struct {
+	Mode             string
+	Network          string
+	Addrs            []string
+	MasterName       string
+	Username         string
+	Password         string
+	SentinelPassword string
+	DB               int
+
+	MaxRetries      int
+	MinRetryBackoff int
+	MaxRetryBackoff int
+	DialTimeout     int
+	ReadTimeout     int
+	WriteTimeout    int
+
+	PoolSize           int
+	MinIdleConns       int
+	MaxConnAge         int
+	PoolTimeout        int
+	IdleTimeout        int
+	IdleCheckFrequency int
+
+	TLSConfig *tls.Config
+	// Renames maps command names to the names set with rename-command on
+	// the servers of the backend.
+	Renames map[string]string
+}
+
+// intSettings maps option names, shared by command line flags and
+// redis URL query strings, to their field in connectionSetting.
+func (setting *connectionSetting) intSettings() map[string]*int {
+	return map[string]*int{
+		"db":                   &setting.DB,
+		"max-retries":          &setting.MaxRetries,
+		"min-retry-backoff":    &setting.MinRetryBackoff,
+		"max-retry-backoff":    &setting.MaxRetryBackoff,
+		"dial-timeout":         &setting.DialTimeout,
+		"read-timeout":         &setting.ReadTimeout,
+		"write-timeout":        &setting.WriteTimeout,
+		"pool-size":            &setting.PoolSize,
+		"min-idle-conns":       &setting.MinIdleConns,
+		"max-conn-age":         &setting.MaxConnAge,
+		"pool-timeout":         &setting.PoolTimeout,
+		"idle-timeout":         &setting.IdleTimeout,
+		"idle-check-frequency": &setting.IdleCheckFrequency,
+	}
+}
+
+// settingSource reads the settings of one backend. The default backend is
+// configured through flags, named backends through their own section of
+// the config file and fall back to the flags for everything but the
+// address of the server and its credentials.
+type settingSource struct {
+	config *viper.Viper
+}
+
+var backendOnlySettings = map[string]bool{
+	"redis-url":         true,
+	"mode":              true,
+	"host":              true,
+	"sentinel-address":  true,
+	"master-name":       true,
+	"username":          true,
+	"password":          true,
+	"sentinel-password": true,
+	"replica-address":   true,
+}
+
+func (source settingSource) lookup(key string) *viper.Viper {
+	if source.config != nil && (backendOnlySettings[key] || source.config.IsSet(key)) {
+		return source.config
+	}
+	return viper.GetViper()
+}
+
+func (source settingSource) getString(key string) string {
+	return source.lookup(key).GetString(key)
+}
+
+func (source settingSource) getInt(key string) int {
+	return source.lookup(key).GetInt(key)
+}
+
+func (source settingSource) getBool(key string) bool {
+	return source.lookup(key).GetBool(key)
+}
+
+func loadConnectionSetting(source settingSource) (connectionSetting, error) {
+	var setting connectionSetting
+
+	setting.Network = "tcp"
+	setting.MasterName = source.getString("master-name")
+	setting.Username = source.getString("username")
+	setting.Password = source.getString("password")
+	setting.SentinelPassword = source.getString("sentinel-password")
+	for name, value := range setting.intSettings() {
+		*value = source.getInt(name)
+	}
+	renames, err := loadRenamedCommands(source)
+	if err != nil {
+		return setting, err
+	}
+	setting.Renames = renames
+
+	mode, err := normalizeMode(source.getString("mode"))
+	if err != nil {
+		return setting, err
+	}
+
+	useTls := source.getBool("redis-tls")
+	redisUrl := source.getString("redis-url")
+	if len(redisUrl) > 0 {
+		urlMode, urlTls, err := applyRedisUrl(&setting, redisUrl)
+		if err != nil {
+			return setting, err
+		}
+		if len(urlMode) > 0 {
+			if len(mode) > 0 && mode != urlMode {
+				return setting, fmt.Errorf("--mode %v conflicts with the scheme of --redis-url", mode)
+			}
+			mode = urlMode
+		}
+		useTls = useTls || urlTls
+	} else {
+		sentinelAddressString := source.getString("sentinel-address")
+		hostString := source.getString("host")
+		if mode == "sentinel" || (len(mode) == 0 && len(sentinelAddressString) > 0) {
+			mode = "sentinel"
+			setting.Addrs = splitList(sentinelAddressString)
+		} else {
+			setting.Addrs = splitList(hostString)
+		}
+	}
+
+	if len(setting.Addrs) == 0 {
+		return setting, errors.New("no redis address configured, set --host, --sentinel-address or --redis-url")
+	}
+	if len(mode) == 0 {
+		// Without an explicit --mode a list of hosts means cluster.
+		if len(setting.Addrs) > 1 {
+			mode = "cluster"
+		} else {
+			mode = "host"
+		}
+	}
+	switch mode {
+	case "host":
+		if len(setting.Addrs) > 1 {
+			return setting, errors.New("standalone mode accepts a single redis address")
+		}
+	case "sentinel":
+		if len(setting.MasterName) == 0 {
+			return setting, errors.New("sentinel mode requires a master name")
+		}
+	case "cluster":
+		if setting.Network == "unix" {
+			return setting, errors.New("cluster mode does not support unix sockets")
+		}
+	}
+	setting.Mode = mode
+
+	setting.TLSConfig, err = newRedisTlsConfig(source, useTls)
+	if err != nil {
+		return setting, err
+	}
+	return setting, nil
+}
+
+// normalizeMode maps the --mode flag to the internal connection type.
+func normalizeMode(mode string) (string, error) {
+	switch strings.ToLower(mode) {
+	case "":
+		return "", nil
+	case "standalone", "host":
+		return "host", nil
+	case "sentinel":
+		return "sentinel", nil
+	case "cluster":
+		return "cluster", nil
+	}
+	return "", fmt.Errorf("unsupported mode %v, expected standalone, sentinel or cluster", mode)
+}
+
+func splitList(listString string) []string {
+	var values []string
+	for _, value := range strings.Split(listString, ",") {
+		value = strings.TrimSpace(value)
+		if len(value) > 0 {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func seconds(value int) time.Duration {
+	return time.Duration(value) * time.Second
+}
+
+func newFailoverOptions(setting connectionSetting) redis.FailoverOptions {
+	var options redis.FailoverOptions
+
+	options.MasterName = setting.MasterName
+	options.SentinelAddrs = setting.Addrs
+	options.SentinelPassword = setting.SentinelPassword
+	options.Username = setting.Username
+	options.Password = setting.Password
+	options.DB = setting.DB
+	// Retries are left to gowebdis, see retryPolicy.
+	options.MaxRetries = -1
+	if setting.DialTimeout > -1 {
+		options.DialTimeout = seconds(setting.DialTimeout)
+	}
+	if setting.ReadTimeout > -1 {
+		options.ReadTimeout = seconds(setting.ReadTimeout)
+	}
+	if setting.WriteTimeout > -1 {
+		options.WriteTimeout = seconds(setting.WriteTimeout)
+	}
+	options.PoolSize = setting.PoolSize
+	options.MinIdleConns = setting.MinIdleConns
+	if setting.MaxConnAge > -1 {
+		options.MaxConnAge = seconds(setting.MaxConnAge)
+	}
+	if setting.PoolTimeout > -1 {
+		options.PoolTimeout = seconds(setting.PoolTimeout)
+	}
+	if setting.IdleTimeout > -1 {
+		options.IdleTimeout = seconds(setting.IdleTimeout)
+	}
+	if setting.IdleCheckFrequency > -1 {
+		options.IdleCheckFrequency = seconds(setting.IdleCheckFrequency)
+	}
+	options.TLSConfig = setting.TLSConfig
+	return options
+}
+
+func newClusterOptions(setting connectionSetting) redis.ClusterOptions {
+	var options redis.ClusterOptions
+
+	options.Addrs = setting.Addrs
+	options.Username = setting.Username
+	options.Password = setting.Password
+	// Retries are left to gowebdis, see retryPolicy.
+	options.MaxRetries = -1
+	if setting.DialTimeout > -1 {
+		options.DialTimeout = seconds(setting.DialTimeout)
+	}
+	if setting.ReadTimeout > -1 {
+		options.ReadTimeout = seconds(setting.ReadTimeout)
+	}
+	if setting.WriteTimeout > -1 {
+		options.WriteTimeout = seconds(setting.WriteTimeout)
+	}
+	options.PoolSize = setting.PoolSize
+	options.MinIdleConns = setting.MinIdleConns
+	if setting.MaxConnAge > -1 {
+		options.MaxConnAge = seconds(setting.MaxConnAge)
+	}
+	if setting.PoolTimeout > -1 {
+		options.PoolTimeout = seconds(setting.PoolTimeout)
+	}
+	if setting.IdleTimeout > -1 {
+		options.IdleTimeout = seconds(setting.IdleTimeout)
+	}
+	if setting.IdleCheckFrequency > -1 {
+		options.IdleCheckFrequency = seconds(setting.IdleCheckFrequency)
+	}
+	options.TLSConfig = setting.TLSConfig
+	return options
+}
+
+func newHostOptions(setting connectionSetting) redis.Options {
+	var options redis.Options
+
+	options.Network = setting.Network
+	options.Addr = setting.Addrs[0]
+	options.Username = setting.Username
+	options.Password = setting.Password
+	options.DB = setting.DB
+	// Retries are left to gowebdis, see retryPolicy.
+	options.MaxRetries = -1
+	if setting.DialTimeout > -1 {
+		options.DialTimeout = seconds(setting.DialTimeout)
+	}
+	if setting.ReadTimeout > -1 {
+		options.ReadTimeout = seconds(setting.ReadTimeout)
+	}
+	if setting.WriteTimeout > -1 {
+		options.WriteTimeout = seconds(setting.WriteTimeout)
+	}
+	options.PoolSize = setting.PoolSize
+	options.MinIdleConns = setting.MinIdleConns
+	if setting.MaxConnAge > -1 {
+		options.MaxConnAge = seconds(setting.MaxConnAge)
+	}
+	if setting.PoolTimeout > -1 {
+		options.PoolTimeout = seconds(setting.PoolTimeout)
+	}
+	if setting.IdleTimeout > -1 {
+		options.IdleTimeout = seconds(setting.IdleTimeout)
+	}
+	if setting.IdleCheckFrequency > -1 {
+		options.IdleCheckFrequency = seconds(setting.IdleCheckFrequency)
+	}
+	options.TLSConfig = setting.TLSConfig
+	return options
+}
@@ -0,0 +1,438 @@
+package gowebdis
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/spf13/viper"
+)
+
+// Documents are JSON objects stored in a hash, one field per leaf: nested
+// objects are flattened into dotted field names, e.g. {"address":
+// {"city": "Paris"}} into the field address.city. Strings are stored as is
+// and every other value as JSON, with its type recorded in the types field
+// of the hash, so that plain hset and hgetall interoperate with documents.
+const (
+	docTypeNumber  = "number"
+	docTypeBoolean = "boolean"
+	docTypeNull    = "null"
+	docTypeArray   = "array"
+	docTypeObject  = "object"
+)
+
+// docPutScript replaces the hash with the fields of ARGV, keeping the
+// version counting when --version-field is set.
+var docPutScript = redis.NewScript(versionCheckScript + `
+redis.call('DEL', KEYS[1])
+local count = 0
+for i = 4, #ARGV, 2 do
+	redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+	count = count + 1
+end
+if ARGV[1] == '' then
+	return {count, ''}
+end
+local version = tonumber(current) + 1
+redis.call('HSET', KEYS[1], ARGV[1], version)
+settle()
+return {count, tostring(version)}
+`)
+
+// docPatchScript applies a merge patch compiled by CompileMergePatch.
+// ARGV[4] is the types field and ARGV[5] the number of deleted paths that
+// follow, then come the fields to set. Objects listed in the types of the
+// patch replace the values stored at their path and are kept empty when
+// the patch leaves them without fields.
+var docPatchScript = redis.NewScript(versionCheckScript + `
+local typesField = ARGV[4]
+local types = {}
+local stored = redis.call('HGET', KEYS[1], typesField)
+if stored then
+	local ok, decoded = pcall(cjson.decode, stored)
+	if ok and type(decoded) == 'table' then
+		types = decoded
+	end
+end
+local present = {}
+for _, field in ipairs(redis.call('HKEYS', KEYS[1])) do
+	present[field] = true
+end
+local function remove(field)
+	if present[field] then
+		redis.call('HDEL', KEYS[1], field)
+		present[field] = nil
+	end
+	types[field] = nil
+end
+local function hasChildren(path)
+	for field in pairs(present) do
+		if string.sub(field, 1, #path + 1) == path .. '.' then
+			return true
+		end
+	end
+	return false
+end
+
+local deleted = tonumber(ARGV[5])
+for i = 6, 5 + deleted do
+	remove(ARGV[i])
+	for field in pairs(present) do
+		if string.sub(field, 1, #ARGV[i] + 1) == ARGV[i] .. '.' then
+			remove(field)
+		end
+	end
+end
+local patchTypes = {}
+local values = {}
+for i = 6 + deleted, #ARGV, 2 do
+	if ARGV[i] == typesField then
+		patchTypes = cjson.decode(ARGV[i + 1])
+	else
+		values[ARGV[i]] = ARGV[i + 1]
+	end
+end
+local objects = {}
+for path, kind in pairs(patchTypes) do
+	if kind == 'object' and values[path] == nil then
+		remove(path)
+		table.insert(objects, path)
+	end
+end
+local count = 0
+for field, value in pairs(values) do
+	redis.call('HSET', KEYS[1], field, value)
+	present[field] = true
+	types[field] = patchTypes[field]
+	count = count + 1
+end
+table.sort(objects, function(a, b) return #a > #b end)
+for _, path in ipairs(objects) do
+	if not hasChildren(path) then
+		redis.call('HSET', KEYS[1], path, '{}')
+		present[path] = true
+		types[path] = 'object'
+	end
+end
+if next(types) == nil then
+	redis.call('HSET', KEYS[1], typesField, '{}')
+else
+	redis.call('HSET', KEYS[1], typesField, cjson.encode(types))
+end
+if ARGV[1] == '' then
+	return {count, ''}
+end
+local version = redis.call('HINCRBY', KEYS[1], ARGV[1], 1)
+settle()
+return {count, tostring(version)}
+`)
+
+// docDelScript deletes the document, keeping the version field as
+// versionCheckScript describes.
+var docDelScript = redis.NewScript(versionCheckScript + `
+if ARGV[1] == '' then
+	return {redis.call('DEL', KEYS[1]), ''}
+end
+if redis.call('HLEN', KEYS[1]) <= redis.call('HEXISTS', KEYS[1], ARGV[1]) then
+	return {0, current}
+end
+redis.call('DEL', KEYS[1])
+local version = tonumber(current) + 1
+redis.call('HSET', KEYS[1], ARGV[1], version)
+settle()
+return {1, tostring(version)}
+`)
+
+func docTypesField() string {
+	return viper.GetString("doc-types-field")
+}
+
+// DecodeDocument reads a JSON object, keeping the precision of numbers.
+func DecodeDocument(body []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("document is followed by more data")
+	}
+	document, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("document is not a JSON object")
+	}
+	return document, nil
+}
+
+// checkDocumentName refuses names that cannot be flattened: names holding
+// dots would be split on reading, and the types and version fields are
+// maintained by gowebdis.
+func checkDocumentName(path string, name string) error {
+	where := "the document"
+	if len(path) > 0 {
+		where = path
+	}
+	if len(name) == 0 {
+		return fmt.Errorf("empty name in %v", where)
+	}
+	if strings.Contains(name, ".") {
+		return fmt.Errorf("name %q in %v contains a dot", name, where)
+	}
+	if len(path) == 0 && (name == docTypesField() || name == versionField()) {
+		return fmt.Errorf("'%v' is maintained by gowebdis and cannot be written", name)
+	}
+	return nil
+}
+
+func documentPath(path string, name string) string {
+	if len(path) == 0 {
+		return name
+	}
+	return path + "." + name
+}
+
+// encodeDocumentValue returns the stored form of a leaf and its type, empty
+// for strings.
+func encodeDocumentValue(value interface{}) (string, string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, "", nil
+	case json.Number:
+		return v.String(), docTypeNumber, nil
+	case bool:
+		if v {
+			return "true", docTypeBoolean, nil
+		}
+		return "false", docTypeBoolean, nil
+	case nil:
+		return "null", docTypeNull, nil
+	case []interface{}:
+		encoded, err := json.Marshal(v)
+		return string(encoded), docTypeArray, err
+	case map[string]interface{}:
+		// Only empty objects are leaves.
+		return "{}", docTypeObject, nil
+	}
+	return "", "", fmt.Errorf("unsupported value %v", value)
+}
+
+// FlattenDocument returns the fields of the hash storing a document,
+// including its types field.
+func FlattenDocument(document map[string]interface{}) (map[string]string, error) {
+	values := map[string]string{}
+	types := map[string]string{}
+	err := flattenDocument("", document, values, types)
+	if err != nil {
+		return nil, err
+	}
+	encoded, _ := json.Marshal(types)
+	values[docTypesField()] = string(encoded)
+	return values, nil
+}
+
+func flattenDocument(path string, object map[string]interface{}, values map[string]string, types map[string]string) error {
+	for name, value := range object {
+		err := checkDocumentName(path, name)
+		if err != nil {
+			return err
+		}
+		field := documentPath(path, name)
+		if child, ok := value.(map[string]interface{}); ok && len(child) > 0 {
+			err = flattenDocument(field, child, values, types)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		stored, kind, err := encodeDocumentValue(value)
+		if err != nil {
+			return err
+		}
+		values[field] = stored
+		if len(kind) > 0 {
+			types[field] = kind
+		}
+	}
+	return nil
+}
+
+// CompileMergePatch turns a JSON Merge Patch (RFC 7396) into the paths to
+// delete and the fields to set of docpatch. The types field of the values
+// lists the type of the fields set and every object of the patch.
+func CompileMergePatch(patch map[string]interface{}) (map[string]string, []string, error) {
+	values := map[string]string{}
+	types := map[string]string{}
+	var deleted []string
+	err := compileMergePatch("", patch, values, types, &deleted)
+	if err != nil {
+		return nil, nil, err
+	}
+	encoded, _ := json.Marshal(types)
+	values[docTypesField()] = string(encoded)
+	sort.Strings(deleted)
+	return values, deleted, nil
+}
+
+func compileMergePatch(path string, patch map[string]interface{}, values map[string]string, types map[string]string, deleted *[]string) error {
+	for name, value := range patch {
+		err := checkDocumentName(path, name)
+		if err != nil {
+			return err
+		}
+		field := documentPath(path, name)
+		switch v := value.(type) {
+		case nil:
+			*deleted = append(*deleted, field)
+		case map[string]interface{}:
+			types[field] = docTypeObject
+			err = compileMergePatch(field, v, values, types, deleted)
+			if err != nil {
+				return err
+			}
+		default:
+			// Values replace whatever the path held, objects included.
+			*deleted = append(*deleted, field)
+			stored, kind, err := encodeDocumentValue(v)
+			if err != nil {
+				return err
+			}
+			values[field] = stored
+			if len(kind) > 0 {
+				types[field] = kind
+			}
+		}
+	}
+	return nil
+}
+
+// decodeDocumentValue returns the value of a leaf. Values that do not
+// parse as their recorded type, e.g. because they were overwritten with
+// hset, are strings.
+func decodeDocumentValue(value string, kind string) interface{} {
+	if len(kind) == 0 {
+		return value
+	}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	var decoded interface{}
+	if decoder.Decode(&decoded) != nil || decoder.More() {
+		return value
+	}
+	matches := false
+	switch decoded.(type) {
+	case json.Number:
+		matches = kind == docTypeNumber
+	case bool:
+		matches = kind == docTypeBoolean
+	case nil:
+		matches = kind == docTypeNull
+	case []interface{}:
+		matches = kind == docTypeArray
+	case map[string]interface{}:
+		matches = kind == docTypeObject
+	}
+	if !matches {
+		return value
+	}
+	return decoded
+}
+
+// AssembleDocument rebuilds the document stored in the fields of a hash.
+// Fields written without the types field, e.g. with hset, are strings.
+// It fails when a field is both a value and an object, e.g. a and a.b.
+func AssembleDocument(values map[string]string) (map[string]interface{}, error) {
+	types := map[string]string{}
+	if encoded, ok := values[docTypesField()]; ok {
+		// A corrupted types field leaves every value a string.
+		_ = json.Unmarshal([]byte(encoded), &types)
+	}
+	fields := make([]string, 0, len(values))
+	for field := range values {
+		if field == docTypesField() || field == versionField() {
+			continue
+		}
+		fields = append(fields, field)
+	}
+	// Parents sort before their children.
+	sort.Strings(fields)
+	document := map[string]interface{}{}
+	for _, field := range fields {
+		names := strings.Split(field, ".")
+		object := document
+		for idx, name := range names[:len(names)-1] {
+			child, ok := object[name]
+			if !ok {
+				child = map[string]interface{}{}
+				object[name] = child
+			}
+			childObject, ok := child.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("field %v conflicts with %v", strings.Join(names[:idx+1], "."), field)
+			}
+			object = childObject
+		}
+		name := names[len(names)-1]
+		value := decodeDocumentValue(values[field], types[field])
+		if existing, ok := object[name]; ok {
+			if _, isObject := existing.(map[string]interface{}); !isObject {
+				return nil, fmt.Errorf("field %v is set twice", field)
+			}
+			if valueObject, isObject := value.(map[string]interface{}); isObject && len(valueObject) == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("field %v conflicts with its fields", field)
+		}
+		object[name] = value
+	}
+	return document, nil
+}
+
+// The document scripts reply like the version scripts, with an empty
+// version when --version-field is not set, so runVersionedScript and
+// transactions read their replies.
+func docPut(client redis.UniversalClient, jsonPayload JsonPayload, options CommandOptions) CommandResponse {
+	var commandResponse = CommandResponse{Name: "docput"}
+	args := make([]interface{}, 0, 2*len(jsonPayload.Values))
+	for field, value := range jsonPayload.Values {
+		if field == versionField() {
+			return versionFieldError(commandResponse)
+		}
+		args = append(args, field, value)
+	}
+	return runVersionedScript(commandResponse, client, docPutScript, jsonPayload.Key, options.IfMatch, args...)
+}
+
+func docPatchArgs(jsonPayload JsonPayload) []interface{} {
+	args := []interface{}{docTypesField(), len(jsonPayload.Fields)}
+	for _, field := range jsonPayload.Fields {
+		args = append(args, field)
+	}
+	for field, value := range jsonPayload.Values {
+		args = append(args, field, value)
+	}
+	return args
+}
+
+func docPatch(client redis.UniversalClient, jsonPayload JsonPayload, options CommandOptions) CommandResponse {
+	var commandResponse = CommandResponse{Name: "docpatch"}
+	if _, ok := jsonPayload.Values[versionField()]; ok {
+		return versionFieldError(commandResponse)
+	}
+	for _, field := range jsonPayload.Fields {
+		if field == versionField() {
+			return versionFieldError(commandResponse)
+		}
+	}
+	return runVersionedScript(commandResponse, client, docPatchScript, jsonPayload.Key, options.IfMatch, docPatchArgs(jsonPayload)...)
+}
+
+func docDel(client redis.UniversalClient, jsonPayload JsonPayload, options CommandOptions) CommandResponse {
+	var commandResponse = CommandResponse{Name: "docdel"}
+	return runVersionedScript(commandResponse, client, docDelScript, jsonPayload.Key, options.IfMatch)
+}
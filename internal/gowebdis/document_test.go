@@ -0,0 +1,223 @@
+package gowebdis
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func decodeTestDocument(t *testing.T, body string) map[string]interface{} {
+	document, err := DecodeDocument([]byte(body))
+	if err != nil {
+		t.Fatalf("%v: %v", body, err)
+	}
+	return document
+}
+
+func encodeTestDocument(document map[string]interface{}) string {
+	encoded, _ := json.Marshal(document)
+	return string(encoded)
+}
+
+func TestFlattenDocument(t *testing.T) {
+	viper.Set("doc-types-field", "$types")
+	defer viper.Set("doc-types-field", nil)
+	tests := []struct {
+		document string
+		values   map[string]string
+	}{
+		{`{}`, map[string]string{"$types": `{}`}},
+		{`{"name":"ada","age":"36"}`, map[string]string{"name": "ada", "age": "36", "$types": `{}`}},
+		{
+			`{"age":36,"ratio":-1.50,"big":12345678901234567890,"admin":false,"nickname":null}`,
+			map[string]string{"age": "36", "ratio": "-1.50", "big": "12345678901234567890", "admin": "false", "nickname": "null",
+				"$types": `{"admin":"boolean","age":"number","big":"number","nickname":"null","ratio":"number"}`},
+		},
+		{
+			`{"address":{"city":"Paris","geo":{"lat":48.8}},"tags":["a",1,null,{"b":true}],"settings":{}}`,
+			map[string]string{"address.city": "Paris", "address.geo.lat": "48.8", "tags": `["a",1,null,{"b":true}]`, "settings": "{}",
+				"$types": `{"address.geo.lat":"number","settings":"object","tags":"array"}`},
+		},
+	}
+	for _, test := range tests {
+		values, err := FlattenDocument(decodeTestDocument(t, test.document))
+		if err != nil || !reflect.DeepEqual(values, test.values) {
+			t.Errorf("FlattenDocument(%v) = %v, %v, want %v", test.document, values, err, test.values)
+		}
+	}
+
+	for _, document := range []string{`{"a.b":1}`, `{"":1}`, `{"a":{"":1}}`, `{"$types":"{}"}`} {
+		if values, err := FlattenDocument(decodeTestDocument(t, document)); err == nil {
+			t.Errorf("FlattenDocument(%v) = %v, want an error", document, values)
+		}
+	}
+}
+
+// TestDocumentRoundTrip checks that documents read back with the types and
+// the precision they were written with.
+func TestDocumentRoundTrip(t *testing.T) {
+	viper.Set("doc-types-field", "$types")
+	defer viper.Set("doc-types-field", nil)
+	for _, body := range []string{
+		`{}`,
+		`{"name":"ada","age":"36","admin":"true","empty":"","nothing":"null"}`,
+		`{"age":36,"ratio":-1.50,"exp":1e400,"big":12345678901234567890,"zero":0}`,
+		`{"admin":true,"banned":false,"nickname":null}`,
+		`{"tags":[],"matrix":[[1,2],[3]],"mixed":["a",1,true,null,{"b":{}}]}`,
+		`{"settings":{},"profile":{"address":{},"name":"ada"}}`,
+		`{"a":{"b":{"c":{"d":1,"e":{"f":[null]}}}}}`,
+	} {
+		document := decodeTestDocument(t, body)
+		values, err := FlattenDocument(document)
+		if err != nil {
+			t.Fatalf("FlattenDocument(%v): %v", body, err)
+		}
+		assembled, err := AssembleDocument(values)
+		if err != nil {
+			t.Errorf("AssembleDocument of %v: %v", body, err)
+			continue
+		}
+		if want, got := encodeTestDocument(document), encodeTestDocument(assembled); got != want {
+			t.Errorf("%v read back as %v, want %v", body, got, want)
+		}
+	}
+}
+
+func TestAssembleDocument(t *testing.T) {
+	viper.Set("doc-types-field", "$types")
+	defer viper.Set("doc-types-field", nil)
+	tests := []struct {
+		values   map[string]string
+		document string
+	}{
+		// Fields written with hset are strings.
+		{map[string]string{"age": "36", "address.city": "Paris"}, `{"address":{"city":"Paris"},"age":"36"}`},
+		// Values no longer parsing as their type are strings.
+		{map[string]string{"age": "old", "admin": "1", "$types": `{"age":"number","admin":"boolean"}`}, `{"admin":"1","age":"old"}`},
+		// A corrupted types field leaves every value a string.
+		{map[string]string{"age": "36", "$types": "{"}, `{"age":"36"}`},
+		// Empty objects are dropped once their fields are set.
+		{map[string]string{"a": "{}", "a.b": "1", "$types": `{"a":"object","a.b":"number"}`}, `{"a":{"b":1}}`},
+	}
+	for _, test := range tests {
+		document, err := AssembleDocument(test.values)
+		if err != nil || encodeTestDocument(document) != test.document {
+			t.Errorf("AssembleDocument(%v) = %v, %v, want %v", test.values, encodeTestDocument(document), err, test.document)
+		}
+	}
+
+	for _, values := range []map[string]string{
+		{"a": "1", "a.b": "2"},
+		{"a": "[]", "a.b": "2", "$types": `{"a":"array"}`},
+	} {
+		if document, err := AssembleDocument(values); err == nil {
+			t.Errorf("AssembleDocument(%v) = %v, want an error", values, document)
+		}
+	}
+}
+
+func TestCompileMergePatch(t *testing.T) {
+	viper.Set("doc-types-field", "$types")
+	defer viper.Set("doc-types-field", nil)
+	tests := []struct {
+		patch   string
+		values  map[string]string
+		deleted []string
+	}{
+		{`{}`, map[string]string{"$types": `{}`}, nil},
+		{`{"name":"ada"}`, map[string]string{"name": "ada", "$types": `{}`}, []string{"name"}},
+		{`{"name":null}`, map[string]string{"$types": `{}`}, []string{"name"}},
+		{
+			`{"age":37,"admin":true,"tags":[1]}`,
+			map[string]string{"age": "37", "admin": "true", "tags": "[1]", "$types": `{"admin":"boolean","age":"number","tags":"array"}`},
+			[]string{"admin", "age", "tags"},
+		},
+		{
+			`{"address":{"city":"Paris","zip":null,"geo":{}}}`,
+			map[string]string{"address.city": "Paris", "$types": `{"address":"object","address.geo":"object"}`},
+			[]string{"address.city", "address.zip"},
+		},
+	}
+	for _, test := range tests {
+		values, deleted, err := CompileMergePatch(decodeTestDocument(t, test.patch))
+		if err != nil || !reflect.DeepEqual(values, test.values) || !reflect.DeepEqual(deleted, test.deleted) {
+			t.Errorf("CompileMergePatch(%v) = %v, %q, %v, want %v, %q", test.patch, values, deleted, err, test.values, test.deleted)
+		}
+	}
+
+	for _, patch := range []string{`{"a.b":1}`, `{"a":{"":null}}`, `{"$types":null}`} {
+		if values, deleted, err := CompileMergePatch(decodeTestDocument(t, patch)); err == nil {
+			t.Errorf("CompileMergePatch(%v) = %v, %q, want an error", patch, values, deleted)
+		}
+	}
+}
+
+// TestDocPatch applies merge patches with docPatchScript and checks the
+// documents read back against RFC 7396.
+func TestDocPatch(t *testing.T) {
+	viper.Set("doc-types-field", "$types")
+	defer viper.Set("doc-types-field", nil)
+	backend, err := ResolveBackend("", "doc:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		document string
+		patch    string
+		want     string
+	}{
+		// Examples of RFC 7396, appendix A.
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		// Objects replacing scalars and scalars replacing objects.
+		{`{"a":"c"}`, `{"a":{"b":"c"}}`, `{"a":{"b":"c"}}`},
+		{`{"a":1}`, `{"a":{}}`, `{"a":{}}`},
+		{`{"a":{"b":"c","d":{"e":1}}}`, `{"a":"x"}`, `{"a":"x"}`},
+		{`{"a":{"b":"c","d":{"e":1}}}`, `{"a":{"d":7}}`, `{"a":{"b":"c","d":7}}`},
+		{`{"a":{"b":1}}`, `{"a":{}}`, `{"a":{"b":1}}`},
+		{`{"a":{"b":1}}`, `{"a":{"b":null}}`, `{"a":{}}`},
+		{`{"a":{"b":1},"c":2}`, `{"a":null}`, `{"c":2}`},
+		// Types of the fields kept and set.
+		{`{"n":1,"s":"1"}`, `{"b":true,"z":null,"f":2.50}`, `{"b":true,"f":2.50,"n":1,"s":"1"}`},
+		{`{"n":1}`, `{"n":"1"}`, `{"n":"1"}`},
+		{`{"s":"1"}`, `{"s":1}`, `{"s":1}`},
+	}
+	for _, test := range tests {
+		values, err := FlattenDocument(decodeTestDocument(t, test.document))
+		if err != nil {
+			t.Fatal(err)
+		}
+		commandResponse := RunRedisCommand(backend, "docput", JsonPayload{Key: "doc:1", Values: values}, CommandOptions{})
+		if !commandResponse.Success {
+			t.Fatalf("docput of %v: %v", test.document, commandResponse.ErrorMessage)
+		}
+		values, deleted, err := CompileMergePatch(decodeTestDocument(t, test.patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		commandResponse = RunRedisCommand(backend, "docpatch", JsonPayload{Key: "doc:1", Values: values, Fields: deleted}, CommandOptions{})
+		if !commandResponse.Success {
+			t.Errorf("docpatch of %v with %v: %v", test.document, test.patch, commandResponse.ErrorMessage)
+			continue
+		}
+		commandResponse = RunRedisCommand(backend, "hgetall", JsonPayload{Key: "doc:1"}, CommandOptions{})
+		document, err := AssembleDocument(commandResponse.MapVal)
+		if err != nil {
+			t.Errorf("%v patched with %v: %v", test.document, test.patch, err)
+			continue
+		}
+		if got, want := encodeTestDocument(document), encodeTestDocument(decodeTestDocument(t, test.want)); got != want {
+			t.Errorf("%v patched with %v = %v, want %v", test.document, test.patch, got, want)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package gowebdis
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// encryptedPrefix starts every encrypted value, followed by the ID of the
+// key and the base64 of the nonce and sealed value.
+const encryptedPrefix = "enc:v1:"
+
+// encryptionHookOrder runs field encryption after every other pre-execute
+// hook and before every other post-execute hook, so that these only see
+// plaintext.
+const encryptionHookOrder = 1 << 30
+
+var fieldEncryptionTotal = newCounter("gowebdis_field_encryption_total", "Number of hash field values encrypted, decrypted or masked.", "operation", "result")
+
+// keyring holds the AES keys of field encryption by ID. New values are
+// encrypted with the primary key, older keys only decrypt.
+type keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// loadKeyring reads a keyring file, in any format viper reads:
+//
+//	primary: "2024-06"
+//	keys:
+//	  "2024-01": <base64 of a 16, 24 or 32 byte key>
+//	  "2024-06": <base64 of a 16, 24 or 32 byte key>
+//
+// Key IDs are case-insensitive.
+func loadKeyring(path string) (*keyring, error) {
+	config := viper.New()
+	config.SetConfigFile(path)
+	err := config.ReadInConfig()
+	if err != nil {
+		return nil, err
+	}
+	k := &keyring{
+		primary: strings.ToLower(config.GetString("primary")),
+		keys:    map[string]cipher.AEAD{},
+	}
+	for id, encoded := range config.GetStringMapString("keys") {
+		if len(id) == 0 || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid key ID %q in keyring", id)
+		}
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %v: %v", id, err)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, fmt.Errorf("key %v: %v", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %v: %v", id, err)
+		}
+		k.keys[id] = aead
+	}
+	if _, ok := k.keys[k.primary]; !ok {
+		return nil, fmt.Errorf("primary key %q is not in the keyring", k.primary)
+	}
+	return k, nil
+}
+
+// additionalData binds a ciphertext to its hash and field, so that it
+// cannot be copied to another field and decrypted there.
+func additionalData(key string, field string) []byte {
+	return []byte(key + "\x00" + field)
+}
+
+func (k *keyring) encrypt(key string, field string, value string) (string, error) {
+	aead := k.keys[k.primary]
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), additionalData(key, field))
+	return encryptedPrefix + k.primary + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (k *keyring) decrypt(key string, field string, value string) (string, error) {
+	id := encryptedKeyID(value)
+	aead, ok := k.keys[id]
+	if !ok {
+		return "", fmt.Errorf("key %q is not in the keyring", id)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix+id+":"))
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted value is too short")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], additionalData(key, field))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func isEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// encryptedKeyID returns the ID of the key an encrypted value was
+// encrypted with.
+func encryptedKeyID(value string) string {
+	rest := strings.TrimPrefix(value, encryptedPrefix)
+	if idx := strings.Index(rest, ":"); idx > -1 {
+		return rest[:idx]
+	}
+	return ""
+}
+
+type encryptionRule struct {
+	keyPattern   string
+	fieldPattern string
+}
+
+// fieldEncryption encrypts the hash fields matching its rules on hset and
+// document writes and decrypts them on hgetall for identities with one of
+// the decrypt roles, masking them for the others. It runs as a hook, so the
+// cache, the audit log and stored idempotent results only ever hold
+// ciphertext.
+type fieldEncryption struct {
+	keyring      *keyring
+	rules        []encryptionRule
+	decryptRoles []string
+	mask         string
+}
+
+var encryption *fieldEncryption
+
+// initFieldEncryption enables field encryption when --encryption-keyring
+// is set.
+func initFieldEncryption() error {
+	path := viper.GetString("encryption-keyring")
+	if len(path) == 0 {
+		return nil
+	}
+	k, err := loadKeyring(path)
+	if err != nil {
+		return fmt.Errorf("encryption keyring: %v", err)
+	}
+	rules, err := loadEncryptionRules(viper.GetString("encrypted-fields"))
+	if err != nil {
+		return err
+	}
+	encryption = &fieldEncryption{
+		keyring:      k,
+		rules:        rules,
+		decryptRoles: splitList(viper.GetString("encryption-decrypt-roles")),
+		mask:         viper.GetString("encryption-mask"),
+	}
+	return AddHook(Hook{
+		Order:    encryptionHookOrder,
+		Commands: []string{"hset", "hgetall", "docput", "docpatch"},
+		Before:   encryption,
+		After:    encryption,
+	})
+}
+
+// loadEncryptionRules reads "key-pattern=field-pattern" pairs separated by
+// comma.
+func loadEncryptionRules(value string) ([]encryptionRule, error) {
+	var rules []encryptionRule
+	for _, pair := range splitList(value) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("invalid encrypted-fields entry %v, expected key-pattern=field", pair)
+		}
+		rules = append(rules, encryptionRule{keyPattern: parts[0], fieldPattern: parts[1]})
+	}
+	return rules, nil
+}
+
+// encrypts reports whether the field of the hash is stored encrypted. The
+// version and document types fields never are.
+func (e *fieldEncryption) encrypts(key string, field string) bool {
+	if field == versionField() || field == docTypesField() {
+		return false
+	}
+	for _, rule := range e.rules {
+		if matchesPattern([]string{rule.keyPattern}, key) && matchesPattern([]string{rule.fieldPattern}, field) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *fieldEncryption) BeforeExecute(call *Call) *CommandResponse {
+	payload := &call.JsonPayload
+	var err error
+	if call.Command == "hset" && e.encrypts(payload.Key, payload.Field) {
+		payload.Value, err = e.encrypt(payload.Key, payload.Field, payload.Value)
+	} else if len(payload.Values) > 0 {
+		// Documents, whose values may be shared with the caller.
+		values := make(map[string]string, len(payload.Values))
+		for field, value := range payload.Values {
+			if err == nil && e.encrypts(payload.Key, field) {
+				value, err = e.encrypt(payload.Key, field, value)
+			}
+			values[field] = value
+		}
+		payload.Values = values
+	}
+	if err != nil {
+		commandResponse := failedResponse(call.Command, err)
+		return &commandResponse
+	}
+	return nil
+}
+
+func (e *fieldEncryption) encrypt(key string, field string, value string) (string, error) {
+	encrypted, err := e.keyring.encrypt(key, field, value)
+	if err != nil {
+		fieldEncryptionTotal.inc("encrypt", "error")
+		return "", err
+	}
+	fieldEncryptionTotal.inc("encrypt", "success")
+	return encrypted, nil
+}
+
+// AfterExecute decrypts or masks the encrypted fields of hgetall replies.
+// Only the fields matching the rules are, other values are returned as
+// stored even when they look encrypted. Values stored before their field
+// was encrypted are masked for the identities without a decrypt role.
+func (e *fieldEncryption) AfterExecute(call *Call, commandResponse *CommandResponse) {
+	if call.Command != "hgetall" || !commandResponse.Success {
+		return
+	}
+	authorized := call.Options.Identity.HasRole(e.decryptRoles...)
+	// The map may be shared with the cache and concurrent requests.
+	values := make(map[string]string, len(commandResponse.MapVal))
+	for field, value := range commandResponse.MapVal {
+		if !e.encrypts(call.JsonPayload.Key, field) {
+			values[field] = value
+			continue
+		}
+		switch {
+		case !authorized:
+			fieldEncryptionTotal.inc("mask", "success")
+			value = e.mask
+		case isEncrypted(value):
+			plaintext, err := e.keyring.decrypt(call.JsonPayload.Key, field, value)
+			if err != nil {
+				fieldEncryptionTotal.inc("decrypt", "error")
+				log.Error("[ERROR] Cannot decrypt field " + field + " of " + call.JsonPayload.Key + ": " + err.Error())
+				value = e.mask
+			} else {
+				fieldEncryptionTotal.inc("decrypt", "success")
+				value = plaintext
+			}
+		}
+		values[field] = value
+	}
+	commandResponse.MapVal = values
+}
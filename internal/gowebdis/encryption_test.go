@@ -0,0 +1,54 @@
+package gowebdis
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+)
+
+func testEncryption(t *testing.T) *fieldEncryption {
+	block, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fieldEncryption{
+		keyring:      &keyring{primary: "k1", keys: map[string]cipher.AEAD{"k1": aead}},
+		rules:        []encryptionRule{{keyPattern: "user:*", fieldPattern: "ssn"}},
+		decryptRoles: []string{"pii"},
+		mask:         "***",
+	}
+}
+
+func TestEncryptionOnlyDecodesConfiguredFields(t *testing.T) {
+	e := testEncryption(t)
+	ssn, err := e.encrypt("user:1", "ssn", "123-45-6789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookalike := encryptedPrefix + "k1:bm90IGEgY2lwaGVydGV4dA=="
+	stored := map[string]string{"ssn": ssn, "note": lookalike, "name": "ada"}
+
+	for _, test := range []struct {
+		roles []string
+		want  map[string]string
+	}{
+		{[]string{"pii"}, map[string]string{"ssn": "123-45-6789", "note": lookalike, "name": "ada"}},
+		{nil, map[string]string{"ssn": "***", "note": lookalike, "name": "ada"}},
+	} {
+		call := &Call{Command: "hgetall", JsonPayload: JsonPayload{Key: "user:1"}, Options: CommandOptions{Identity: Identity{Roles: test.roles}}}
+		commandResponse := &CommandResponse{Name: "hgetall", Success: true, MapVal: stored}
+		e.AfterExecute(call, commandResponse)
+		for field, want := range test.want {
+			if got := commandResponse.MapVal[field]; got != want {
+				t.Errorf("roles %v: field %v is %q, want %q", test.roles, field, got, want)
+			}
+		}
+	}
+	if stored["ssn"] != ssn {
+		t.Error("AfterExecute changed the stored reply")
+	}
+}
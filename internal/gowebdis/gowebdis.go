@@ -1,328 +1,265 @@
 package gowebdis
 
 import (
-	"errors"
 	"fmt"
-	"strings"
+	"strconv"
 	"time"
 
-	"github.com/go-redis/redis"
+	"github.com/go-redis/redis/v7"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
-var connType string
-
-var connFailoverOptions redis.FailoverOptions
-var connClusterOptions redis.ClusterOptions
-var connHostOptions redis.Options
-
-var client interface{}
+var commandsTotal = newCounter("gowebdis_commands_total", "Number of redis commands executed.", "backend", "command", "result")
+var commandDurationSeconds = newCounter("gowebdis_command_duration_seconds_total", "Total time spent executing redis commands.", "backend", "command")
 
 type JsonPayload struct {
 	Key    string   `json:"key" binding:"required"`
 	Field  string   `json:"field"`
 	Fields []string `json:"fields"`
 	Value  string   `json:"value"`
+	// Values holds the fields and values written by the document
+	// commands, see FlattenDocument.
+	Values map[string]string `json:"values,omitempty"`
+	// Path is the JSONPath of the json commands, the root by default.
+	Path string `json:"path,omitempty"`
+}
+
+// CommandOptions carries request metadata that changes how a command is
+// executed.
+type CommandOptions struct {
+	ReadFromMaster bool
+	// IfMatch is the version a write expects the key to be at, "*" when
+	// the key only has to exist and empty when the write is unconditional.
+	IfMatch string
+	// IdempotencyKey makes a write execute at most once, duplicates get
+	// the stored result of the first execution.
+	IdempotencyKey string
+	Identity       Identity
+	SourceIP       string
+	// Route is the route of the API serving the command, see RouteCommand.
+	Route string
+	// fingerprint identifies the request as received, before hooks
+	// changed it, see requestFingerprint.
+	fingerprint string
+	// backend is the backend serving the command, set by executeCommand.
+	backend *Backend
 }
 
+// Error codes classify failed commands for the caller, an empty code is a
+// plain command error.
+const (
+	ErrorCodePreconditionFailed = "precondition_failed"
+	ErrorCodeUnavailable        = "unavailable"
+	ErrorCodeConflict           = "conflict"
+	ErrorCodeUnprocessable      = "unprocessable"
+	ErrorCodeTooLarge           = "too_large"
+	ErrorCodeForbidden          = "forbidden"
+	ErrorCodeInternal           = "internal"
+)
+
 type CommandResponse struct {
 	Name         string            `json:"name"`
 	Success      bool              `json:"success"`
 	ErrorMessage string            `json:"errorMessage"`
+	ErrorCode    string            `json:"errorCode,omitempty"`
 	BoolVal      bool              `json:"boolValue"`
 	MapVal       map[string]string `json:"mapValue"`
 	IntVal       int64             `json:"intVal"`
 	StringVal    string            `json:"stringVal"`
+	// Version is the version of the key after a versioned write, or as
+	// read by hgetall.
+	Version string `json:"version,omitempty"`
+	// Replayed is set when the response is the stored result of an
+	// earlier request with the same Idempotency-Key.
+	Replayed bool `json:"-"`
 }
 
-func InitConnectionSetting(cmd *cobra.Command) error {
-
-	sentinelAddressString := viper.GetString("sentinel-address")
-	if len(sentinelAddressString) > 0 {
-		connFailoverOptions = initFailoverConnectionSetting(sentinelAddressString, cmd)
-	} else {
-		hostString := viper.GetString("host")
-		if len(hostString) > 0 {
-			hostArray := strings.Split(hostString, ",")
-			if len(hostArray) > 1 {
-				connClusterOptions = initClusterConnectionSetting(hostArray, cmd)
-			} else {
-				connHostOptions = initHostConnectionSetting(hostArray[0], cmd)
-			}
-		}
-	}
-	if connType == "cluster" {
-
-	} else {
-		var commandResponse = ping()
-		if !commandResponse.Success {
-			return errors.New(commandResponse.ErrorMessage)
-		}
-	}
-	return nil
+// RunRedisCommand runs a command on the backend on behalf of the identity
+// of the options through the hooks, recording writes in the audit log.
+func RunRedisCommand(backend *Backend, redisCommand string, jsonPayload JsonPayload, options CommandOptions) CommandResponse {
+	if len(options.IdempotencyKey) > 0 {
+		options.fingerprint = requestFingerprint(redisCommand, jsonPayload, options)
+	}
+	call := &Call{Backend: backend.Name, Command: redisCommand, JsonPayload: jsonPayload, Options: options}
+	var chain hookChain
+	commandResponse := chain.before(call)
+	if commandResponse == nil {
+		auditedResponse := runAuditedCommand(backend, call.Command, call.JsonPayload, call.Options)
+		commandResponse = &auditedResponse
+	}
+	chain.after(call, commandResponse)
+	return checkReplyLimits(backend, *commandResponse)
 }
 
-func initFailoverConnectionSetting(sentinelAddressString string, cmd *cobra.Command) redis.FailoverOptions {
-
-	connType = "sentinel"
-	var options redis.FailoverOptions
-
-	sentinelAddress := strings.Split(sentinelAddressString, ",")
-	masterName := viper.GetString("master-name")
-
-	password := viper.GetString("password")
-	db := viper.GetInt("db")
-
-	maxRetries := viper.GetInt("max-retries")
-	minRetryBackoff := viper.GetInt("min-retry-backoff")
-	maxRetryBackoff := viper.GetInt("max-retry-backoff")
-	dialTimeout := viper.GetInt("dial-timeout")
-	readTimeout := viper.GetInt("read-timeout")
-	writeTimeout := viper.GetInt("write-timeout")
-
-	poolSize := viper.GetInt("pool-size")
-	minIdleConns := viper.GetInt("min-idle-conns")
-	maxConnAge := viper.GetInt("min-conn-age")
-	poolTimeout := viper.GetInt("pool-timeout")
-	idleTimeout := viper.GetInt("idle-timeout")
-	idleCheckFrequencey := viper.GetInt("idle-check-frequency")
-
-	options.MasterName = masterName
-	options.SentinelAddrs = sentinelAddress
-	if len(password) > 0 {
-		options.Password = password
-	}
-	options.DB = db
-	if maxRetries > -1 {
-		options.MaxRetries = maxRetries
-	}
-	if minRetryBackoff > -1 {
-		options.MinRetryBackoff = time.Duration(minRetryBackoff) * time.Second
-	}
-	if maxRetryBackoff > -1 {
-		options.MaxRetryBackoff = time.Duration(maxRetryBackoff) * time.Second
+func runAuditedCommand(backend *Backend, redisCommand string, jsonPayload JsonPayload, options CommandOptions) CommandResponse {
+	if !audit.audits(redisCommand, jsonPayload.Key) {
+		return runRedisCommand(backend, redisCommand, jsonPayload, options)
 	}
-	if dialTimeout > -1 {
-		options.DialTimeout = time.Duration(dialTimeout) * time.Second
+	var changes []FieldChange
+	if backend.policy.check(redisCommand, "", options.Identity) == nil {
+		changes = audit.before(backend, redisCommand, jsonPayload)
 	}
-	if readTimeout > -1 {
-		options.ReadTimeout = time.Duration(readTimeout) * time.Second
+	commandResponse := runRedisCommand(backend, redisCommand, jsonPayload, options)
+	// Replays wrote nothing, the first request was recorded.
+	if !commandResponse.Replayed {
+		audit.record(backend, redisCommand, jsonPayload, options, changes, commandResponse)
 	}
-	if writeTimeout > -1 {
-		options.WriteTimeout = time.Duration(writeTimeout) * time.Second
-	}
-	options.PoolSize = poolSize
-	options.MinIdleConns = minIdleConns
-	if maxConnAge > -1 {
-		options.MaxConnAge = time.Duration(maxConnAge) * time.Second
-	}
-	if poolTimeout > -1 {
-		options.PoolTimeout = time.Duration(poolTimeout) * time.Second
-	}
-	if idleTimeout > -1 {
-		options.IdleTimeout = time.Duration(idleTimeout) * time.Second
-	}
-	if idleCheckFrequencey > -1 {
-		options.IdleCheckFrequency = time.Duration(idleCheckFrequencey) * time.Second
-	}
-
-	// Dialer    func(ctx context.Context, network, addr string) (net.Conn, error)
-	// OnConnect func(*Conn) error
-	// TLSConfig *tls.Config
-
-	return options
-
+	return commandResponse
 }
 
-func initClusterConnectionSetting(hostAddresses []string, cmd *cobra.Command) redis.ClusterOptions {
-
-	connType = "cluster"
-	var options redis.ClusterOptions
-
-	password := viper.GetString("password")
-
-	maxRetries := viper.GetInt("max-retries")
-	minRetryBackoff := viper.GetInt("min-retry-backoff")
-	maxRetryBackoff := viper.GetInt("max-retry-backoff")
-	dialTimeout := viper.GetInt("dial-timeout")
-	readTimeout := viper.GetInt("read-timeout")
-	writeTimeout := viper.GetInt("write-timeout")
-
-	poolSize := viper.GetInt("pool-size")
-	minIdleConns := viper.GetInt("min-idle-conns")
-	maxConnAge := viper.GetInt("min-conn-age")
-	poolTimeout := viper.GetInt("pool-timeout")
-	idleTimeout := viper.GetInt("idle-timeout")
-	idleCheckFrequencey := viper.GetInt("idle-check-frequency")
-
-	options.Addrs = hostAddresses
-	if len(password) > 0 {
-		options.Password = password
-	}
-	if maxRetries > -1 {
-		options.MaxRetries = maxRetries
-	}
-	if minRetryBackoff > -1 {
-		options.MinRetryBackoff = time.Duration(minRetryBackoff) * time.Second
-	}
-	if maxRetryBackoff > -1 {
-		options.MaxRetryBackoff = time.Duration(maxRetryBackoff) * time.Second
-	}
-	if dialTimeout > -1 {
-		options.DialTimeout = time.Duration(dialTimeout) * time.Second
-	}
-	if readTimeout > -1 {
-		options.ReadTimeout = time.Duration(readTimeout) * time.Second
-	}
-	if writeTimeout > -1 {
-		options.WriteTimeout = time.Duration(writeTimeout) * time.Second
-	}
-	options.PoolSize = poolSize
-	options.MinIdleConns = minIdleConns
-	if maxConnAge > -1 {
-		options.MaxConnAge = time.Duration(maxConnAge) * time.Second
-	}
-	if poolTimeout > -1 {
-		options.PoolTimeout = time.Duration(poolTimeout) * time.Second
+func runRedisCommand(backend *Backend, redisCommand string, jsonPayload JsonPayload, options CommandOptions) CommandResponse {
+	var commandResponse = CommandResponse{}
+	start := time.Now()
+	err := backend.CheckCommand(redisCommand, "", options.Identity)
+	if err != nil {
+		commandResponse.Success = false
+		commandResponse.ErrorCode = ErrorCodeForbidden
+		commandResponse.ErrorMessage = err.Error()
+		log.Error("[ERROR] " + commandResponse.ErrorMessage)
+		return commandResponse
 	}
-	if idleTimeout > -1 {
-		options.IdleTimeout = time.Duration(idleTimeout) * time.Second
+	if _, ok := LookupCommand(redisCommand); !ok {
+		commandResponse.Success = false
+		commandResponse.ErrorMessage = fmt.Sprintf(`Does not support %v command`, redisCommand)
+		log.Error("[ERROR] " + commandResponse.ErrorMessage)
+		return commandResponse
 	}
-	if idleCheckFrequencey > -1 {
-		options.IdleCheckFrequency = time.Duration(idleCheckFrequencey) * time.Second
+	if len(options.IfMatch) > 0 && len(versionField()) == 0 {
+		commandResponse.Success = false
+		commandResponse.ErrorMessage = "If-Match requires --version-field to be set"
+		log.Error("[ERROR] " + commandResponse.ErrorMessage)
+		return commandResponse
+	}
+
+	cache := backend.cache
+	redisKeys := readKeys(redisCommand, jsonPayload)
+	if cache != nil && !options.ReadFromMaster && cache.cacheable(redisKeys) {
+		key := cacheKey(redisCommand, jsonPayload)
+		var ok bool
+		commandResponse, ok = cache.get(key)
+		if !ok {
+			tokens := cache.begin(redisKeys)
+			var shared bool
+			commandResponse, shared = runReadCommand(backend, redisCommand, jsonPayload, options)
+			// A shared reply may have been read before the token was
+			// taken, and thus before an invalidation it missed. The
+			// caller that read it caches it.
+			if commandResponse.Success && !shared {
+				cache.put(key, redisKeys, tokens, commandResponse)
+			}
+		}
+	} else if IsReadCommand(redisCommand) {
+		commandResponse, _ = runReadCommand(backend, redisCommand, jsonPayload, options)
+	} else {
+		if len(options.IdempotencyKey) > 0 {
+			commandResponse = runIdempotentCommand(backend, redisCommand, jsonPayload, options)
+		} else {
+			commandResponse = runCommand(backend, redisCommand, jsonPayload, options)
+		}
+		if cache != nil && !IsReadCommand(redisCommand) && len(jsonPayload.Key) > 0 {
+			// Do not wait for the invalidation message to read our own
+			// writes.
+			cache.invalidate(jsonPayload.Key)
+		}
 	}
-	return options
+	recordCommand(backend, redisCommand, commandResponse, time.Since(start))
+	return commandResponse
 }
 
-func initHostConnectionSetting(hostAddress string, cmd *cobra.Command) redis.Options {
-
-	connType = "host"
-	var options redis.Options
-
-	password := viper.GetString("password")
-	db := viper.GetInt("db")
-
-	maxRetries := viper.GetInt("max-retries")
-	minRetryBackoff := viper.GetInt("min-retry-backoff")
-	maxRetryBackoff := viper.GetInt("max-retry-backoff")
-	dialTimeout := viper.GetInt("dial-timeout")
-	readTimeout := viper.GetInt("read-timeout")
-	writeTimeout := viper.GetInt("write-timeout")
-
-	poolSize := viper.GetInt("pool-size")
-	minIdleConns := viper.GetInt("min-idle-conns")
-	maxConnAge := viper.GetInt("min-conn-age")
-	poolTimeout := viper.GetInt("pool-timeout")
-	idleTimeout := viper.GetInt("idle-timeout")
-	idleCheckFrequencey := viper.GetInt("idle-check-frequency")
+// runReadCommand merges identical concurrent reads unless the command opted
+// out of coalescing, and reports whether the reply was read by another
+// caller.
+func runReadCommand(backend *Backend, redisCommand string, jsonPayload JsonPayload, options CommandOptions) (CommandResponse, bool) {
+	if !backend.coalesces(redisCommand) {
+		return runCommand(backend, redisCommand, jsonPayload, options), false
+	}
+	key := backend.Name + "\x00" + strconv.FormatBool(options.ReadFromMaster) + "\x00" + cacheKey(redisCommand, jsonPayload)
+	commandResponse, shared := readFlights.do(key, func() CommandResponse {
+		return runCommand(backend, redisCommand, jsonPayload, options)
+	})
+	if shared {
+		coalescedTotal.inc(backend.Name, redisCommand)
+	}
+	return commandResponse, shared
+}
 
-	options.Addr = hostAddress
-	if len(password) > 0 {
-		options.Password = password
-	}
-	options.DB = db
-	if maxRetries > -1 {
-		options.MaxRetries = maxRetries
-	}
-	if minRetryBackoff > -1 {
-		options.MinRetryBackoff = time.Duration(minRetryBackoff) * time.Second
-	}
-	if maxRetryBackoff > -1 {
-		options.MaxRetryBackoff = time.Duration(maxRetryBackoff) * time.Second
-	}
-	if dialTimeout > -1 {
-		options.DialTimeout = time.Duration(dialTimeout) * time.Second
-	}
-	if readTimeout > -1 {
-		options.ReadTimeout = time.Duration(readTimeout) * time.Second
-	}
-	if writeTimeout > -1 {
-		options.WriteTimeout = time.Duration(writeTimeout) * time.Second
-	}
-	options.PoolSize = poolSize
-	options.MinIdleConns = minIdleConns
-	if maxConnAge > -1 {
-		options.MaxConnAge = time.Duration(maxConnAge) * time.Second
-	}
-	if poolTimeout > -1 {
-		options.PoolTimeout = time.Duration(poolTimeout) * time.Second
+// executeCommand runs the registered command against the master or, for
+// read-only commands, the client chosen by the read policy.
+func executeCommand(backend *Backend, redisCommand string, jsonPayload JsonPayload, options CommandOptions) CommandResponse {
+	var commandResponse = CommandResponse{Name: redisCommand}
+	command, ok := LookupCommand(redisCommand)
+	if !ok {
+		commandResponse.Success = false
+		commandResponse.ErrorMessage = fmt.Sprintf(`Does not support %v command`, redisCommand)
+		log.Error("[ERROR] " + commandResponse.ErrorMessage)
+		return commandResponse
 	}
-	if idleTimeout > -1 {
-		options.IdleTimeout = time.Duration(idleTimeout) * time.Second
+	client := backend.client
+	if command.Spec().ReadOnly {
+		client = backend.readClient(options)
 	}
-	if idleCheckFrequencey > -1 {
-		options.IdleCheckFrequency = time.Duration(idleCheckFrequencey) * time.Second
+	if client == nil {
+		commandResponse.Success = false
+		commandResponse.ErrorMessage = "Cannot make redis connection"
+		log.Error("[ERROR] " + commandResponse.ErrorMessage)
+		return commandResponse
+	}
+	options.backend = backend
+	commandResponse = command.Execute(client, jsonPayload, options)
+	commandResponse.Name = redisCommand
+	if redisCommand == "ping" {
+		// Pings double as health checks of the backend.
+		if commandResponse.Success {
+			backendUp.set(1, backend.Name)
+		} else {
+			backendUp.set(0, backend.Name)
+		}
 	}
-	return options
+	return commandResponse
 }
 
-func startConnection() *redis.Client {
-	var conn *redis.Client
-	if connType == "sentinel" {
-		conn = redis.NewFailoverClient(&connFailoverOptions)
-	} else if connType == "host" {
-		conn = redis.NewClient(&connHostOptions)
-	}
-	return conn
+func unavailableResponse(backend *Backend, redisCommand string) CommandResponse {
+	var commandResponse = CommandResponse{Name: redisCommand}
+	commandResponse.Success = false
+	commandResponse.ErrorCode = ErrorCodeUnavailable
+	commandResponse.ErrorMessage = "Circuit breaker of backend " + backend.Name + " is open"
+	log.Error("[ERROR] " + commandResponse.ErrorMessage)
+	return commandResponse
 }
 
-func startClusterConnection() *redis.ClusterClient {
-	return redis.NewClusterClient(&connClusterOptions)
+func failedResponse(redisCommand string, err error) CommandResponse {
+	var commandResponse = CommandResponse{Name: redisCommand}
+	commandResponse.Success = false
+	commandResponse.ErrorMessage = err.Error()
+	commandResponse.ErrorCode = failureCode(err)
+	log.Error("[ERROR] " + commandResponse.ErrorMessage)
+	return commandResponse
 }
 
-func RunRedisCommand(redisCommand string, jsonPayload JsonPayload) CommandResponse {
-	var commandResponse = CommandResponse{}
-	switch redisCommand {
-	case "ping":
-		commandResponse = ping()
-	case "hset":
-		commandResponse = hSet(jsonPayload.Key, jsonPayload.Field, jsonPayload.Value)
-	case "hgetall":
-		commandResponse = hGetAll(jsonPayload.Key)
-	case "hdel":
-		commandResponse = hDel(jsonPayload.Key, jsonPayload.Fields)
-	default:
-		commandResponse.Success = false
-		commandResponse.ErrorMessage = fmt.Sprintf(`Does not support %v command`, redisCommand)
-		log.Error("[ERROR] " + commandResponse.ErrorMessage)
+func recordCommand(backend *Backend, redisCommand string, commandResponse CommandResponse, elapsed time.Duration) {
+	result := "success"
+	if !commandResponse.Success {
+		result = "error"
 	}
-	return commandResponse
+	commandsTotal.inc(backend.Name, redisCommand, result)
+	commandDurationSeconds.add(elapsed.Seconds(), backend.Name, redisCommand)
+}
+
+func ping(backend *Backend) CommandResponse {
+	return executeCommand(backend, "ping", JsonPayload{}, CommandOptions{})
 }
 
-func ping() CommandResponse {
+func pingClient(client redis.UniversalClient) CommandResponse {
 	var statusCmd *redis.StatusCmd
 	var commandResponse = CommandResponse{Name: "ping"}
 
-	if connType == "cluster" {
-		var conn = startConnection()
-		if conn != nil {
-			statusCmd = conn.Ping()
-			defer conn.Close()
-		} else {
-			commandResponse.Success = false
-			commandResponse.ErrorMessage = "Cannot make redis connection"
-			log.Error("[ERROR] " + commandResponse.ErrorMessage)
-			return commandResponse
-		}
-	} else {
-		var conn = startConnection()
-		if conn != nil {
-			statusCmd = conn.Ping()
-			defer conn.Close()
-		} else {
-			commandResponse.Success = false
-			commandResponse.ErrorMessage = "Cannot make redis connection"
-			log.Error("[ERROR] " + commandResponse.ErrorMessage)
-			return commandResponse
-		}
-	}
+	statusCmd = client.Ping()
 
 	var err = statusCmd.Err()
 	if err != nil {
 		commandResponse.Success = false
 		commandResponse.ErrorMessage = err.Error()
+		commandResponse.ErrorCode = failureCode(err)
 		log.Error("[ERROR] " + commandResponse.ErrorMessage)
 	} else {
 		commandResponse.Success = true
@@ -333,125 +270,81 @@ func ping() CommandResponse {
 
 }
 
-func hSet(key string, field string, value string) CommandResponse {
-	var boolCmd *redis.BoolCmd
+func hSet(client redis.UniversalClient, key string, field string, value string) CommandResponse {
+	var intCmd *redis.IntCmd
 	var commandResponse = CommandResponse{Name: "hset"}
 
-	if connType == "cluster" {
-		var conn = startConnection()
-		if conn != nil {
-			boolCmd = conn.HSet(key, field, value)
-			defer conn.Close()
-		} else {
-			commandResponse.Success = false
-			commandResponse.ErrorMessage = "Cannot make redis connection"
-			log.Error("[ERROR] " + commandResponse.ErrorMessage)
-			return commandResponse
-		}
-	} else {
-		var conn = startConnection()
-		if conn != nil {
-			boolCmd = conn.HSet(key, field, value)
-			defer conn.Close()
-		} else {
-			commandResponse.Success = false
-			commandResponse.ErrorMessage = "Cannot make redis connection"
-			log.Error("[ERROR] " + commandResponse.ErrorMessage)
-			return commandResponse
-		}
+	if client == nil {
+		commandResponse.Success = false
+		commandResponse.ErrorMessage = "Cannot make redis connection"
+		log.Error("[ERROR] " + commandResponse.ErrorMessage)
+		return commandResponse
 	}
+	intCmd = client.HSet(key, field, value)
 
-	var err = boolCmd.Err()
+	var err = intCmd.Err()
 	if err != nil {
 		commandResponse.Success = false
 		commandResponse.ErrorMessage = err.Error()
+		commandResponse.ErrorCode = failureCode(err)
 
 		log.Error("[ERROR] " + commandResponse.ErrorMessage)
 	} else {
 		commandResponse.Success = true
 		commandResponse.BoolVal = true
-		log.Info("[INFO] " + boolCmd.String())
+		log.Info("[INFO] " + intCmd.String())
 	}
 	return commandResponse
 
 }
 
-func hGetAll(key string) CommandResponse {
+func hGetAll(client redis.UniversalClient, key string) CommandResponse {
 	var stringStringMapCmd *redis.StringStringMapCmd
 	var commandResponse = CommandResponse{Name: "hgetall"}
 
-	if connType == "cluster" {
-		var conn = startConnection()
-		if conn != nil {
-			stringStringMapCmd = conn.HGetAll(key)
-			defer conn.Close()
-		} else {
-			commandResponse.Success = false
-			commandResponse.ErrorMessage = "Cannot make redis connection"
-			log.Error("[ERROR] " + commandResponse.ErrorMessage)
-			return commandResponse
-		}
-	} else {
-		var conn = startConnection()
-		if conn != nil {
-			stringStringMapCmd = conn.HGetAll(key)
-			defer conn.Close()
-		} else {
-			commandResponse.Success = false
-			commandResponse.ErrorMessage = "Cannot make redis connection"
-			log.Error("[ERROR] " + commandResponse.ErrorMessage)
-			return commandResponse
-		}
+	if client == nil {
+		commandResponse.Success = false
+		commandResponse.ErrorMessage = "Cannot make redis connection"
+		log.Error("[ERROR] " + commandResponse.ErrorMessage)
+		return commandResponse
 	}
+	stringStringMapCmd = client.HGetAll(key)
 
 	var err = stringStringMapCmd.Err()
 	if err != nil {
 		commandResponse.Success = false
 		commandResponse.ErrorMessage = err.Error()
+		commandResponse.ErrorCode = failureCode(err)
 		log.Error("[ERROR] " + commandResponse.ErrorMessage)
 	} else {
 		commandResponse.Success = true
 		commandResponse.MapVal = stringStringMapCmd.Val()
 		log.Info("[INFO] " + stringStringMapCmd.String())
 	}
-	return commandResponse
+	return takeVersionField(commandResponse)
 }
 
-func hDel(key string, fields []string) CommandResponse {
+func hDel(client redis.UniversalClient, key string, fields []string) CommandResponse {
 	var intCmd *redis.IntCmd
 	var commandResponse = CommandResponse{Name: "hdel"}
 
-	if connType == "cluster" {
-		var conn = startConnection()
-		if conn != nil {
-			intCmd = conn.HDel(key, fields...)
-			defer conn.Close()
-		} else {
-			commandResponse.Success = false
-			commandResponse.ErrorMessage = "Cannot make redis connection"
-			log.Error("[ERROR] " + commandResponse.ErrorMessage)
-			return commandResponse
-		}
-	} else {
-		var conn = startConnection()
-		if conn != nil {
-			intCmd = conn.HDel(key, fields...)
-			defer conn.Close()
-		} else {
-			commandResponse.Success = false
-			commandResponse.ErrorMessage = "Cannot make redis connection"
-			log.Error("[ERROR] " + commandResponse.ErrorMessage)
-			return commandResponse
-		}
+	if client == nil {
+		commandResponse.Success = false
+		commandResponse.ErrorMessage = "Cannot make redis connection"
+		log.Error("[ERROR] " + commandResponse.ErrorMessage)
+		return commandResponse
 	}
+	intCmd = client.HDel(key, fields...)
 
 	var err = intCmd.Err()
 	if err != nil {
 		commandResponse.Success = false
 		commandResponse.ErrorMessage = err.Error()
+		commandResponse.ErrorCode = failureCode(err)
 		log.Error("[ERROR] " + commandResponse.ErrorMessage)
 	} else {
 		commandResponse.Success = true
+		commandResponse.IntVal = intCmd.Val()
 		log.Info("[INFO] " + intCmd.String())
 	}
 	return commandResponse
@@ -0,0 +1,141 @@
+package gowebdis
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Routes of the API passed to hooks in CommandOptions.Route.
+const (
+	RouteCommand     = "/{command}"
+	RouteRead        = "/read/{command}/{key}"
+	RouteBatch       = "/batch"
+	RouteTransaction = "/transaction"
+	RouteHealth      = "/healthz"
+	RouteSubscribe   = "/subscribe/{channel}"
+	RouteDocument    = "/doc/{key}"
+)
+
+// Call is a command on its way through the hooks. Hooks run after the
+// backend was selected for the key of the request and before the command
+// policy, so changed commands are checked like requested ones.
+type Call struct {
+	Backend     string
+	Command     string
+	JsonPayload JsonPayload
+	Options     CommandOptions
+}
+
+// PreExecuteHook runs before a command. It may change the command, its
+// payload and its options, or answer the command itself by returning a
+// response, in which case the command and the following hooks do not run.
+type PreExecuteHook interface {
+	BeforeExecute(call *Call) *CommandResponse
+}
+
+// PostExecuteHook runs after a command and may change its response, e.g.
+// to decode values or add computed ones. Responses may be shared with the
+// cache and concurrent requests: replace maps and slices rather than
+// changing them.
+type PostExecuteHook interface {
+	AfterExecute(call *Call, commandResponse *CommandResponse)
+}
+
+// Hook registers pre- and post-execute hooks. Pre-execute hooks run by
+// ascending Order, hooks of equal order in registration order, and
+// post-execute hooks in the reverse order, so the first hook to see a
+// request is the last to see its response. Post-execute hooks also see
+// responses short-circuited by a later pre-execute hook.
+type Hook struct {
+	Order int
+	// Routes limits the hook to routes of the API, see RouteCommand, and
+	// Commands to commands; empty lists match everything.
+	Routes   []string
+	Commands []string
+	Before   PreExecuteHook
+	After    PostExecuteHook
+}
+
+var hooksMutex sync.RWMutex
+var hooks []Hook
+
+// AddHook adds a hook to every following command.
+func AddHook(hook Hook) error {
+	err := ValidateHook(hook)
+	if err != nil {
+		return err
+	}
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+	hooks = append(hooks, hook)
+	sort.SliceStable(hooks, func(i, j int) bool {
+		return hooks[i].Order < hooks[j].Order
+	})
+	return nil
+}
+
+// ValidateHook checks that AddHook accepts the hook, without adding it.
+func ValidateHook(hook Hook) error {
+	if hook.Before == nil && hook.After == nil {
+		return errors.New("hook has neither a pre- nor a post-execute hook")
+	}
+	return nil
+}
+
+// currentHooks returns a copy of the hooks added so far, which
+// restoreHooks brings back.
+func currentHooks() []Hook {
+	hooksMutex.RLock()
+	defer hooksMutex.RUnlock()
+	return append([]Hook(nil), hooks...)
+}
+
+func restoreHooks(saved []Hook) {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+	hooks = saved
+}
+
+func (hook Hook) matches(call *Call) bool {
+	return (len(hook.Routes) == 0 || containsString(hook.Routes, call.Options.Route)) &&
+		(len(hook.Commands) == 0 || containsString(hook.Commands, call.Command))
+}
+
+// hookChain holds the hooks that matched a call, in order.
+type hookChain []Hook
+
+// before runs the pre-execute hooks, returning the response of the hook
+// that short-circuited the call, if any. Hooks are matched against the
+// call as changed by the previous ones.
+func (chain *hookChain) before(call *Call) *CommandResponse {
+	hooksMutex.RLock()
+	registered := hooks
+	hooksMutex.RUnlock()
+	for _, hook := range registered {
+		if !hook.matches(call) {
+			continue
+		}
+		*chain = append(*chain, hook)
+		if hook.Before == nil {
+			continue
+		}
+		commandResponse := hook.Before.BeforeExecute(call)
+		if commandResponse != nil {
+			if len(commandResponse.Name) == 0 {
+				commandResponse.Name = call.Command
+			}
+			return commandResponse
+		}
+	}
+	return nil
+}
+
+// after runs the post-execute hooks of the hooks that ran before.
+func (chain hookChain) after(call *Call, commandResponse *CommandResponse) {
+	for idx := len(chain) - 1; idx >= 0; idx-- {
+		if chain[idx].After != nil {
+			chain[idx].After.AfterExecute(call, commandResponse)
+		}
+	}
+}
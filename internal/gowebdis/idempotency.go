@@ -0,0 +1,112 @@
+package gowebdis
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/go-redis/redis/v7"
+	log "github.com/sirupsen/logrus"
+)
+
+var idempotencyReplaysTotal = newCounter("gowebdis_idempotency_replays_total", "Number of writes answered with the stored result of an earlier request with the same Idempotency-Key.", "backend", "command")
+
+// idempotencyRecord is stored under the Idempotency-Key of a write for
+// --idempotency-window seconds. Response is nil while the first request
+// is still executing, for at most --idempotency-pending-ttl seconds so
+// that a request that dies before storing its result does not hold the
+// key for the whole window.
+type idempotencyRecord struct {
+	Fingerprint string           `json:"fingerprint"`
+	Response    *CommandResponse `json:"response,omitempty"`
+}
+
+// requestFingerprint identifies the request an Idempotency-Key was first
+// used with, so that reusing the key for another request is refused.
+func requestFingerprint(redisCommand string, jsonPayload JsonPayload, options CommandOptions) string {
+	payload, _ := json.Marshal(jsonPayload)
+	digest := sha1.Sum([]byte(redisCommand + "\x00" + options.IfMatch + "\x00" + string(payload)))
+	return hex.EncodeToString(digest[:])
+}
+
+// runIdempotentCommand executes a write at most once per Idempotency-Key
+// and identity: duplicates of the request within the window get the stored
+// result of the first execution instead.
+func runIdempotentCommand(backend *Backend, redisCommand string, jsonPayload JsonPayload, options CommandOptions) CommandResponse {
+	if backend.breaker.currentState() == circuitOpen {
+		return unavailableResponse(backend, redisCommand)
+	}
+	storeKey := backend.idempotencyPrefix + options.Identity.Name + ":" + options.IdempotencyKey
+	record := idempotencyRecord{Fingerprint: options.fingerprint}
+	if len(record.Fingerprint) == 0 {
+		record.Fingerprint = requestFingerprint(redisCommand, jsonPayload, options)
+	}
+	pending, _ := json.Marshal(record)
+	pendingTTL := backend.idempotencyPending
+	if pendingTTL <= 0 || pendingTTL > backend.idempotencyWindow {
+		pendingTTL = backend.idempotencyWindow
+	}
+
+	stored, err := backend.client.SetNX(storeKey, pending, pendingTTL).Result()
+	if err != nil {
+		return failedResponse(redisCommand, err)
+	}
+	if !stored {
+		return replayCommand(backend, redisCommand, storeKey, record.Fingerprint)
+	}
+
+	commandResponse := runCommand(backend, redisCommand, jsonPayload, options)
+	if commandResponse.ErrorCode == ErrorCodeUnavailable {
+		// Whether the write was applied is unknown, let the client retry
+		// rather than replaying the failure forever.
+		err = backend.client.Del(storeKey).Err()
+	} else {
+		record.Response = &commandResponse
+		result, _ := json.Marshal(record)
+		err = backend.client.Set(storeKey, result, backend.idempotencyWindow).Err()
+	}
+	if err != nil {
+		log.Error("[ERROR] Cannot store result of Idempotency-Key " + options.IdempotencyKey + ": " + err.Error())
+	}
+	return commandResponse
+}
+
+func replayCommand(backend *Backend, redisCommand string, storeKey string, fingerprint string) CommandResponse {
+	var commandResponse = CommandResponse{Name: redisCommand}
+	value, err := backend.client.Get(storeKey).Bytes()
+	if err == redis.Nil {
+		// The record expired in between, the client may simply retry.
+		commandResponse.Success = false
+		commandResponse.ErrorCode = ErrorCodeConflict
+		commandResponse.ErrorMessage = "Request with the same Idempotency-Key just expired, retry"
+		log.Error("[ERROR] " + commandResponse.ErrorMessage)
+		return commandResponse
+	}
+	if err != nil {
+		return failedResponse(redisCommand, err)
+	}
+
+	var record idempotencyRecord
+	err = json.Unmarshal(value, &record)
+	switch {
+	case err != nil:
+		commandResponse.Success = false
+		commandResponse.ErrorMessage = "Invalid result stored for Idempotency-Key: " + err.Error()
+	case record.Fingerprint != fingerprint:
+		commandResponse.Success = false
+		commandResponse.ErrorCode = ErrorCodeUnprocessable
+		commandResponse.ErrorMessage = "Idempotency-Key was already used for a different request"
+	case record.Response == nil:
+		commandResponse.Success = false
+		commandResponse.ErrorCode = ErrorCodeConflict
+		commandResponse.ErrorMessage = "Request with the same Idempotency-Key is in progress"
+	default:
+		idempotencyReplaysTotal.inc(backend.Name, redisCommand)
+		commandResponse = *record.Response
+		commandResponse.Replayed = true
+		log.Info("[INFO] Replayed " + redisCommand + " of Idempotency-Key")
+		return commandResponse
+	}
+	log.Error("[ERROR] " + commandResponse.ErrorMessage)
+	return commandResponse
+}
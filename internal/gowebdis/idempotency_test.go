@@ -0,0 +1,89 @@
+package gowebdis
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestIdempotencyPendingTTL runs testttl with an Idempotency-Key on its own
+// record, which holds the key for --idempotency-pending-ttl seconds while
+// the write runs and for the window once its result is stored.
+func TestIdempotencyPendingTTL(t *testing.T) {
+	backend, err := ResolveBackend("", "idempotency:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	window, pending := backend.idempotencyWindow, backend.idempotencyPending
+	defer func() {
+		backend.idempotencyWindow, backend.idempotencyPending = window, pending
+	}()
+	backend.idempotencyWindow = time.Hour
+	storeKey := func(idempotencyKey string) string {
+		return backend.idempotencyPrefix + ":" + idempotencyKey
+	}
+
+	tests := []struct {
+		pending    time.Duration
+		pendingTTL int64
+	}{
+		{30 * time.Second, 30},
+		{0, 3600},
+		{2 * time.Hour, 3600},
+	}
+	for idx, test := range tests {
+		backend.idempotencyPending = test.pending
+		key := storeKey(string(rune('a' + idx)))
+		options := CommandOptions{IdempotencyKey: string(rune('a' + idx))}
+		commandResponse := RunRedisCommand(backend, "testttl", JsonPayload{Key: key}, options)
+		if !commandResponse.Success || commandResponse.IntVal != test.pendingTTL {
+			t.Errorf("pending ttl %v held the key for %v seconds, want %v", test.pending, commandResponse.IntVal, test.pendingTTL)
+		}
+		if ttl := testRedis.TTL(key); ttl != time.Hour {
+			t.Errorf("pending ttl %v stored the result for %v, want the window", test.pending, ttl)
+		}
+		commandResponse = RunRedisCommand(backend, "testttl", JsonPayload{Key: key}, options)
+		if !commandResponse.Replayed || commandResponse.IntVal != test.pendingTTL {
+			t.Errorf("duplicate request was not replayed: %+v", commandResponse)
+		}
+	}
+}
+
+func TestReplaysNotAudited(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := &auditLog{filePath: filepath.Join(dir, "audit.log")}
+	if err := a.openFile(); err != nil {
+		t.Fatal(err)
+	}
+	audit = a
+	defer func() {
+		audit = nil
+		a.close()
+	}()
+
+	backend, err := ResolveBackend("", "audited:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := CommandOptions{IdempotencyKey: "audited"}
+	for idx := 0; idx < 2; idx++ {
+		commandResponse := RunRedisCommand(backend, "hset", JsonPayload{Key: "audited:1", Field: "name", Value: "ada"}, options)
+		if !commandResponse.Success || commandResponse.Replayed != (idx > 0) {
+			t.Fatalf("hset %v: %+v", idx, commandResponse)
+		}
+	}
+	content, err := ioutil.ReadFile(a.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := strings.Count(string(content), "\n"); records != 1 {
+		t.Errorf("audit log has %v records, want 1:\n%s", records, content)
+	}
+}
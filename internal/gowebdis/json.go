@@ -0,0 +1,716 @@
+package gowebdis
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+	log "github.com/sirupsen/logrus"
+)
+
+// The json commands serve the RedisJSON commands JSON.SET, JSON.GET,
+// JSON.DEL, JSON.ARRAPPEND and JSON.NUMINCRBY. Backends without the module
+// emulate them on documents stored as JSON strings: the path is evaluated
+// here and the document written back with a compare-and-set script, as the
+// cjson library of redis scripts turns empty arrays into objects and
+// rounds numbers to 14 digits. Emulated writes are therefore not atomic
+// like RedisJSON ones: a write racing with other writes of the document is
+// read and applied again, and fails with a conflict after
+// jsonEmulationAttempts tries. The emulation supports definite paths only,
+// e.g. $.address.city, $['name'] or $.tags[0], and the legacy .a.b syntax.
+
+// JSON module settings of --json-module.
+const (
+	jsonModuleAuto     = "auto"
+	jsonModuleNative   = "native"
+	jsonModuleEmulated = "emulated"
+)
+
+// jsonEmulationAttempts bounds the compare-and-set retries of an emulated
+// write racing with other writes of the document.
+const jsonEmulationAttempts = 10
+
+// jsonEmulationDescription documents the emulated writes in the OpenAPI
+// document.
+var jsonEmulationDescription = fmt.Sprintf("Backends without the RedisJSON module emulate the command on documents stored as JSON strings. "+
+	"Emulated writes are not atomic: gowebdis reads the document, changes it and writes it back only if it did not change in between, "+
+	"otherwise it tries again and fails with 409 after %v tries.", jsonEmulationAttempts)
+
+var jsonModuleGauge = newGauge("gowebdis_json_module", "Whether the backend serves the json commands with the RedisJSON module rather than emulating them.", "backend")
+
+// jsonCompareAndSetScript replaces the document, or deletes it when ARGV[3]
+// is del, only if it still holds ARGV[2], or is still missing when ARGV[1]
+// is 0. The TTL of the key is kept.
+var jsonCompareAndSetScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if ARGV[1] == '1' then
+	if current ~= ARGV[2] then
+		return 0
+	end
+elseif current then
+	return 0
+end
+if ARGV[3] == 'del' then
+	redis.call('DEL', KEYS[1])
+	return 1
+end
+local ttl = redis.call('PTTL', KEYS[1])
+redis.call('SET', KEYS[1], ARGV[4])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 1
+`)
+
+// detectJSONModule decides whether the backend has the RedisJSON module,
+// asking MODULE LIST unless --json-module forces the choice.
+func (backend *Backend) detectJSONModule(setting string) error {
+	switch setting {
+	case jsonModuleNative:
+		backend.jsonNative = true
+	case jsonModuleEmulated:
+		backend.jsonNative = false
+	case jsonModuleAuto, "":
+		modules, err := backend.client.Do("MODULE", "LIST").Result()
+		if err != nil {
+			// MODULE is often disabled on managed servers.
+			log.Warn("[WARN] Cannot list modules of backend " + backend.Name + ": " + err.Error())
+		}
+		backend.jsonNative = err == nil && hasJSONModule(modules)
+	default:
+		return fmt.Errorf("invalid json-module %v, expected auto, native or emulated", setting)
+	}
+	if backend.jsonNative {
+		jsonModuleGauge.set(1, backend.Name)
+		log.Info("[INFO] Backend " + backend.Name + " serves json commands with the RedisJSON module")
+	} else {
+		jsonModuleGauge.set(0, backend.Name)
+		log.Info("[INFO] Backend " + backend.Name + " emulates json commands")
+	}
+	return nil
+}
+
+// hasJSONModule looks for RedisJSON, registered as ReJSON, in the reply of
+// MODULE LIST: one list of name, value pairs per module.
+func hasJSONModule(modules interface{}) bool {
+	list, _ := modules.([]interface{})
+	for _, module := range list {
+		attributes, _ := module.([]interface{})
+		for idx := 0; idx+1 < len(attributes); idx += 2 {
+			name, _ := attributes[idx].(string)
+			value, _ := attributes[idx+1].(string)
+			if name == "name" && (strings.EqualFold(value, "ReJSON") || strings.EqualFold(value, "RedisJSON")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jsonCommand implements one json command natively and emulated.
+type jsonCommand struct {
+	spec     CommandSpec
+	native   string
+	emulate  func(client redis.UniversalClient, key string, path jsonPath, jsonPayload JsonPayload) CommandResponse
+	validate func(jsonPayload JsonPayload) error
+}
+
+func (command *jsonCommand) Spec() CommandSpec {
+	return command.spec
+}
+
+func (command *jsonCommand) Validate(jsonPayload JsonPayload) error {
+	err := command.spec.Validate(jsonPayload)
+	if err == nil && command.validate != nil {
+		err = command.validate(jsonPayload)
+	}
+	return err
+}
+
+func (command *jsonCommand) Execute(client redis.UniversalClient, jsonPayload JsonPayload, options CommandOptions) CommandResponse {
+	path := jsonPayload.Path
+	if len(path) == 0 {
+		path = "$"
+	}
+	if options.backend != nil && options.backend.jsonNative {
+		args := []interface{}{command.native, jsonPayload.Key, path}
+		if len(jsonPayload.Value) > 0 {
+			args = append(args, jsonPayload.Value)
+		}
+		result, err := client.Do(args...).Result()
+		return jsonNativeResponse(command.spec, result, err)
+	}
+	parsed, err := parseJSONPath(path)
+	if err != nil {
+		return jsonFailedResponse(command.spec.Name, err)
+	}
+	return command.emulate(client, jsonPayload.Key, parsed, jsonPayload)
+}
+
+func (command *jsonCommand) Encode(commandResponse CommandResponse) map[string]interface{} {
+	switch command.spec.Response.Type {
+	case TypeBoolean:
+		return map[string]interface{}{command.spec.Response.Name: commandResponse.BoolVal}
+	case TypeInteger:
+		return map[string]interface{}{command.spec.Response.Name: commandResponse.IntVal}
+	}
+	var value interface{}
+	if len(commandResponse.StringVal) > 0 {
+		value = json.RawMessage(commandResponse.StringVal)
+	}
+	return map[string]interface{}{command.spec.Response.Name: value}
+}
+
+// jsonNativeResponse reads the reply of a RedisJSON command: OK or nil for
+// JSON.SET, an integer for JSON.DEL and JSON text, or a list of integers
+// for JSON.ARRAPPEND, otherwise.
+func jsonNativeResponse(spec CommandSpec, result interface{}, err error) CommandResponse {
+	var commandResponse = CommandResponse{Name: spec.Name}
+	if err != nil && err != redis.Nil {
+		return failedResponse(spec.Name, err)
+	}
+	switch value := result.(type) {
+	case string:
+		commandResponse.BoolVal = value == "OK"
+		commandResponse.StringVal = value
+	case int64:
+		commandResponse.IntVal = value
+		commandResponse.StringVal = strconv.FormatInt(value, 10)
+	case []interface{}:
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return failedResponse(spec.Name, err)
+		}
+		commandResponse.StringVal = string(encoded)
+	}
+	commandResponse.Success = true
+	log.Info("[INFO] " + spec.Name + " " + commandResponse.StringVal)
+	return commandResponse
+}
+
+func validateJSONValue(jsonPayload JsonPayload) error {
+	if !json.Valid([]byte(jsonPayload.Value)) {
+		return errors.New("'value' is not valid JSON")
+	}
+	return nil
+}
+
+func validateJSONNumber(jsonPayload JsonPayload) error {
+	_, err := strconv.ParseFloat(jsonPayload.Value, 64)
+	if err != nil || !json.Valid([]byte(jsonPayload.Value)) {
+		return errors.New("'value' is not a JSON number")
+	}
+	return nil
+}
+
+var jsonCommands = []*jsonCommand{
+	{
+		spec: CommandSpec{
+			Name:        "jsonset",
+			Summary:     "Set the JSON value at a path of a JSON document, JSON.SET. New documents are created at the root.",
+			Description: jsonEmulationDescription,
+			Arguments: []ArgumentSpec{
+				{Name: "key", Type: TypeString, Required: true, Description: "Key of the document."},
+				{Name: "path", Type: TypeString, Description: "JSONPath of the value, $ by default."},
+				{Name: "value", Type: TypeString, Required: true, Description: "JSON text of the value."},
+			},
+			Response: ResponseSpec{Name: "boolValue", Type: TypeBoolean, Description: "Whether the value was set, false when its parent does not exist."},
+		},
+		native:   "JSON.SET",
+		emulate:  emulateJSONSet,
+		validate: validateJSONValue,
+	},
+	{
+		spec: CommandSpec{
+			Name:     "jsonget",
+			Summary:  "Get the JSON value at a path of a JSON document, JSON.GET.",
+			ReadOnly: true,
+			ReadKeys: PayloadKey,
+			Arguments: []ArgumentSpec{
+				{Name: "key", Type: TypeString, Required: true, Description: "Key of the document."},
+				{Name: "path", Type: TypeString, Description: "JSONPath of the value, $ by default."},
+			},
+			Response: ResponseSpec{Name: "jsonValue", Type: TypeJSON, Description: "Array of the values matching a JSONPath, the value at a legacy path, null when the document does not exist."},
+		},
+		native:  "JSON.GET",
+		emulate: emulateJSONGet,
+	},
+	{
+		spec: CommandSpec{
+			Name:        "jsondel",
+			Summary:     "Delete the JSON value at a path of a JSON document, or the document, JSON.DEL.",
+			Description: jsonEmulationDescription,
+			Arguments: []ArgumentSpec{
+				{Name: "key", Type: TypeString, Required: true, Description: "Key of the document."},
+				{Name: "path", Type: TypeString, Description: "JSONPath of the value, $ by default."},
+			},
+			Response: ResponseSpec{Name: "intValue", Type: TypeInteger, Description: "Number of values deleted."},
+		},
+		native:  "JSON.DEL",
+		emulate: emulateJSONDel,
+	},
+	{
+		spec: CommandSpec{
+			Name:        "jsonarrappend",
+			Summary:     "Append a JSON value to the array at a path of a JSON document, JSON.ARRAPPEND.",
+			Description: jsonEmulationDescription,
+			Arguments: []ArgumentSpec{
+				{Name: "key", Type: TypeString, Required: true, Description: "Key of the document."},
+				{Name: "path", Type: TypeString, Description: "JSONPath of the array, $ by default."},
+				{Name: "value", Type: TypeString, Required: true, Description: "JSON text of the value."},
+			},
+			Response: ResponseSpec{Name: "jsonValue", Type: TypeJSON, Description: "New length of the arrays matching a JSONPath, null for values that are not arrays."},
+		},
+		native:   "JSON.ARRAPPEND",
+		emulate:  emulateJSONArrAppend,
+		validate: validateJSONValue,
+	},
+	{
+		spec: CommandSpec{
+			Name:        "jsonnumincrby",
+			Summary:     "Increment the number at a path of a JSON document, JSON.NUMINCRBY.",
+			Description: jsonEmulationDescription,
+			Arguments: []ArgumentSpec{
+				{Name: "key", Type: TypeString, Required: true, Description: "Key of the document."},
+				{Name: "path", Type: TypeString, Description: "JSONPath of the number, $ by default."},
+				{Name: "value", Type: TypeString, Required: true, Description: "Increment, a JSON number."},
+			},
+			Response: ResponseSpec{Name: "jsonValue", Type: TypeJSON, Description: "New value of the numbers matching a JSONPath, null for values that are not numbers."},
+		},
+		native:   "JSON.NUMINCRBY",
+		emulate:  emulateJSONNumIncrBy,
+		validate: validateJSONNumber,
+	},
+}
+
+// jsonPath is a definite path into a JSON document: object member names
+// and array indexes, negative from the end. Legacy paths reply with the
+// value itself rather than the list of matches.
+type jsonPath struct {
+	raw      string
+	legacy   bool
+	segments []interface{}
+}
+
+// jsonError is an error of the caller found by the emulation, answered
+// with 400 rather than as a redis failure.
+type jsonError struct {
+	message string
+}
+
+func (err jsonError) Error() string {
+	return err.message
+}
+
+func jsonErrorf(format string, args ...interface{}) error {
+	return jsonError{message: fmt.Sprintf(format, args...)}
+}
+
+func jsonFailedResponse(name string, err error) CommandResponse {
+	commandResponse := failedResponse(name, err)
+	if _, ok := err.(jsonError); ok {
+		commandResponse.ErrorCode = ""
+	}
+	return commandResponse
+}
+
+func unsupportedJSONPath(path string) error {
+	return jsonErrorf("path %v is not supported without the RedisJSON module", path)
+}
+
+func parseJSONPath(path string) (jsonPath, error) {
+	parsed := jsonPath{raw: path}
+	rest := path
+	if strings.HasPrefix(rest, "$") {
+		rest = rest[1:]
+	} else {
+		parsed.legacy = true
+		if rest == "." {
+			rest = ""
+		} else if !strings.HasPrefix(rest, ".") && !strings.HasPrefix(rest, "[") {
+			rest = "." + rest
+		}
+	}
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			if len(name) == 0 || name == "*" {
+				return parsed, unsupportedJSONPath(path)
+			}
+			parsed.segments = append(parsed.segments, name)
+			rest = rest[end:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return parsed, jsonErrorf("invalid path %v", path)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				parsed.segments = append(parsed.segments, inner[1:len(inner)-1])
+				continue
+			}
+			index, err := strconv.Atoi(inner)
+			if err != nil {
+				return parsed, unsupportedJSONPath(path)
+			}
+			parsed.segments = append(parsed.segments, index)
+		default:
+			return parsed, jsonErrorf("invalid path %v", path)
+		}
+	}
+	return parsed, nil
+}
+
+// lookup returns the value at the path.
+func (path jsonPath) lookup(document interface{}) (interface{}, bool) {
+	value := document
+	for _, segment := range path.segments {
+		switch s := segment.(type) {
+		case string:
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			value, ok = object[s]
+			if !ok {
+				return nil, false
+			}
+		case int:
+			array, ok := value.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			index, ok := arrayIndex(array, s)
+			if !ok {
+				return nil, false
+			}
+			value = array[index]
+		}
+	}
+	return value, true
+}
+
+func arrayIndex(array []interface{}, index int) (int, bool) {
+	if index < 0 {
+		index += len(array)
+	}
+	return index, index >= 0 && index < len(array)
+}
+
+// update calls fn with the value at the path, or nil and false when the
+// object holding it lacks the member, and stores the value it returns, or
+// deletes it when keep is false. It returns the updated node and false
+// when the parent of the path does not exist.
+func (path jsonPath) update(node interface{}, fn func(value interface{}, exists bool) (interface{}, bool)) (interface{}, bool) {
+	return updateJSON(node, path.segments, fn)
+}
+
+func updateJSON(node interface{}, segments []interface{}, fn func(value interface{}, exists bool) (interface{}, bool)) (interface{}, bool) {
+	if len(segments) == 0 {
+		value, _ := fn(node, true)
+		return value, true
+	}
+	switch s := segments[0].(type) {
+	case string:
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return node, false
+		}
+		child, exists := object[s]
+		if len(segments) == 1 {
+			value, keep := fn(child, exists)
+			if keep {
+				object[s] = value
+			} else {
+				delete(object, s)
+			}
+			return object, true
+		}
+		if !exists {
+			return node, false
+		}
+		child, ok = updateJSON(child, segments[1:], fn)
+		object[s] = child
+		return object, ok
+	case int:
+		array, ok := node.([]interface{})
+		if !ok {
+			return node, false
+		}
+		index, ok := arrayIndex(array, s)
+		if !ok {
+			return node, false
+		}
+		if len(segments) == 1 {
+			value, keep := fn(array[index], true)
+			if keep {
+				array[index] = value
+				return array, true
+			}
+			return append(array[:index], array[index+1:]...), true
+		}
+		array[index], ok = updateJSON(array[index], segments[1:], fn)
+		return array, ok
+	}
+	return node, false
+}
+
+func decodeJSON(text string) (interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err == nil && decoder.More() {
+		err = errors.New("trailing data")
+	}
+	return value, err
+}
+
+func encodeJSON(value interface{}) (string, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(value)
+	return strings.TrimSuffix(buffer.String(), "\n"), err
+}
+
+// loadJSONDocument reads an emulated document, exists is false when the
+// key does not exist.
+func loadJSONDocument(client redis.UniversalClient, key string) (string, interface{}, bool, error) {
+	stored, err := client.Get(key).Result()
+	if err == redis.Nil {
+		return "", nil, false, nil
+	}
+	if err != nil {
+		return "", nil, false, err
+	}
+	document, err := decodeJSON(stored)
+	if err != nil {
+		return "", nil, false, jsonErrorf("%v does not hold a JSON document", key)
+	}
+	return stored, document, true, nil
+}
+
+// jsonMatches formats the values found at a path like RedisJSON: the list
+// of matches for a JSONPath, the value for a legacy path.
+func jsonMatches(path jsonPath, value interface{}, found bool) (string, error) {
+	if path.legacy {
+		if !found {
+			return "", jsonErrorf("path %v does not exist", path.raw)
+		}
+		return encodeJSON(value)
+	}
+	if !found {
+		return "[]", nil
+	}
+	return encodeJSON([]interface{}{value})
+}
+
+// deletedJSONDocument is returned to modifyJSONDocument to delete the
+// document, as nil is the JSON null.
+type deletedJSONDocument struct{}
+
+// modifyJSONDocument applies fn to the document until it is written back
+// without a concurrent change in between. fn returns the new document, or
+// deletedJSONDocument, and whether it changed.
+func modifyJSONDocument(client redis.UniversalClient, name string, key string, fn func(document interface{}, exists bool) (interface{}, bool, CommandResponse)) CommandResponse {
+	for attempt := 0; attempt < jsonEmulationAttempts; attempt++ {
+		stored, document, exists, err := loadJSONDocument(client, key)
+		if err != nil {
+			return jsonFailedResponse(name, err)
+		}
+		document, changed, commandResponse := fn(document, exists)
+		if !changed || !commandResponse.Success {
+			return commandResponse
+		}
+		args := []interface{}{"0", stored, "set", ""}
+		if exists {
+			args[0] = "1"
+		}
+		if _, ok := document.(deletedJSONDocument); ok {
+			args[2] = "del"
+		} else {
+			args[3], err = encodeJSON(document)
+			if err != nil {
+				return jsonFailedResponse(name, err)
+			}
+		}
+		replaced, err := jsonCompareAndSetScript.Run(client, []string{key}, args...).Int()
+		if err != nil {
+			return jsonFailedResponse(name, err)
+		}
+		if replaced == 1 {
+			log.Info("[INFO] " + name + " " + key)
+			return commandResponse
+		}
+	}
+	var commandResponse = CommandResponse{Name: name}
+	commandResponse.Success = false
+	commandResponse.ErrorCode = ErrorCodeConflict
+	commandResponse.ErrorMessage = key + " changed concurrently too often, retry"
+	log.Error("[ERROR] " + commandResponse.ErrorMessage)
+	return commandResponse
+}
+
+func emulateJSONGet(client redis.UniversalClient, key string, path jsonPath, jsonPayload JsonPayload) CommandResponse {
+	var commandResponse = CommandResponse{Name: "jsonget"}
+	_, document, exists, err := loadJSONDocument(client, key)
+	if err != nil {
+		return jsonFailedResponse(commandResponse.Name, err)
+	}
+	if exists {
+		value, found := path.lookup(document)
+		commandResponse.StringVal, err = jsonMatches(path, value, found)
+		if err != nil {
+			return jsonFailedResponse(commandResponse.Name, err)
+		}
+	}
+	commandResponse.Success = true
+	return commandResponse
+}
+
+func emulateJSONSet(client redis.UniversalClient, key string, path jsonPath, jsonPayload JsonPayload) CommandResponse {
+	return modifyJSONDocument(client, "jsonset", key, func(document interface{}, exists bool) (interface{}, bool, CommandResponse) {
+		var commandResponse = CommandResponse{Name: "jsonset", Success: true}
+		if !exists && len(path.segments) > 0 {
+			return nil, false, jsonFailedResponse("jsonset", jsonErrorf("new documents must be created at the root"))
+		}
+		// Decoded on every attempt, as the document ends up holding it.
+		value, err := decodeJSON(jsonPayload.Value)
+		if err != nil {
+			return nil, false, jsonFailedResponse("jsonset", err)
+		}
+		document, commandResponse.BoolVal = path.update(document, func(interface{}, bool) (interface{}, bool) {
+			return value, true
+		})
+		return document, commandResponse.BoolVal, commandResponse
+	})
+}
+
+func emulateJSONDel(client redis.UniversalClient, key string, path jsonPath, jsonPayload JsonPayload) CommandResponse {
+	return modifyJSONDocument(client, "jsondel", key, func(document interface{}, exists bool) (interface{}, bool, CommandResponse) {
+		var commandResponse = CommandResponse{Name: "jsondel", Success: true}
+		if !exists {
+			return nil, false, commandResponse
+		}
+		if len(path.segments) == 0 {
+			commandResponse.IntVal = 1
+			return deletedJSONDocument{}, true, commandResponse
+		}
+		document, _ = path.update(document, func(value interface{}, exists bool) (interface{}, bool) {
+			if exists {
+				commandResponse.IntVal = 1
+			}
+			return nil, false
+		})
+		return document, commandResponse.IntVal > 0, commandResponse
+	})
+}
+
+// emulateJSONValues replaces the value at the path with the one computed
+// by fn and replies with the result of fn: the list of results for a
+// JSONPath, holding null when the value has the wrong type, the result for
+// a legacy path, which fails then.
+func emulateJSONValues(client redis.UniversalClient, name string, key string, path jsonPath, kind string, fn func(value interface{}) (interface{}, interface{}, bool, error)) CommandResponse {
+	return modifyJSONDocument(client, name, key, func(document interface{}, exists bool) (interface{}, bool, CommandResponse) {
+		var commandResponse = CommandResponse{Name: name, Success: true}
+		if !exists {
+			return nil, false, jsonFailedResponse(name, jsonErrorf("%v does not exist", key))
+		}
+		value, found := path.lookup(document)
+		if !found {
+			if path.legacy {
+				return nil, false, jsonFailedResponse(name, jsonErrorf("path %v does not exist", path.raw))
+			}
+			commandResponse.StringVal = "[]"
+			return nil, false, commandResponse
+		}
+		updated, result, ok, err := fn(value)
+		if err != nil {
+			return nil, false, jsonFailedResponse(name, err)
+		}
+		if !ok {
+			if path.legacy {
+				return nil, false, jsonFailedResponse(name, jsonErrorf("path %v is not %v", path.raw, kind))
+			}
+			commandResponse.StringVal = "[null]"
+			return nil, false, commandResponse
+		}
+		document, _ = path.update(document, func(interface{}, bool) (interface{}, bool) {
+			return updated, true
+		})
+		if path.legacy {
+			commandResponse.StringVal, err = encodeJSON(result)
+		} else {
+			commandResponse.StringVal, err = encodeJSON([]interface{}{result})
+		}
+		if err != nil {
+			return nil, false, jsonFailedResponse(name, err)
+		}
+		return document, true, commandResponse
+	})
+}
+
+func emulateJSONArrAppend(client redis.UniversalClient, key string, path jsonPath, jsonPayload JsonPayload) CommandResponse {
+	return emulateJSONValues(client, "jsonarrappend", key, path, "an array", func(value interface{}) (interface{}, interface{}, bool, error) {
+		array, ok := value.([]interface{})
+		if !ok {
+			return nil, nil, false, nil
+		}
+		appended, err := decodeJSON(jsonPayload.Value)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		array = append(array, appended)
+		return array, len(array), true, nil
+	})
+}
+
+func emulateJSONNumIncrBy(client redis.UniversalClient, key string, path jsonPath, jsonPayload JsonPayload) CommandResponse {
+	return emulateJSONValues(client, "jsonnumincrby", key, path, "a number", func(value interface{}) (interface{}, interface{}, bool, error) {
+		number, ok := value.(json.Number)
+		if !ok {
+			return nil, nil, false, nil
+		}
+		sum, err := addJSONNumbers(number, json.Number(jsonPayload.Value))
+		return sum, sum, true, err
+	})
+}
+
+// addJSONNumbers keeps integers integers, like RedisJSON, unless their sum
+// overflows 64 bits and is then a float.
+func addJSONNumbers(a json.Number, b json.Number) (json.Number, error) {
+	if x, err := a.Int64(); err == nil {
+		if y, err := b.Int64(); err == nil {
+			sum := x + y
+			if (sum > x) == (y > 0) {
+				return json.Number(strconv.FormatInt(sum, 10)), nil
+			}
+		}
+	}
+	x, err := a.Float64()
+	if err != nil {
+		return "", err
+	}
+	y, err := b.Float64()
+	if err != nil {
+		return "", err
+	}
+	sum := x + y
+	if math.IsInf(sum, 0) {
+		return "", jsonErrorf("%v + %v is out of the range of numbers", a, b)
+	}
+	return json.Number(strconv.FormatFloat(sum, 'g', -1, 64)), nil
+}
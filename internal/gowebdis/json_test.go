@@ -0,0 +1,126 @@
+package gowebdis
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		legacy   bool
+		segments []interface{}
+	}{
+		{"$", false, nil},
+		{".", true, nil},
+		{"$.address.city", false, []interface{}{"address", "city"}},
+		{"$['address.city']", false, []interface{}{"address.city"}},
+		{`$["name"].first`, false, []interface{}{"name", "first"}},
+		{"$.tags[0]", false, []interface{}{"tags", 0}},
+		{"$.tags[-1][2]", false, []interface{}{"tags", -1, 2}},
+		{"address.city", true, []interface{}{"address", "city"}},
+		{".address", true, []interface{}{"address"}},
+		{"[1].name", true, []interface{}{1, "name"}},
+	}
+	for _, test := range tests {
+		parsed, err := parseJSONPath(test.path)
+		if err != nil || parsed.legacy != test.legacy || !reflect.DeepEqual(parsed.segments, test.segments) {
+			t.Errorf("parseJSONPath(%v) = %v %v, %v, want %v %v", test.path, parsed.legacy, parsed.segments, err, test.legacy, test.segments)
+		}
+	}
+
+	for _, path := range []string{"$.*", "$..name", "$.tags[*]", "$[?(@.a)]", "$.tags[0", "$name", "$.a.", "a..b"} {
+		parsed, err := parseJSONPath(path)
+		if err == nil {
+			t.Errorf("parseJSONPath(%v) = %v, want an error", path, parsed.segments)
+		} else if _, ok := err.(jsonError); !ok {
+			t.Errorf("parseJSONPath(%v) failed with %v, want an error of the caller", path, err)
+		}
+	}
+}
+
+func TestAddJSONNumbers(t *testing.T) {
+	tests := []struct {
+		a, b json.Number
+		sum  json.Number
+	}{
+		{"1", "2", "3"},
+		{"-3", "3", "0"},
+		{"1.5", "1", "2.5"},
+		{"0.1", "0.2", "0.30000000000000004"},
+		{"1e2", "1", "101"},
+		{"9223372036854775806", "1", "9223372036854775807"},
+		{"9223372036854775807", "1", "9223372036854775808"},
+		{"-9223372036854775808", "-1", "-9223372036854775809"},
+		{"9223372036854775807", "9223372036854775807", "18446744073709551614"},
+		{"-9223372036854775808", "-9223372036854775808", "-18446744073709551616"},
+	}
+	for _, test := range tests {
+		sum, err := addJSONNumbers(test.a, test.b)
+		if err != nil {
+			t.Errorf("%v + %v: %v", test.a, test.b, err)
+			continue
+		}
+		// Overflowing sums are floats, compare them as such.
+		got, _ := sum.Float64()
+		want, _ := test.sum.Float64()
+		if got != want || (got < 0) != (want < 0) {
+			t.Errorf("%v + %v = %v, want %v", test.a, test.b, sum, test.sum)
+		}
+	}
+	if sum, err := addJSONNumbers("1e308", "1e308"); err == nil {
+		t.Errorf("1e308 + 1e308 = %v, want an error", sum)
+	}
+}
+
+// TestModifyJSONDocumentRetries changes the document behind the back of
+// modifyJSONDocument, which must apply fn again to the new document, and
+// fail with a conflict once the document kept changing for
+// jsonEmulationAttempts tries.
+func TestModifyJSONDocumentRetries(t *testing.T) {
+	backend, err := ResolveBackend("", "json:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRedis.Set("json:1", `{"count":1}`)
+	testRedis.SetTTL("json:1", time.Hour)
+	increment := func(races int) (func(document interface{}, exists bool) (interface{}, bool, CommandResponse), *int) {
+		calls := 0
+		return func(document interface{}, exists bool) (interface{}, bool, CommandResponse) {
+			calls++
+			if calls <= races {
+				// Another writer changes the document in between.
+				testRedis.Set("json:1", fmt.Sprintf(`{"count":%v}`, 10*calls))
+				testRedis.SetTTL("json:1", time.Hour)
+			}
+			object := document.(map[string]interface{})
+			sum, _ := addJSONNumbers(object["count"].(json.Number), "1")
+			object["count"] = sum
+			return object, true, CommandResponse{Name: "test", Success: true}
+		}, &calls
+	}
+
+	fn, calls := increment(2)
+	commandResponse := modifyJSONDocument(backend.client, "test", "json:1", fn)
+	if !commandResponse.Success || *calls != 3 {
+		t.Errorf("write racing twice = %+v after %v tries", commandResponse, *calls)
+	}
+	if stored, _ := testRedis.Get("json:1"); stored != `{"count":21}` {
+		t.Errorf("write racing twice stored %v", stored)
+	}
+	if ttl := testRedis.TTL("json:1"); ttl != time.Hour {
+		t.Errorf("write lost the TTL of the document: %v", ttl)
+	}
+
+	fn, calls = increment(jsonEmulationAttempts)
+	commandResponse = modifyJSONDocument(backend.client, "test", "json:1", fn)
+	if commandResponse.Success || commandResponse.ErrorCode != ErrorCodeConflict || *calls != jsonEmulationAttempts {
+		t.Errorf("write always racing = %+v after %v tries", commandResponse, *calls)
+	}
+	if stored, _ := testRedis.Get("json:1"); stored != fmt.Sprintf(`{"count":%v}`, 10*jsonEmulationAttempts) {
+		t.Errorf("write always racing stored %v", stored)
+	}
+}
@@ -0,0 +1,103 @@
+package gowebdis
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var repliesRefusedTotal = newCounter("gowebdis_replies_refused_total", "Number of replies refused for exceeding --max-reply-elements or --max-reply-size.", "backend", "command")
+
+// checkReplyLimits refuses replies of unbounded commands such as hgetall on
+// a huge hash, which would otherwise be sent in one response. The reply is
+// already in memory by then: only checkHashLength keeps hgetall from
+// loading hashes with too many fields. It checks every kind of reply,
+// fields and values as well as strings and the JSON arrays replied by the
+// json commands. Replies are checked as read, so that refused replies are neither cached nor shared
+// with coalesced reads, and again after the post hooks decoded them, since
+// decompressed and decrypted values are larger than stored.
+func checkReplyLimits(backend *Backend, commandResponse CommandResponse) CommandResponse {
+	if !commandResponse.Success {
+		return commandResponse
+	}
+
+	var err error
+	maxElements := viper.GetInt("max-reply-elements")
+	maxSize := viper.GetInt("max-reply-size")
+	if maxSize > 0 && replySize(commandResponse) > maxSize {
+		err = fmt.Errorf("Reply of %v is larger than %v bytes", commandResponse.Name, maxSize)
+	} else if maxElements > 0 {
+		if elements := replyElements(commandResponse); elements > maxElements {
+			err = fmt.Errorf("Reply of %v has %v elements, more than %v", commandResponse.Name, elements, maxElements)
+		}
+	}
+	if err == nil {
+		return commandResponse
+	}
+	return refuseReply(backend, commandResponse.Name, err)
+}
+
+// checkHashLength refuses hgetall on a hash with more fields than
+// --max-reply-elements before reading it, with HLEN. A hash growing
+// between HLEN and HGETALL is still refused by checkReplyLimits, once read.
+// Values are only measured against --max-reply-size once read.
+func checkHashLength(backend *Backend, client redis.UniversalClient, key string) *CommandResponse {
+	maxElements := viper.GetInt("max-reply-elements")
+	if maxElements <= 0 {
+		return nil
+	}
+	length, err := client.HLen(key).Result()
+	if err != nil {
+		commandResponse := failedResponse("hgetall", err)
+		return &commandResponse
+	}
+	if len(versionField()) > 0 {
+		// The version field is not part of the reply.
+		length--
+	}
+	if length <= int64(maxElements) {
+		return nil
+	}
+	refused := refuseReply(backend, "hgetall", fmt.Errorf("Reply of hgetall has %v elements, more than %v", length, maxElements))
+	return &refused
+}
+
+func refuseReply(backend *Backend, redisCommand string, err error) CommandResponse {
+	backendName := ""
+	if backend != nil {
+		backendName = backend.Name
+	}
+	repliesRefusedTotal.inc(backendName, redisCommand)
+	refused := CommandResponse{Name: redisCommand}
+	refused.Success = false
+	refused.ErrorCode = ErrorCodeUnprocessable
+	refused.ErrorMessage = err.Error()
+	log.Error("[ERROR] " + refused.ErrorMessage)
+	return refused
+}
+
+// replySize is the size of the values of a reply.
+func replySize(commandResponse CommandResponse) int {
+	size := len(commandResponse.StringVal)
+	for field, value := range commandResponse.MapVal {
+		size += len(field) + len(value)
+	}
+	return size
+}
+
+// replyElements is the number of fields of a reply, or of elements of the
+// JSON array it holds.
+func replyElements(commandResponse CommandResponse) int {
+	if len(commandResponse.MapVal) > 0 || !strings.HasPrefix(commandResponse.StringVal, "[") {
+		return len(commandResponse.MapVal)
+	}
+	var elements []json.RawMessage
+	if json.Unmarshal([]byte(commandResponse.StringVal), &elements) != nil {
+		return 0
+	}
+	return len(elements)
+}
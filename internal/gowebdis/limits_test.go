@@ -0,0 +1,62 @@
+package gowebdis
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestCheckReplyLimits(t *testing.T) {
+	viper.Set("max-reply-elements", 2)
+	viper.Set("max-reply-size", 16)
+	defer viper.Set("max-reply-elements", 0)
+	defer viper.Set("max-reply-size", 0)
+
+	backend := &Backend{Name: "test"}
+	for _, test := range []struct {
+		response CommandResponse
+		refused  bool
+	}{
+		{CommandResponse{MapVal: map[string]string{"a": "1", "b": "2"}}, false},
+		{CommandResponse{MapVal: map[string]string{"a": "1", "b": "2", "c": "3"}}, true},
+		{CommandResponse{MapVal: map[string]string{"a": strings.Repeat("x", 16)}}, true},
+		{CommandResponse{StringVal: "PONG"}, false},
+		{CommandResponse{StringVal: strings.Repeat("x", 17)}, true},
+		{CommandResponse{StringVal: "[1,2]"}, false},
+		{CommandResponse{StringVal: "[1,2,3]"}, true},
+		{CommandResponse{StringVal: `"[1,2,3]"`}, false},
+	} {
+		test.response.Name = "test"
+		test.response.Success = true
+		checked := checkReplyLimits(backend, test.response)
+		if checked.Success == test.refused {
+			t.Errorf("reply %v %v refused", test.response.MapVal, test.response.StringVal)
+		}
+		if test.refused && checked.ErrorCode != ErrorCodeUnprocessable {
+			t.Errorf("refused reply has error code %v", checked.ErrorCode)
+		}
+	}
+}
+
+// TestHashLengthCheckedBeforeRead runs hgetall without the reply checks of
+// RunRedisCommand, so that only the HLEN check can refuse it.
+func TestHashLengthCheckedBeforeRead(t *testing.T) {
+	viper.Set("max-reply-elements", 2)
+	defer viper.Set("max-reply-elements", 0)
+	testRedis.HSet("limits:1", "a", "1", "b", "2")
+	backend, err := ResolveBackend("", "limits:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	command, _ := LookupCommand("hgetall")
+	options := CommandOptions{backend: backend}
+	if commandResponse := command.Execute(backend.client, JsonPayload{Key: "limits:1"}, options); !commandResponse.Success {
+		t.Fatalf("hgetall of 2 fields refused: %v", commandResponse.ErrorMessage)
+	}
+	testRedis.HSet("limits:1", "c", "3")
+	commandResponse := command.Execute(backend.client, JsonPayload{Key: "limits:1"}, options)
+	if commandResponse.Success || commandResponse.ErrorCode != ErrorCodeUnprocessable || len(commandResponse.MapVal) > 0 {
+		t.Errorf("hgetall of 3 fields returned %+v", commandResponse)
+	}
+}
@@ -0,0 +1,126 @@
+package gowebdis
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is a minimal Prometheus counter or gauge with labels, rendered in
+// the text exposition format by WriteMetrics.
+type metric struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+var metricsMutex sync.Mutex
+var metricsRegistry []*metric
+
+// metricsCollectors refresh gauges whose values are only known at scrape
+// time, such as connection pool statistics.
+var metricsCollectors []func()
+
+func newMetric(metricType string, name string, help string, labelNames ...string) *metric {
+	m := &metric{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		values:     map[string]float64{},
+	}
+	metricsMutex.Lock()
+	metricsRegistry = append(metricsRegistry, m)
+	metricsMutex.Unlock()
+	return m
+}
+
+func newCounter(name string, help string, labelNames ...string) *metric {
+	return newMetric("counter", name, help, labelNames...)
+}
+
+func newGauge(name string, help string, labelNames ...string) *metric {
+	return newMetric("gauge", name, help, labelNames...)
+}
+
+func registerMetricsCollector(collector func()) {
+	metricsMutex.Lock()
+	metricsCollectors = append(metricsCollectors, collector)
+	metricsMutex.Unlock()
+}
+
+func (m *metric) labelKey(labelValues []string) string {
+	pairs := make([]string, len(m.labelNames))
+	for idx, labelName := range m.labelNames {
+		var value string
+		if idx < len(labelValues) {
+			value = labelValues[idx]
+		}
+		pairs[idx] = labelName + "=" + strconv.Quote(value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *metric) add(delta float64, labelValues ...string) {
+	key := m.labelKey(labelValues)
+	m.mutex.Lock()
+	m.values[key] += delta
+	m.mutex.Unlock()
+}
+
+func (m *metric) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metric) set(value float64, labelValues ...string) {
+	key := m.labelKey(labelValues)
+	m.mutex.Lock()
+	m.values[key] = value
+	m.mutex.Unlock()
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.values) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %v %v\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", m.name, m.metricType)
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := strconv.FormatFloat(m.values[key], 'g', -1, 64)
+		if len(key) > 0 {
+			fmt.Fprintf(w, "%v{%v} %v\n", m.name, key, value)
+		} else {
+			fmt.Fprintf(w, "%v %v\n", m.name, value)
+		}
+	}
+}
+
+// WriteMetrics renders every registered metric in the Prometheus text
+// format.
+func WriteMetrics(w io.Writer) {
+	metricsMutex.Lock()
+	collectors := metricsCollectors
+	registry := metricsRegistry
+	metricsMutex.Unlock()
+
+	for _, collector := range collectors {
+		collector()
+	}
+	for _, m := range registry {
+		m.write(w)
+	}
+}
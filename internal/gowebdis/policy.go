@@ -0,0 +1,340 @@
+package gowebdis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/spf13/viper"
+)
+
+type commandFlag uint
+
+const (
+	flagReadonly commandFlag = 1 << iota
+	flagWrite
+	flagAdmin
+	flagBlocking
+	flagMultiKey
+)
+
+// commandFlagNames are used in --command-allow and --command-deny as
+// "@name" to refer to every command with the flag.
+var commandFlagNames = map[string]commandFlag{
+	"readonly":  flagReadonly,
+	"write":     flagWrite,
+	"admin":     flagAdmin,
+	"blocking":  flagBlocking,
+	"multi-key": flagMultiKey,
+}
+
+// commandTable flags the redis commands, and the subcommands whose flags
+// differ from their command, e.g. "script flush".
+var commandTable = map[string]commandFlag{
+	"ping":   flagReadonly,
+	"echo":   flagReadonly,
+	"select": flagReadonly,
+
+	"get":         flagReadonly,
+	"mget":        flagReadonly | flagMultiKey,
+	"strlen":      flagReadonly,
+	"getrange":    flagReadonly,
+	"set":         flagWrite,
+	"setnx":       flagWrite,
+	"setex":       flagWrite,
+	"psetex":      flagWrite,
+	"mset":        flagWrite | flagMultiKey,
+	"msetnx":      flagWrite | flagMultiKey,
+	"getset":      flagWrite,
+	"append":      flagWrite,
+	"setrange":    flagWrite,
+	"incr":        flagWrite,
+	"incrby":      flagWrite,
+	"incrbyfloat": flagWrite,
+	"decr":        flagWrite,
+	"decrby":      flagWrite,
+
+	"exists":    flagReadonly | flagMultiKey,
+	"type":      flagReadonly,
+	"ttl":       flagReadonly,
+	"pttl":      flagReadonly,
+	"scan":      flagReadonly,
+	"randomkey": flagReadonly,
+	"dbsize":    flagReadonly,
+	"del":       flagWrite | flagMultiKey,
+	"unlink":    flagWrite | flagMultiKey,
+	"expire":    flagWrite,
+	"pexpire":   flagWrite,
+	"expireat":  flagWrite,
+	"persist":   flagWrite,
+	"rename":    flagWrite | flagMultiKey,
+	"renamenx":  flagWrite | flagMultiKey,
+	"move":      flagWrite,
+	"keys":      flagReadonly | flagAdmin,
+
+	"hget":         flagReadonly,
+	"hmget":        flagReadonly,
+	"hgetall":      flagReadonly,
+	"hkeys":        flagReadonly,
+	"hvals":        flagReadonly,
+	"hlen":         flagReadonly,
+	"hexists":      flagReadonly,
+	"hstrlen":      flagReadonly,
+	"hscan":        flagReadonly,
+	"hset":         flagWrite,
+	"hsetnx":       flagWrite,
+	"hmset":        flagWrite,
+	"hdel":         flagWrite,
+	"hincrby":      flagWrite,
+	"hincrbyfloat": flagWrite,
+
+	"lrange":     flagReadonly,
+	"llen":       flagReadonly,
+	"lindex":     flagReadonly,
+	"lpush":      flagWrite,
+	"rpush":      flagWrite,
+	"lpop":       flagWrite,
+	"rpop":       flagWrite,
+	"lset":       flagWrite,
+	"lrem":       flagWrite,
+	"ltrim":      flagWrite,
+	"rpoplpush":  flagWrite | flagMultiKey,
+	"blpop":      flagWrite | flagBlocking | flagMultiKey,
+	"brpop":      flagWrite | flagBlocking | flagMultiKey,
+	"brpoplpush": flagWrite | flagBlocking | flagMultiKey,
+
+	"smembers":    flagReadonly,
+	"sismember":   flagReadonly,
+	"scard":       flagReadonly,
+	"sscan":       flagReadonly,
+	"sinter":      flagReadonly | flagMultiKey,
+	"sunion":      flagReadonly | flagMultiKey,
+	"sdiff":       flagReadonly | flagMultiKey,
+	"sadd":        flagWrite,
+	"srem":        flagWrite,
+	"spop":        flagWrite,
+	"smove":       flagWrite | flagMultiKey,
+	"sinterstore": flagWrite | flagMultiKey,
+	"sunionstore": flagWrite | flagMultiKey,
+	"sdiffstore":  flagWrite | flagMultiKey,
+
+	"zrange":           flagReadonly,
+	"zrevrange":        flagReadonly,
+	"zrangebyscore":    flagReadonly,
+	"zrevrangebyscore": flagReadonly,
+	"zscore":           flagReadonly,
+	"zrank":            flagReadonly,
+	"zcard":            flagReadonly,
+	"zcount":           flagReadonly,
+	"zscan":            flagReadonly,
+	"zadd":             flagWrite,
+	"zincrby":          flagWrite,
+	"zrem":             flagWrite,
+	"zremrangebyscore": flagWrite,
+	"zremrangebyrank":  flagWrite,
+	"zunionstore":      flagWrite | flagMultiKey,
+	"zinterstore":      flagWrite | flagMultiKey,
+	"bzpopmin":         flagWrite | flagBlocking | flagMultiKey,
+	"bzpopmax":         flagWrite | flagBlocking | flagMultiKey,
+
+	"xrange":    flagReadonly,
+	"xrevrange": flagReadonly,
+	"xlen":      flagReadonly,
+	"xread":     flagReadonly | flagBlocking | flagMultiKey,
+	"xadd":      flagWrite,
+	"xtrim":     flagWrite,
+	"xdel":      flagWrite,
+
+	"publish":    flagWrite,
+	"subscribe":  flagReadonly | flagBlocking,
+	"psubscribe": flagReadonly | flagBlocking,
+
+	"eval":    flagWrite | flagMultiKey,
+	"evalsha": flagWrite | flagMultiKey,
+	"multi":   flagReadonly,
+	"exec":    flagWrite,
+	"watch":   flagReadonly | flagMultiKey,
+	"wait":    flagReadonly | flagBlocking,
+
+	"script":        flagAdmin,
+	"script load":   flagWrite,
+	"script exists": flagReadonly,
+	"script flush":  flagWrite | flagAdmin,
+	"script kill":   flagWrite | flagAdmin,
+
+	"flushdb":      flagWrite | flagAdmin,
+	"flushall":     flagWrite | flagAdmin,
+	"config":       flagAdmin,
+	"debug":        flagAdmin,
+	"shutdown":     flagAdmin,
+	"monitor":      flagAdmin | flagBlocking,
+	"client":       flagAdmin,
+	"info":         flagReadonly,
+	"slowlog":      flagAdmin,
+	"save":         flagAdmin,
+	"bgsave":       flagAdmin,
+	"bgrewriteaof": flagAdmin,
+	"lastsave":     flagReadonly,
+	"replicaof":    flagAdmin,
+	"slaveof":      flagAdmin,
+	"cluster":      flagAdmin,
+	"acl":          flagAdmin,
+	"module":       flagAdmin,
+	"migrate":      flagWrite | flagAdmin | flagMultiKey,
+	"swapdb":       flagWrite | flagAdmin,
+}
+
+var commandsDeniedTotal = newCounter("gowebdis_commands_denied_total", "Number of commands refused by the command policy.", "backend", "command")
+
+// commandFlags looks a command up in the command table, preferring the
+// entry of its subcommand when there is one.
+func commandFlags(redisCommand string, subcommand string) commandFlag {
+	if len(subcommand) > 0 {
+		if flags, ok := commandTable[redisCommand+" "+strings.ToLower(subcommand)]; ok {
+			return flags
+		}
+	}
+	if flags, ok := commandTable[redisCommand]; ok {
+		return flags
+	}
+	// Commands added with RegisterCommand are flagged after their spec.
+	if command, ok := LookupCommand(redisCommand); ok {
+		if command.Spec().ReadOnly {
+			return flagReadonly
+		}
+		return flagWrite
+	}
+	return 0
+}
+
+// commandPolicy decides which commands a backend accepts. A command is
+// refused when it matches --command-deny, when --command-allow is set and
+// it does not match it, or when the backend renamed it to "". Commands
+// flagged admin additionally require the --admin-role role. Entries of both
+// lists are command names, "command subcommand" or "@flag".
+type commandPolicy struct {
+	allow   []string
+	deny    []string
+	renames map[string]string
+}
+
+func newCommandPolicy(source settingSource, renames map[string]string) commandPolicy {
+	return commandPolicy{
+		allow:   splitList(strings.ToLower(source.getString("command-allow"))),
+		deny:    splitList(strings.ToLower(source.getString("command-deny"))),
+		renames: renames,
+	}
+}
+
+func matchesCommand(entries []string, redisCommand string, subcommand string, flags commandFlag) bool {
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, "@") {
+			if flag, ok := commandFlagNames[entry[1:]]; ok && flags&flag != 0 {
+				return true
+			}
+		} else if entry == redisCommand || entry == redisCommand+" "+strings.ToLower(subcommand) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns why the identity may not run the command, nil when it may.
+func (policy commandPolicy) check(redisCommand string, subcommand string, identity Identity) error {
+	redisCommand = strings.ToLower(redisCommand)
+	flags := commandFlags(redisCommand, subcommand)
+	if renamed, ok := policy.renames[redisCommand]; ok && len(renamed) == 0 {
+		return fmt.Errorf("%v is disabled on this backend", redisCommand)
+	}
+	if matchesCommand(policy.deny, redisCommand, subcommand, flags) {
+		return fmt.Errorf("%v is denied on this backend", redisCommand)
+	}
+	if len(policy.allow) > 0 && !matchesCommand(policy.allow, redisCommand, subcommand, flags) {
+		return fmt.Errorf("%v is not allowed on this backend", redisCommand)
+	}
+	adminRole := viper.GetString("admin-role")
+	if flags&flagAdmin != 0 && !identity.HasRole(adminRole) {
+		return fmt.Errorf("%v requires the %v role", redisCommand, adminRole)
+	}
+	return nil
+}
+
+// CheckCommand applies the command policy of the backend to a command run
+// on behalf of the identity.
+func (backend *Backend) CheckCommand(redisCommand string, subcommand string, identity Identity) error {
+	err := backend.policy.check(redisCommand, subcommand, identity)
+	if err != nil {
+		// Command names come from requests, keep the label set bounded.
+		label := strings.ToLower(redisCommand)
+		if _, ok := commandTable[label]; !ok {
+			label = "other"
+		}
+		commandsDeniedTotal.inc(backend.Name, label)
+	}
+	return err
+}
+
+// loadRenamedCommands reads the rename-command mapping of a backend, either
+// as a map in the config file or as "name=renamed" pairs separated by comma.
+// An empty new name marks a command disabled with rename-command "".
+func loadRenamedCommands(source settingSource) (map[string]string, error) {
+	renames := map[string]string{}
+	config := source.lookup("rename-commands")
+	if value, ok := config.Get("rename-commands").(string); ok {
+		for _, pair := range splitList(value) {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid rename-commands entry %v, expected name=renamed", pair)
+			}
+			renames[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+		}
+		return renames, nil
+	}
+	for name, renamed := range config.GetStringMapString("rename-commands") {
+		renames[strings.ToLower(name)] = renamed
+	}
+	return renames, nil
+}
+
+// renameHook sends commands under the name the backend knows them by.
+// Scripts run by gowebdis call the original names and fail on backends
+// where these are renamed.
+type renameHook struct {
+	renames map[string]string
+}
+
+func (hook renameHook) rename(cmd redis.Cmder) {
+	args := cmd.Args()
+	if renamed, ok := hook.renames[cmd.Name()]; ok && len(renamed) > 0 && len(args) > 0 {
+		args[0] = renamed
+	}
+}
+
+func (hook renameHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	hook.rename(cmd)
+	return ctx, nil
+}
+
+func (hook renameHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (hook renameHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	for _, cmd := range cmds {
+		hook.rename(cmd)
+	}
+	return ctx, nil
+}
+
+func (hook renameHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+// addRenameHook installs the rename-command mapping of the setting on a
+// client of the backend.
+func addRenameHook(client redis.UniversalClient, setting connectionSetting) {
+	if len(setting.Renames) > 0 {
+		client.AddHook(renameHook{renames: setting.Renames})
+	}
+}
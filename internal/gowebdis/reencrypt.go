@@ -0,0 +1,136 @@
+package gowebdis
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReencryptStats counts the work of Reencrypt on one backend.
+type ReencryptStats struct {
+	Keys        int
+	Fields      int
+	Reencrypted int
+	Errors      int
+}
+
+// reencryptScript replaces a field only if it still holds the value that
+// was re-encrypted, leaving concurrent writes alone.
+var reencryptScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[2] then
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+	return 1
+end
+return 0
+`)
+
+// Reencrypt encrypts the encrypted fields of the hashes of every backend
+// with the primary key of the keyring, including values stored in plaintext
+// before their field was encrypted. Keys are scanned count at a time. A
+// dry run only counts the fields to re-encrypt.
+func Reencrypt(count int64, dryRun bool) (map[string]ReencryptStats, error) {
+	if encryption == nil {
+		return nil, errors.New("field encryption is not configured, set --encryption-keyring")
+	}
+	if len(encryption.rules) == 0 {
+		return nil, errors.New("no encrypted fields configured, set --encrypted-fields")
+	}
+	results := map[string]ReencryptStats{}
+	for _, name := range BackendNames() {
+		backend := backends[name]
+		var stats ReencryptStats
+		for idx, rule := range encryption.rules {
+			var earlierPatterns []string
+			for _, earlier := range encryption.rules[:idx] {
+				earlierPatterns = append(earlierPatterns, earlier.keyPattern)
+			}
+			// Keys matching several rules are re-encrypted once.
+			if containsString(earlierPatterns, rule.keyPattern) {
+				continue
+			}
+			err := scanKeys(backend.client, rule.keyPattern, count, func(key string) {
+				if matchesPattern(earlierPatterns, key) {
+					return
+				}
+				reencryptHash(backend.client, key, dryRun, &stats)
+			})
+			if err != nil {
+				return results, fmt.Errorf("backend %v: %v", name, err)
+			}
+		}
+		log.Info(fmt.Sprintf("[INFO] Backend %v: %v keys, %v encrypted fields, %v re-encrypted, %v errors", name, stats.Keys, stats.Fields, stats.Reencrypted, stats.Errors))
+		results[name] = stats
+	}
+	return results, nil
+}
+
+// scanKeys calls fn with the keys matching the pattern, on every master of
+// cluster backends.
+func scanKeys(client redis.UniversalClient, pattern string, count int64, fn func(key string)) error {
+	scan := func(scanner redis.Cmdable) error {
+		iterator := scanner.Scan(0, pattern, count).Iterator()
+		for iterator.Next() {
+			if matchesPattern([]string{pattern}, iterator.Val()) {
+				fn(iterator.Val())
+			}
+		}
+		return iterator.Err()
+	}
+	if cluster, ok := client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(func(master *redis.Client) error {
+			return scan(master)
+		})
+	}
+	return scan(client)
+}
+
+func reencryptHash(client redis.UniversalClient, key string, dryRun bool, stats *ReencryptStats) {
+	values, err := client.HGetAll(key).Result()
+	if err != nil {
+		if !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+			stats.Errors++
+			log.Error("[ERROR] " + key + ": " + err.Error())
+		}
+		return
+	}
+	stats.Keys++
+	k := encryption.keyring
+	for field, value := range values {
+		if !encryption.encrypts(key, field) {
+			continue
+		}
+		stats.Fields++
+		if isEncrypted(value) && encryptedKeyID(value) == k.primary {
+			continue
+		}
+		plaintext := value
+		if isEncrypted(value) {
+			plaintext, err = k.decrypt(key, field, value)
+			if err != nil {
+				stats.Errors++
+				log.Error("[ERROR] Cannot decrypt field " + field + " of " + key + ": " + err.Error())
+				continue
+			}
+		}
+		if dryRun {
+			stats.Reencrypted++
+			continue
+		}
+		encrypted, err := k.encrypt(key, field, plaintext)
+		if err != nil {
+			stats.Errors++
+			log.Error("[ERROR] " + err.Error())
+			continue
+		}
+		replaced, err := reencryptScript.Run(client, []string{key}, field, value, encrypted).Int()
+		if err != nil {
+			stats.Errors++
+			log.Error("[ERROR] " + key + ": " + err.Error())
+		} else if replaced == 1 {
+			stats.Reencrypted++
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package gowebdis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// Argument types of the command registry, named after JSON Schema types.
+const (
+	TypeString  = "string"
+	TypeArray   = "array"
+	TypeBoolean = "boolean"
+	TypeInteger = "integer"
+	TypeObject  = "object"
+	// TypeJSON is any JSON value.
+	TypeJSON = "json"
+)
+
+// ArgumentSpec describes an attribute of the JSON payload of a command.
+// Arrays hold strings, objects map strings to strings.
+type ArgumentSpec struct {
+	Name        string
+	Type        string
+	Required    bool
+	Description string
+}
+
+// ResponseSpec describes the attribute holding the reply of a command.
+type ResponseSpec struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+// CommandSpec declares a command served by gowebdis. It drives the
+// OpenAPI document and, for the built-in commands, the validation of
+// payloads.
+type CommandSpec struct {
+	Name    string
+	Summary string
+	// Description details the command in the OpenAPI document.
+	Description string
+	ReadOnly    bool
+	// Internal commands are only run by the routes of gowebdis, such as
+	// the document commands run by /doc/{key} once the document is
+	// flattened. They are not served by /{command}, batches and
+	// transactions, nor documented.
+	Internal bool
+	// ReadKeys returns the keys a read-only command reads for a payload.
+	// Only commands declaring it are cached and coalesced, and their
+	// cached replies are dropped when any of the keys changes. PayloadKey
+	// suits commands reading the key of their payload only.
+	ReadKeys  func(jsonPayload JsonPayload) []string
+	Arguments []ArgumentSpec
+	Response  ResponseSpec
+}
+
+// PayloadKey returns the key of the payload, for CommandSpec.ReadKeys.
+func PayloadKey(jsonPayload JsonPayload) []string {
+	return []string{jsonPayload.Key}
+}
+
+// Command is a command served by gowebdis, either built in or added with
+// RegisterCommand. RunRedisCommand applies the command policy, the cache,
+// retries and the audit log around Execute, so a command only has to talk
+// to redis.
+type Command interface {
+	// Spec declares the command. Read-only commands may be served by
+	// replicas and retried, are served over GET, and are cached and
+	// coalesced when they declare the keys they read.
+	Spec() CommandSpec
+	// Validate checks a payload before the command runs, usually with
+	// CommandSpec.Validate.
+	Validate(jsonPayload JsonPayload) error
+	// Execute runs the command against the client of the backend selected
+	// for the key of the payload.
+	Execute(client redis.UniversalClient, jsonPayload JsonPayload, options CommandOptions) CommandResponse
+	// Encode returns the JSON reply of a successful response.
+	Encode(commandResponse CommandResponse) map[string]interface{}
+}
+
+// builtinCommand implements the commands of gowebdis itself, which can
+// also run in transactions.
+type builtinCommand struct {
+	spec    CommandSpec
+	execute func(client redis.UniversalClient, jsonPayload JsonPayload, options CommandOptions) CommandResponse
+	encode  func(commandResponse CommandResponse) map[string]interface{}
+	// queue adds the command to a MULTI/EXEC block, its reply is read by
+	// transactionResponse.
+	queue func(pipe redis.Pipeliner, jsonPayload JsonPayload) redis.Cmder
+}
+
+func (command *builtinCommand) Spec() CommandSpec {
+	return command.spec
+}
+
+func (command *builtinCommand) Validate(jsonPayload JsonPayload) error {
+	return command.spec.Validate(jsonPayload)
+}
+
+func (command *builtinCommand) Execute(client redis.UniversalClient, jsonPayload JsonPayload, options CommandOptions) CommandResponse {
+	return command.execute(client, jsonPayload, options)
+}
+
+func (command *builtinCommand) Encode(commandResponse CommandResponse) map[string]interface{} {
+	return command.encode(commandResponse)
+}
+
+var builtinCommands = []*builtinCommand{
+	{
+		spec: CommandSpec{
+			Name:    "ping",
+			Summary: "Check the connection to redis.",
+			Arguments: []ArgumentSpec{
+				{Name: "key", Type: TypeString, Required: true, Description: "Key used to route the command to a backend."},
+			},
+			Response: ResponseSpec{Name: "stringValue", Type: TypeString, Description: "PONG"},
+		},
+		execute: func(client redis.UniversalClient, jsonPayload JsonPayload, options CommandOptions) CommandResponse {
+			return pingClient(client)
+		},
+		encode: func(commandResponse CommandResponse) map[string]interface{} {
+			return map[string]interface{}{"stringValue": commandResponse.StringVal}
+		},
+		queue: func(pipe redis.Pipeliner, jsonPayload JsonPayload) redis.Cmder {
+			return pipe.Ping()
+		},
+	},
+	{
+		spec: CommandSpec{
+			Name:    "hset",
+			Summary: "Set a field of a hash.",
+			Arguments: []ArgumentSpec{
+				{Name: "key", Type: TypeString, Required: true, Description: "Key of the hash."},
+				{Name: "field", Type: TypeString, Required: true, Description: "Field to set."},
+				{Name: "value", Type: TypeString, Required: true, Description: "Value of the field."},
+			},
+			Response: ResponseSpec{Name: "boolValue", Type: TypeBoolean, Description: "Whether the field was set."},
+		},
+		execute: func(client redis.UniversalClient, jsonPayload JsonPayload, options CommandOptions) CommandResponse {
+			if len(versionField()) > 0 {
+				return hSetVersioned(client, jsonPayload.Key, jsonPayload.Field, jsonPayload.Value, options.IfMatch)
+			}
+			return hSet(client, jsonPayload.Key, jsonPayload.Field, jsonPayload.Value)
+		},
+		encode: func(commandResponse CommandResponse) map[string]interface{} {
+			return map[string]interface{}{"boolValue": commandResponse.BoolVal}
+		},
+		queue: func(pipe redis.Pipeliner, jsonPayload JsonPayload) redis.Cmder {
+			if len(versionField()) > 0 {
+				args := versionScriptArgs("", jsonPayload.Field, jsonPayload.Value)
+				return versionedHSetScript.Eval(pipe, []string{jsonPayload.Key}, args...)
+			}
+			return pipe.HSet(jsonPayload.Key, jsonPayload.Field, jsonPayload.Value)
+		},
+	},
+	{
+		spec: CommandSpec{
+			Name:     "hgetall",
+			Summary:  "Get the values of all fields of a hash, ordered by field.",
+			ReadOnly: true,
+			ReadKeys: PayloadKey,
+			Arguments: []ArgumentSpec{
+				{Name: "key", Type: TypeString, Required: true, Description: "Key of the hash."},
+			},
+			Response: ResponseSpec{Name: "stringArrayValue", Type: TypeArray, Description: "Values of the hash ordered by field."},
+		},
+		execute: func(client redis.UniversalClient, jsonPayload JsonPayload, options CommandOptions) CommandResponse {
+			if refused := checkHashLength(options.backend, client, jsonPayload.Key); refused != nil {
+				return *refused
+			}
+			return hGetAll(client, jsonPayload.Key)
+		},
+		encode: func(commandResponse CommandResponse) map[string]interface{} {
+			return map[string]interface{}{"stringArrayValue": getStringArrayValue(commandResponse.MapVal)}
+		},
+		queue: func(pipe redis.Pipeliner, jsonPayload JsonPayload) redis.Cmder {
+			return pipe.HGetAll(jsonPayload.Key)
+		},
+	},
+	{
+		spec: CommandSpec{
+			Name:    "hdel",
+			Summary: "Delete fields of a hash.",
+			Arguments: []ArgumentSpec{
+				{Name: "key", Type: TypeString, Required: true, Description: "Key of the hash."},
+				{Name: "fields", Type: TypeArray, Required: true, Description: "Fields to delete."},
+			},
+			Response: ResponseSpec{Name: "intValue", Type: TypeInteger, Description: "Number of fields deleted."},
+		},
+		execute: func(client redis.UniversalClient, jsonPayload JsonPayload, options CommandOptions) CommandResponse {
+			if len(versionField()) > 0 {
+				return hDelVersioned(client, jsonPayload.Key, jsonPayload.Fields, options.IfMatch)
+			}
+			return hDel(client, jsonPayload.Key, jsonPayload.Fields)
+		},
+		encode: func(commandResponse CommandResponse) map[string]interface{} {
+			return map[string]interface{}{"intValue": commandResponse.IntVal}
+		},
+		queue: func(pipe redis.Pipeliner, jsonPayload JsonPayload) redis.Cmder {
+			if len(versionField()) > 0 {
+				args := make([]interface{}, len(jsonPayload.Fields))
+				for idx, field := range jsonPayload.Fields {
+					args[idx] = field
+				}
+				return versionedHDelScript.Eval(pipe, []string{jsonPayload.Key}, versionScriptArgs("", args...)...)
+			}
+			return pipe.HDel(jsonPayload.Key, jsonPayload.Fields...)
+		},
+	},
+	{
+		spec: CommandSpec{
+			Name:     "docput",
+			Internal: true,
+			Summary:  "Replace a hash with the fields of a flattened JSON document, see PUT /doc/{key}.",
+			Arguments: []ArgumentSpec{
+				{Name: "key", Type: TypeString, Required: true, Description: "Key of the hash."},
+				{Name: "values", Type: TypeObject, Required: true, Description: "Fields of the document, including its types field."},
+			},
+			Response: ResponseSpec{Name: "intValue", Type: TypeInteger, Description: "Number of fields set."},
+		},
+		execute: docPut,
+		encode: func(commandResponse CommandResponse) map[string]interface{} {
+			return map[string]interface{}{"intValue": commandResponse.IntVal}
+		},
+		queue: func(pipe redis.Pipeliner, jsonPayload JsonPayload) redis.Cmder {
+			args := make([]interface{}, 0, 2*len(jsonPayload.Values))
+			for field, value := range jsonPayload.Values {
+				args = append(args, field, value)
+			}
+			return docPutScript.Eval(pipe, []string{jsonPayload.Key}, versionScriptArgs("", args...)...)
+		},
+	},
+	{
+		spec: CommandSpec{
+			Name:     "docpatch",
+			Internal: true,
+			Summary:  "Apply a compiled JSON Merge Patch to the document stored in a hash, see PATCH /doc/{key}.",
+			Arguments: []ArgumentSpec{
+				{Name: "key", Type: TypeString, Required: true, Description: "Key of the hash."},
+				{Name: "fields", Type: TypeArray, Description: "Paths deleted with their fields."},
+				{Name: "values", Type: TypeObject, Description: "Fields to set. The types field lists their types and the objects of the patch."},
+			},
+			Response: ResponseSpec{Name: "intValue", Type: TypeInteger, Description: "Number of fields set."},
+		},
+		execute: docPatch,
+		encode: func(commandResponse CommandResponse) map[string]interface{} {
+			return map[string]interface{}{"intValue": commandResponse.IntVal}
+		},
+		queue: func(pipe redis.Pipeliner, jsonPayload JsonPayload) redis.Cmder {
+			return docPatchScript.Eval(pipe, []string{jsonPayload.Key}, versionScriptArgs("", docPatchArgs(jsonPayload)...)...)
+		},
+	},
+	{
+		spec: CommandSpec{
+			Name:     "docdel",
+			Internal: true,
+			Summary:  "Delete the document stored in a hash.",
+			Arguments: []ArgumentSpec{
+				{Name: "key", Type: TypeString, Required: true, Description: "Key of the hash."},
+			},
+			Response: ResponseSpec{Name: "intValue", Type: TypeInteger, Description: "Number of documents deleted."},
+		},
+		execute: docDel,
+		encode: func(commandResponse CommandResponse) map[string]interface{} {
+			return map[string]interface{}{"intValue": commandResponse.IntVal}
+		},
+		queue: func(pipe redis.Pipeliner, jsonPayload JsonPayload) redis.Cmder {
+			return docDelScript.Eval(pipe, []string{jsonPayload.Key}, versionScriptArgs("")...)
+		},
+	},
+}
+
+// reservedCommandNames are paths of the API that cannot name a command.
+var reservedCommandNames = map[string]bool{
+	"batch":       true,
+	"transaction": true,
+}
+
+var registryMutex sync.RWMutex
+var commandRegistry []Command
+var commandsByName = map[string]Command{}
+
+func init() {
+	for _, command := range builtinCommands {
+		err := RegisterCommand(command)
+		if err != nil {
+			panic(err)
+		}
+	}
+	for _, command := range jsonCommands {
+		err := RegisterCommand(command)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterCommand adds a command to the API, served at POST /<name> and,
+// when read-only, GET /read/<name>/<key>. Names are lowercase and unique.
+func RegisterCommand(command Command) error {
+	name := command.Spec().Name
+	err := checkCommandName(name)
+	if err != nil {
+		return err
+	}
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if _, ok := commandsByName[name]; ok {
+		return fmt.Errorf("command %v is already registered", name)
+	}
+	commandRegistry = append(commandRegistry, command)
+	commandsByName[name] = command
+	return nil
+}
+
+// ValidateCommands checks that the commands can all be registered with
+// RegisterCommand, without registering them.
+func ValidateCommands(commands []Command) error {
+	names := map[string]bool{}
+	for _, command := range commands {
+		name := command.Spec().Name
+		err := checkCommandName(name)
+		if err != nil {
+			return err
+		}
+		if _, ok := LookupCommand(name); ok || names[name] {
+			return fmt.Errorf("command %v is already registered", name)
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+func checkCommandName(name string) error {
+	if len(name) == 0 || name != strings.ToLower(name) || strings.ContainsAny(name, "/ ") {
+		return fmt.Errorf("invalid command name %q", name)
+	}
+	if reservedCommandNames[name] {
+		return fmt.Errorf("command name %v is reserved", name)
+	}
+	return nil
+}
+
+// CommandSpecs returns the commands served by gowebdis in registration
+// order.
+func CommandSpecs() []CommandSpec {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	specs := make([]CommandSpec, len(commandRegistry))
+	for idx, command := range commandRegistry {
+		specs[idx] = command.Spec()
+	}
+	return specs
+}
+
+// LookupCommand returns a registered command.
+func LookupCommand(redisCommand string) (Command, bool) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	command, ok := commandsByName[redisCommand]
+	return command, ok
+}
+
+// IsReadCommand reports whether the command is read-only: read-only
+// commands are never sent to the master when a replica can serve them,
+// may be cached and coalesced when they declare their keys and are served
+// over GET.
+func IsReadCommand(redisCommand string) bool {
+	command, ok := LookupCommand(redisCommand)
+	return ok && command.Spec().ReadOnly
+}
+
+// readKeys returns the keys a read-only command declares it reads, nil for
+// other commands.
+func readKeys(redisCommand string, jsonPayload JsonPayload) []string {
+	command, ok := LookupCommand(redisCommand)
+	if !ok {
+		return nil
+	}
+	spec := command.Spec()
+	if !spec.ReadOnly || spec.ReadKeys == nil {
+		return nil
+	}
+	return spec.ReadKeys(jsonPayload)
+}
+
+// IsInternalCommand reports whether the command is only run by the routes
+// of gowebdis, see CommandSpec.Internal.
+func IsInternalCommand(redisCommand string) bool {
+	command, ok := LookupCommand(redisCommand)
+	return ok && command.Spec().Internal
+}
+
+// EncodeResponse returns the JSON reply of a successful response.
+func EncodeResponse(commandResponse CommandResponse) map[string]interface{} {
+	command, ok := LookupCommand(commandResponse.Name)
+	if !ok {
+		return nil
+	}
+	return command.Encode(commandResponse)
+}
+
+// getStringArrayValue returns the values ordered by field so that equal
+// hashes always encode to the same payload.
+func getStringArrayValue(m map[string]string) []string {
+	fields := make([]string, 0, len(m))
+	for field := range m {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	v := make([]string, len(m), len(m))
+	for idx, field := range fields {
+		v[idx] = m[field]
+	}
+	return v
+}
+
+// hasArgument reports whether the payload carries a non-empty argument.
+func (jsonPayload JsonPayload) hasArgument(name string) bool {
+	switch name {
+	case "key":
+		return len(jsonPayload.Key) > 0
+	case "field":
+		return len(jsonPayload.Field) > 0
+	case "fields":
+		return len(jsonPayload.Fields) > 0
+	case "value":
+		return len(jsonPayload.Value) > 0
+	case "values":
+		return len(jsonPayload.Values) > 0
+	case "path":
+		return len(jsonPayload.Path) > 0
+	}
+	return false
+}
+
+// Validate checks that the payload carries every required argument.
+func (spec CommandSpec) Validate(jsonPayload JsonPayload) error {
+	for _, argument := range spec.Arguments {
+		if !argument.Required || jsonPayload.hasArgument(argument.Name) {
+			continue
+		}
+		if argument.Type == TypeArray {
+			return fmt.Errorf("'%v' attribute is empty in payload", argument.Name)
+		}
+		return fmt.Errorf("'%v' attribute cannot be found in payload", argument.Name)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package gowebdis
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/spf13/viper"
+)
+
+var testRedis *miniredis.Miniredis
+
+func TestMain(m *testing.M) {
+	var err error
+	testRedis, err = miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	viper.Set("host", testRedis.Addr())
+	viper.Set("default-backend", flagsBackendName)
+	viper.Set("cache", true)
+	viper.Set("cache-max-memory", 1)
+	viper.Set("cache-fallback-ttl", 60)
+	viper.Set("coalesce", true)
+	err = RegisterCommand(&builtinCommand{
+		spec: CommandSpec{
+			Name:    "testttl",
+			Summary: "Writes nothing and returns the seconds to live of a key.",
+			Arguments: []ArgumentSpec{
+				{Name: "key", Type: TypeString, Required: true},
+			},
+			Response: ResponseSpec{Name: "value", Type: TypeInteger},
+		},
+		execute: func(client redis.UniversalClient, jsonPayload JsonPayload, options CommandOptions) CommandResponse {
+			ttl, err := client.TTL(jsonPayload.Key).Result()
+			if err != nil {
+				return failedResponse("testttl", err)
+			}
+			return CommandResponse{Success: true, IntVal: int64(ttl / time.Second)}
+		},
+		encode: func(commandResponse CommandResponse) map[string]interface{} {
+			return map[string]interface{}{"value": commandResponse.IntVal}
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	err = RegisterCommand(newTestProfile("testprofile", func(jsonPayload JsonPayload) []string {
+		return []string{jsonPayload.Key, jsonPayload.Key + ":settings"}
+	}))
+	if err != nil {
+		panic(err)
+	}
+	err = RegisterCommand(newTestProfile("testprofilenokeys", nil))
+	if err != nil {
+		panic(err)
+	}
+	err = RegisterCommand(&builtinCommand{
+		spec: CommandSpec{
+			Name:     "testhmget",
+			Summary:  "Returns the values of fields of a hash.",
+			ReadOnly: true,
+			ReadKeys: PayloadKey,
+			Arguments: []ArgumentSpec{
+				{Name: "key", Type: TypeString, Required: true},
+				{Name: "fields", Type: TypeArray, Required: true},
+			},
+			Response: ResponseSpec{Name: "value", Type: TypeObject},
+		},
+		execute: func(client redis.UniversalClient, jsonPayload JsonPayload, options CommandOptions) CommandResponse {
+			values, err := client.HMGet(jsonPayload.Key, jsonPayload.Fields...).Result()
+			if err != nil {
+				return failedResponse("testhmget", err)
+			}
+			commandResponse := CommandResponse{Success: true, MapVal: map[string]string{}}
+			for idx, field := range jsonPayload.Fields {
+				if value, ok := values[idx].(string); ok {
+					commandResponse.MapVal[field] = value
+				}
+			}
+			return commandResponse
+		},
+		encode: func(commandResponse CommandResponse) map[string]interface{} {
+			return map[string]interface{}{"value": commandResponse.MapVal}
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	err = InitConnectionSetting()
+	if err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	CloseConnection()
+	testRedis.Close()
+	os.Exit(code)
+}
+
+// newTestProfile returns a command merging a hash with its settings hash.
+func newTestProfile(name string, readKeys func(jsonPayload JsonPayload) []string) Command {
+	return &builtinCommand{
+		spec: CommandSpec{
+			Name:     name,
+			Summary:  "Returns the fields of a hash and of its settings hash.",
+			ReadOnly: true,
+			ReadKeys: readKeys,
+			Arguments: []ArgumentSpec{
+				{Name: "key", Type: TypeString, Required: true},
+			},
+			Response: ResponseSpec{Name: "value", Type: TypeObject},
+		},
+		execute: func(client redis.UniversalClient, jsonPayload JsonPayload, options CommandOptions) CommandResponse {
+			profile, err := client.HGetAll(jsonPayload.Key).Result()
+			if err != nil {
+				return failedResponse(name, err)
+			}
+			settings, err := client.HGetAll(jsonPayload.Key + ":settings").Result()
+			if err != nil {
+				return failedResponse(name, err)
+			}
+			for field, value := range settings {
+				profile[field] = value
+			}
+			return CommandResponse{Success: true, MapVal: profile}
+		},
+		encode: func(commandResponse CommandResponse) map[string]interface{} {
+			return map[string]interface{}{"value": commandResponse.MapVal}
+		},
+	}
+}
+
+func TestRegisterCommandRejectsInvalidNames(t *testing.T) {
+	for _, name := range []string{"", "HSet", "a/b", "a b", "batch", "transaction", "hset", "testhmget"} {
+		err := RegisterCommand(&builtinCommand{spec: CommandSpec{Name: name}})
+		if err == nil {
+			t.Errorf("RegisterCommand(%q) succeeded", name)
+		}
+	}
+}
+
+func TestCommandSpecsKeepRegistrationOrder(t *testing.T) {
+	specs := CommandSpecs()
+	if len(specs) == 0 || specs[0].Name != "ping" {
+		t.Fatalf("first command is not ping: %v", specs)
+	}
+	if last := specs[len(specs)-1].Name; last != "testhmget" {
+		t.Errorf("last command is %v, want testhmget", last)
+	}
+	if _, ok := LookupCommand("testhmget"); !ok {
+		t.Error("testhmget is not registered")
+	}
+	if !IsReadCommand("testhmget") || !IsReadCommand("hgetall") || IsReadCommand("hset") {
+		t.Error("IsReadCommand does not follow the specs")
+	}
+	if IsReadCommand("unknown") {
+		t.Error("unknown command is read-only")
+	}
+}
+
+func TestSpecValidateRequiresArguments(t *testing.T) {
+	command, _ := LookupCommand("testhmget")
+	if err := command.Validate(JsonPayload{Key: "user:1"}); err == nil {
+		t.Error("payload without fields validated")
+	}
+	if err := command.Validate(JsonPayload{Key: "user:1", Fields: []string{"name"}}); err != nil {
+		t.Errorf("valid payload rejected: %v", err)
+	}
+}
+
+func TestRunCustomCommand(t *testing.T) {
+	testRedis.HSet("user:1", "name", "ada", "email", "ada@example.com")
+	backend, err := ResolveBackend("", "user:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commandResponse := RunRedisCommand(backend, "testhmget", JsonPayload{Key: "user:1", Fields: []string{"name"}}, CommandOptions{})
+	if !commandResponse.Success {
+		t.Fatalf("testhmget failed: %v", commandResponse.ErrorMessage)
+	}
+	if commandResponse.Name != "testhmget" {
+		t.Errorf("response name is %v", commandResponse.Name)
+	}
+	encoded := EncodeResponse(commandResponse)
+	value, ok := encoded["value"].(map[string]string)
+	if !ok || value["name"] != "ada" || len(value) != 1 {
+		t.Errorf("encoded reply is %v", encoded)
+	}
+}
+
+func TestCachedReadsKeyOnFields(t *testing.T) {
+	testRedis.HSet("user:2", "name", "grace", "email", "grace@example.com")
+	backend, err := ResolveBackend("", "user:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backend.cache == nil || !backend.coalesce {
+		t.Fatal("cache and coalescing are not enabled")
+	}
+	for _, field := range []string{"name", "email", "name"} {
+		commandResponse := RunRedisCommand(backend, "testhmget", JsonPayload{Key: "user:2", Fields: []string{field}}, CommandOptions{})
+		value, ok := commandResponse.MapVal[field]
+		if !commandResponse.Success || !ok || len(commandResponse.MapVal) != 1 {
+			t.Fatalf("testhmget of %v returned %v", field, commandResponse.MapVal)
+		}
+		if want := testRedis.HGet("user:2", field); value != want {
+			t.Errorf("testhmget of %v returned %v, want %v", field, value, want)
+		}
+	}
+	if cacheKey("testhmget", JsonPayload{Key: "user:2", Fields: []string{"name"}}) == cacheKey("testhmget", JsonPayload{Key: "user:2", Fields: []string{"email"}}) {
+		t.Error("cache keys of different fields are equal")
+	}
+}
+
+// TestCachedReadsKeyOnReadKeys checks that replies of a command reading
+// several hashes are dropped on writes to any of them, and that commands
+// not declaring their keys are neither cached nor coalesced.
+func TestCachedReadsKeyOnReadKeys(t *testing.T) {
+	testRedis.HSet("profile:1", "name", "ada")
+	testRedis.HSet("profile:1:settings", "theme", "dark")
+	backend, err := ResolveBackend("", "profile:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := func(command string) map[string]string {
+		commandResponse := RunRedisCommand(backend, command, JsonPayload{Key: "profile:1"}, CommandOptions{})
+		if !commandResponse.Success {
+			t.Fatalf("%v failed: %v", command, commandResponse.ErrorMessage)
+		}
+		return commandResponse.MapVal
+	}
+
+	profile("testprofile")
+	testRedis.HSet("profile:1", "name", "grace")
+	if name := profile("testprofile")["name"]; name != "ada" {
+		t.Errorf("testprofile was not cached, read name %v", name)
+	}
+	commandResponse := RunRedisCommand(backend, "hset", JsonPayload{Key: "profile:1:settings", Field: "theme", Value: "light"}, CommandOptions{})
+	if !commandResponse.Success {
+		t.Fatal(commandResponse.ErrorMessage)
+	}
+	if value := profile("testprofile"); value["theme"] != "light" || value["name"] != "grace" {
+		t.Errorf("testprofile after a write of its settings returned %v", value)
+	}
+
+	if !backend.coalesces("testprofile") || backend.coalesces("testprofilenokeys") {
+		t.Error("coalescing does not follow the read keys of the commands")
+	}
+	profile("testprofilenokeys")
+	testRedis.HSet("profile:1:settings", "theme", "dark")
+	if theme := profile("testprofilenokeys")["theme"]; theme != "dark" {
+		t.Errorf("testprofilenokeys was cached, read theme %v", theme)
+	}
+}
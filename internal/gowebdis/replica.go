@@ -0,0 +1,288 @@
+package gowebdis
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	log "github.com/sirupsen/logrus"
+)
+
+// Read policies decide where read-only commands are sent:
+//
+//	master-only        every command goes to the master (default)
+//	replica-preferred  reads are spread over healthy replicas, the master is
+//	                   used when none is available
+//	latency-based      reads go to the node with the lowest ping latency,
+//	                   master included
+const (
+	readPolicyMasterOnly       = "master-only"
+	readPolicyReplicaPreferred = "replica-preferred"
+	readPolicyLatencyBased     = "latency-based"
+)
+
+var replicaHealthy = newGauge("gowebdis_replica_healthy", "Whether the replica is eligible for reads.", "backend", "replica")
+var readsTotal = newCounter("gowebdis_reads_total", "Number of read commands by the node type serving them.", "backend", "target")
+
+type replica struct {
+	addr    string
+	client  *redis.Client
+	latency time.Duration
+	healthy bool
+}
+
+// replicaSet tracks the replicas of a backend. Replicas are either listed
+// with replica-address or discovered through Sentinel, and are checked
+// every replica-check-interval for reachability and replication lag.
+type replicaSet struct {
+	backendName string
+	policy      string
+	setting     connectionSetting
+	staticAddrs []string
+	maxLag      int
+
+	mutex         sync.RWMutex
+	replicas      map[string]*replica
+	healthy       []*replica
+	masterLatency time.Duration
+	next          uint32
+
+	stopCh chan struct{}
+}
+
+func newReplicaSet(backendName string, source settingSource, setting connectionSetting) (*replicaSet, error) {
+	policy := source.getString("read-policy")
+	switch policy {
+	case "", readPolicyMasterOnly:
+		return nil, nil
+	case readPolicyReplicaPreferred, readPolicyLatencyBased:
+	default:
+		return nil, fmt.Errorf("unsupported read policy %v", policy)
+	}
+
+	set := &replicaSet{
+		backendName: backendName,
+		policy:      policy,
+		setting:     setting,
+		staticAddrs: splitList(source.getString("replica-address")),
+		maxLag:      source.getInt("max-replication-lag"),
+		replicas:    map[string]*replica{},
+		stopCh:      make(chan struct{}),
+	}
+	switch setting.Mode {
+	case "cluster":
+		return nil, fmt.Errorf("read policy %v is not supported in cluster mode", policy)
+	case "host":
+		if len(set.staticAddrs) == 0 {
+			return nil, fmt.Errorf("read policy %v requires replica-address in standalone mode", policy)
+		}
+	}
+	return set, nil
+}
+
+func (set *replicaSet) start(master redis.UniversalClient, interval time.Duration) {
+	set.refresh(master)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				set.refresh(master)
+			case <-set.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (set *replicaSet) stop() {
+	close(set.stopCh)
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	for addr, r := range set.replicas {
+		r.client.Close()
+		delete(set.replicas, addr)
+	}
+	set.healthy = nil
+}
+
+func (set *replicaSet) refresh(master redis.UniversalClient) {
+	addrs := set.staticAddrs
+	if len(addrs) == 0 {
+		discovered, err := set.discover()
+		if err != nil {
+			log.Error("[ERROR] Cannot discover replicas of backend " + set.backendName + ": " + err.Error())
+			return
+		}
+		addrs = discovered
+	}
+
+	set.mutex.Lock()
+	current := map[string]bool{}
+	for _, addr := range addrs {
+		current[addr] = true
+		if _, ok := set.replicas[addr]; !ok {
+			setting := set.setting
+			setting.Mode = "host"
+			setting.Network = "tcp"
+			setting.Addrs = []string{addr}
+			options := newHostOptions(setting)
+			client := redis.NewClient(&options)
+			addRenameHook(client, setting)
+			set.replicas[addr] = &replica{addr: addr, client: client}
+			log.Info("[INFO] Added replica " + addr + " to backend " + set.backendName)
+		}
+	}
+	for addr, r := range set.replicas {
+		if !current[addr] {
+			r.client.Close()
+			delete(set.replicas, addr)
+			replicaHealthy.set(0, set.backendName, addr)
+			log.Info("[INFO] Removed replica " + addr + " from backend " + set.backendName)
+		}
+	}
+	replicas := make([]*replica, 0, len(set.replicas))
+	for _, r := range set.replicas {
+		replicas = append(replicas, r)
+	}
+	set.mutex.Unlock()
+
+	masterLatency, _ := measureLatency(master)
+	results := make([]replica, len(replicas))
+	for idx, r := range replicas {
+		results[idx] = set.check(r)
+	}
+
+	var healthy []*replica
+	set.mutex.Lock()
+	set.masterLatency = masterLatency
+	for idx, r := range replicas {
+		r.latency = results[idx].latency
+		r.healthy = results[idx].healthy
+		if r.healthy {
+			healthy = append(healthy, r)
+			replicaHealthy.set(1, set.backendName, r.addr)
+		} else {
+			replicaHealthy.set(0, set.backendName, r.addr)
+		}
+	}
+	sort.Slice(healthy, func(i, j int) bool {
+		return healthy[i].addr < healthy[j].addr
+	})
+	set.healthy = healthy
+	set.mutex.Unlock()
+}
+
+// discover asks the sentinels for the replicas of the master, skipping
+// replicas that are down or disconnected.
+func (set *replicaSet) discover() ([]string, error) {
+	var lastErr error
+	for _, sentinelAddr := range set.setting.Addrs {
+		sentinel := redis.NewSentinelClient(&redis.Options{
+			Addr:        sentinelAddr,
+			Password:    set.setting.SentinelPassword,
+			DialTimeout: 5 * time.Second,
+			TLSConfig:   set.setting.TLSConfig,
+		})
+		result, err := sentinel.Slaves(set.setting.MasterName).Result()
+		sentinel.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var addrs []string
+		for _, item := range result {
+			fields, ok := item.([]interface{})
+			if !ok {
+				continue
+			}
+			info := map[string]string{}
+			for idx := 0; idx+1 < len(fields); idx += 2 {
+				info[fmt.Sprint(fields[idx])] = fmt.Sprint(fields[idx+1])
+			}
+			flags := info["flags"]
+			if strings.Contains(flags, "s_down") || strings.Contains(flags, "o_down") || strings.Contains(flags, "disconnected") {
+				continue
+			}
+			addrs = append(addrs, info["ip"]+":"+info["port"])
+		}
+		return addrs, nil
+	}
+	return nil, lastErr
+}
+
+func (set *replicaSet) check(r *replica) replica {
+	result := replica{addr: r.addr}
+	latency, err := measureLatency(r.client)
+	if err != nil {
+		return result
+	}
+	result.latency = latency
+
+	info, err := r.client.Info("replication").Result()
+	if err != nil {
+		return result
+	}
+	replication := parseInfo(info)
+	if replication["master_link_status"] != "up" || replication["master_sync_in_progress"] == "1" {
+		return result
+	}
+	if set.maxLag > -1 {
+		lag, err := strconv.Atoi(replication["master_last_io_seconds_ago"])
+		if err != nil || lag > set.maxLag {
+			return result
+		}
+	}
+	result.healthy = true
+	return result
+}
+
+func measureLatency(client redis.UniversalClient) (time.Duration, error) {
+	start := time.Now()
+	err := client.Ping().Err()
+	return time.Since(start), err
+}
+
+func parseInfo(info string) map[string]string {
+	values := map[string]string{}
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if idx := strings.Index(line, ":"); idx > 0 && !strings.HasPrefix(line, "#") {
+			values[line[:idx]] = line[idx+1:]
+		}
+	}
+	return values
+}
+
+// pick returns the client that should serve the next read.
+func (set *replicaSet) pick(master redis.UniversalClient) (redis.UniversalClient, bool) {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	healthy := set.healthy
+	if len(healthy) == 0 {
+		return master, false
+	}
+
+	if set.policy == readPolicyLatencyBased {
+		best := healthy[0]
+		for _, r := range healthy[1:] {
+			if r.latency < best.latency {
+				best = r
+			}
+		}
+		if set.masterLatency > 0 && set.masterLatency <= best.latency {
+			return master, false
+		}
+		return best.client, true
+	}
+	idx := atomic.AddUint32(&set.next, 1)
+	return healthy[int(idx)%len(healthy)].client, true
+}
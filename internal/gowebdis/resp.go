@@ -0,0 +1,148 @@
+package gowebdis
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// respConn is a bare RESP2 connection for the few places where go-redis
+// cannot be used, such as receiving client tracking invalidation messages
+// whose payload is an array.
+type respConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	renames map[string]string
+}
+
+type respError string
+
+func (err respError) Error() string {
+	return string(err)
+}
+
+func dialResp(setting connectionSetting, network string, addr string) (*respConn, error) {
+	timeout := 5 * time.Second
+	if setting.DialTimeout > 0 {
+		timeout = seconds(setting.DialTimeout)
+	}
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if setting.TLSConfig != nil {
+		config := setting.TLSConfig.Clone()
+		if len(config.ServerName) == 0 {
+			host, _, _ := net.SplitHostPort(addr)
+			config.ServerName = host
+		}
+		tlsConn := tls.Client(conn, config)
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		err = tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+
+	c := &respConn{conn: conn, reader: bufio.NewReader(conn), renames: setting.Renames}
+	if len(setting.Username) > 0 {
+		_, err = c.do("AUTH", setting.Username, setting.Password)
+	} else if len(setting.Password) > 0 {
+		_, err = c.do("AUTH", setting.Password)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *respConn) close() error {
+	return c.conn.Close()
+}
+
+func (c *respConn) write(args ...string) error {
+	if renamed, ok := c.renames[strings.ToLower(args[0])]; ok && len(renamed) > 0 {
+		args[0] = renamed
+	}
+	buffer := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buffer = append(buffer, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buffer = append(buffer, arg...)
+		buffer = append(buffer, "\r\n"...)
+	}
+	_, err := c.conn.Write(buffer)
+	return err
+}
+
+func (c *respConn) do(args ...string) (interface{}, error) {
+	err := c.write(args...)
+	if err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read returns a string, an int64, nil or an []interface{} of those. Error
+// replies are returned as respError.
+func (c *respConn) read() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed RESP reply")
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, respError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buffer := make([]byte, size+2)
+		_, err = io.ReadFull(c.reader, buffer)
+		if err != nil {
+			return nil, err
+		}
+		return string(buffer[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, size)
+		for idx := range items {
+			items[idx], err = c.read()
+			if err != nil {
+				if _, ok := err.(respError); !ok {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected RESP type %q", line[0])
+}
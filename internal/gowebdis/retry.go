@@ -0,0 +1,91 @@
+package gowebdis
+
+import (
+	"time"
+)
+
+var retriesTotal = newCounter("gowebdis_retries_total", "Number of commands sent again after a connection failure.", "backend", "command")
+
+// idempotentCommands leave redis in the same state however many times they
+// are applied, so they are sent again after a connection failure: the
+// first attempt may or may not have reached redis. Other commands are
+// never retried by gowebdis, clients retry them safely with an
+// Idempotency-Key.
+var idempotentCommands = map[string]bool{
+	"ping":    true,
+	"hgetall": true,
+	"hset":    true,
+	"hdel":    true,
+}
+
+// isIdempotent reports whether the command may be retried. Versioned hash
+// writes are not idempotent since each of them bumps the version, other
+// read-only commands always are.
+func isIdempotent(redisCommand string) bool {
+	if (redisCommand == "hset" || redisCommand == "hdel") && len(versionField()) > 0 {
+		return false
+	}
+	return idempotentCommands[redisCommand] || IsReadCommand(redisCommand)
+}
+
+// retryPolicy replaces the retries of go-redis, which do not know whether
+// a command is safe to send twice.
+type retryPolicy struct {
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+func newRetryPolicy(setting connectionSetting) retryPolicy {
+	// Same defaults as go-redis.
+	policy := retryPolicy{
+		minBackoff: 8 * time.Millisecond,
+		maxBackoff: 512 * time.Millisecond,
+	}
+	if setting.MaxRetries > 0 {
+		policy.maxRetries = setting.MaxRetries
+	}
+	if setting.MinRetryBackoff > -1 {
+		policy.minBackoff = seconds(setting.MinRetryBackoff)
+	}
+	if setting.MaxRetryBackoff > -1 {
+		policy.maxBackoff = seconds(setting.MaxRetryBackoff)
+	}
+	return policy
+}
+
+// backoff doubles the wait before each retry up to the maximum backoff.
+func (policy retryPolicy) backoff(retry int) time.Duration {
+	backoff := policy.minBackoff
+	for i := 1; i < retry && backoff < policy.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > policy.maxBackoff {
+		backoff = policy.maxBackoff
+	}
+	return backoff
+}
+
+// runCommand sends the command to redis unless the circuit breaker is
+// open, retrying idempotent commands after connection failures.
+func runCommand(backend *Backend, redisCommand string, jsonPayload JsonPayload, options CommandOptions) CommandResponse {
+	attempts := 1
+	if isIdempotent(redisCommand) {
+		attempts += backend.retry.maxRetries
+	}
+	var commandResponse CommandResponse
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backend.retry.backoff(attempt))
+			retriesTotal.inc(backend.Name, redisCommand)
+		}
+		if !backend.breaker.allow() {
+			return unavailableResponse(backend, redisCommand)
+		}
+		commandResponse = executeCommand(backend, redisCommand, jsonPayload, options)
+		if commandResponse.ErrorCode != ErrorCodeUnavailable {
+			break
+		}
+	}
+	return checkReplyLimits(backend, commandResponse)
+}
@@ -0,0 +1,469 @@
+package gowebdis
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// schemaHookOrder validates writes after the hooks that change them and
+// before compression and encryption encode their values.
+const schemaHookOrder = compressionHookOrder - 1
+
+var schemaViolationsTotal = newCounter("gowebdis_schema_violations_total", "Number of hash writes refused because they violate the schema of their key.", "schema", "command")
+
+// Field types of schemas. Hash values are strings, the types constrain
+// their text.
+const (
+	schemaTypeString  = "string"
+	schemaTypeInteger = "integer"
+	schemaTypeNumber  = "number"
+	schemaTypeBoolean = "boolean"
+)
+
+var jsonNumberPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// fieldSchema constrains the value of a hash field. An empty type accepts
+// any text, enum values are compared with the text of the value and
+// maxLength counts characters.
+type fieldSchema struct {
+	valueType string
+	enum      []string
+	maxLength int
+	required  bool
+}
+
+// hashSchema lists the fields of the hashes whose key matches keyPattern.
+type hashSchema struct {
+	name             string
+	keyPattern       string
+	fields           map[string]*fieldSchema
+	additionalFields bool
+}
+
+// schemaValidation refuses hash writes that would leave a hash violating
+// the schema of its key with 422: unknown fields, values of the wrong type,
+// outside the enum or too long, and missing required fields. Documents are
+// validated on their flattened fields. hset writes a single field, so
+// hashes built with it are not checked for required fields, which can only
+// not be deleted; docput must carry them all, and docpatch those neither
+// the patch nor the hash holds, read just ahead of the write, not
+// atomically with it.
+type schemaValidation struct {
+	schemas []*hashSchema
+}
+
+var schemaValidator *schemaValidation
+
+// initSchemaValidation enables validation when --schemas binds schema
+// files to key patterns.
+func initSchemaValidation() error {
+	schemas, err := loadSchemas(viper.GetString("schemas"))
+	if err != nil || len(schemas) == 0 {
+		return err
+	}
+	schemaValidator = &schemaValidation{schemas: schemas}
+	return AddHook(Hook{
+		Order:    schemaHookOrder,
+		Commands: []string{"hset", "hdel", "docput", "docpatch"},
+		Before:   schemaValidator,
+	})
+}
+
+// loadSchemas reads "key-pattern=file" pairs separated by comma, the first
+// matching pattern wins.
+func loadSchemas(value string) ([]*hashSchema, error) {
+	var schemas []*hashSchema
+	for _, pair := range splitList(value) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("invalid schemas entry %v, expected key-pattern=file", pair)
+		}
+		schema, err := loadSchemaFile(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("schema %v: %v", parts[1], err)
+		}
+		schema.keyPattern = parts[0]
+		schemas = append(schemas, schema)
+		log.Info("[INFO] Validating writes of " + parts[0] + " with schema " + schema.name)
+	}
+	return schemas, nil
+}
+
+// loadSchemaFile reads a schema in JSON or YAML, either a JSON Schema of
+// an object whose properties are the fields of the hash:
+//
+//	{
+//	  "type": "object",
+//	  "properties": {
+//	    "name": {"type": "string", "maxLength": 64},
+//	    "status": {"enum": ["active", "banned"]}
+//	  },
+//	  "required": ["name"],
+//	  "additionalProperties": false
+//	}
+//
+// or a type map, which only allows the fields it lists unless
+// additionalFields is true:
+//
+//	fields:
+//	  name: {type: string, maxLength: 64, required: true}
+//	  age: integer
+//	  status: {enum: [active, banned]}
+func loadSchemaFile(path string) (*hashSchema, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var document interface{}
+	err = yaml.Unmarshal(content, &document)
+	if err != nil {
+		return nil, err
+	}
+	root, ok := stringKeys(document).(map[string]interface{})
+	if !ok {
+		return nil, errors.New("expected an object")
+	}
+	schema := &hashSchema{name: filepath.Base(path), fields: map[string]*fieldSchema{}}
+	if _, ok := root["properties"]; ok {
+		err = schema.loadJSONSchema(root)
+	} else if _, ok := root["fields"]; ok {
+		err = schema.loadTypeMap(root)
+	} else {
+		err = errors.New("expected a JSON Schema with properties or a type map with fields")
+	}
+	return schema, err
+}
+
+// stringKeys turns the maps decoded by yaml into maps keyed by string.
+func stringKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = stringKeys(item)
+		}
+		return m
+	case []interface{}:
+		for idx, item := range v {
+			v[idx] = stringKeys(item)
+		}
+	}
+	return value
+}
+
+// Annotation keywords of JSON Schema, which do not constrain values.
+var schemaAnnotations = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"$comment":    true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+}
+
+func (schema *hashSchema) loadJSONSchema(root map[string]interface{}) error {
+	schema.additionalFields = true
+	for keyword, value := range root {
+		switch {
+		case schemaAnnotations[keyword]:
+		case keyword == "type":
+			if value != "object" {
+				return errors.New("type must be object, the hash")
+			}
+		case keyword == "properties":
+			properties, ok := value.(map[string]interface{})
+			if !ok {
+				return errors.New("properties must be an object")
+			}
+			for field, property := range properties {
+				definition, ok := property.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("property %v must be an object", field)
+				}
+				constraints, err := loadFieldSchema(definition, false)
+				if err != nil {
+					return fmt.Errorf("property %v: %v", field, err)
+				}
+				// required may have been read first.
+				constraints.required = schema.fields[field] != nil && schema.fields[field].required
+				schema.fields[field] = constraints
+			}
+		case keyword == "required":
+			required, ok := value.([]interface{})
+			if !ok {
+				return errors.New("required must be an array")
+			}
+			for _, field := range required {
+				name, ok := field.(string)
+				if !ok {
+					return errors.New("required must list field names")
+				}
+				if schema.fields[name] == nil {
+					schema.fields[name] = &fieldSchema{}
+				}
+				schema.fields[name].required = true
+			}
+		case keyword == "additionalProperties":
+			allowed, ok := value.(bool)
+			if !ok {
+				return errors.New("additionalProperties must be true or false")
+			}
+			schema.additionalFields = allowed
+		default:
+			return fmt.Errorf("keyword %v is not supported", keyword)
+		}
+	}
+	return nil
+}
+
+func (schema *hashSchema) loadTypeMap(root map[string]interface{}) error {
+	for keyword, value := range root {
+		switch keyword {
+		case "fields":
+			fields, ok := value.(map[string]interface{})
+			if !ok {
+				return errors.New("fields must map field names to types")
+			}
+			for field, definition := range fields {
+				var constraints *fieldSchema
+				var err error
+				switch d := definition.(type) {
+				case string:
+					constraints, err = loadFieldSchema(map[string]interface{}{"type": d}, true)
+				case map[string]interface{}:
+					constraints, err = loadFieldSchema(d, true)
+				default:
+					err = errors.New("expected a type or an object")
+				}
+				if err != nil {
+					return fmt.Errorf("field %v: %v", field, err)
+				}
+				schema.fields[field] = constraints
+			}
+		case "additionalFields":
+			allowed, ok := value.(bool)
+			if !ok {
+				return errors.New("additionalFields must be true or false")
+			}
+			schema.additionalFields = allowed
+		default:
+			return fmt.Errorf("%v is not supported, expected fields or additionalFields", keyword)
+		}
+	}
+	return nil
+}
+
+// loadFieldSchema reads the constraints of a field, typeMap allowing the
+// required flag of type maps.
+func loadFieldSchema(definition map[string]interface{}, typeMap bool) (*fieldSchema, error) {
+	constraints := &fieldSchema{}
+	for keyword, value := range definition {
+		switch {
+		case schemaAnnotations[keyword]:
+		case keyword == "type":
+			constraints.valueType, _ = value.(string)
+			switch constraints.valueType {
+			case schemaTypeString, schemaTypeInteger, schemaTypeNumber, schemaTypeBoolean:
+			default:
+				return nil, fmt.Errorf("type %v is not supported, expected string, integer, number or boolean", value)
+			}
+		case keyword == "enum":
+			values, ok := value.([]interface{})
+			if !ok || len(values) == 0 {
+				return nil, errors.New("enum must be a non-empty array")
+			}
+			for _, item := range values {
+				switch item.(type) {
+				case map[string]interface{}, []interface{}, nil:
+					return nil, errors.New("enum values must be strings, numbers or booleans")
+				}
+				constraints.enum = append(constraints.enum, fmt.Sprint(item))
+			}
+		case keyword == "maxLength":
+			maxLength, ok := value.(int)
+			if !ok || maxLength <= 0 {
+				return nil, errors.New("maxLength must be a positive integer")
+			}
+			constraints.maxLength = maxLength
+		case keyword == "required" && typeMap:
+			required, ok := value.(bool)
+			if !ok {
+				return nil, errors.New("required must be true or false")
+			}
+			constraints.required = required
+		default:
+			return nil, fmt.Errorf("keyword %v is not supported", keyword)
+		}
+	}
+	return constraints, nil
+}
+
+func (v *schemaValidation) schema(key string) *hashSchema {
+	for _, schema := range v.schemas {
+		if matchesPattern([]string{schema.keyPattern}, key) {
+			return schema
+		}
+	}
+	return nil
+}
+
+func (v *schemaValidation) BeforeExecute(call *Call) *CommandResponse {
+	payload := &call.JsonPayload
+	schema := v.schema(payload.Key)
+	if schema == nil {
+		return nil
+	}
+	var violations []string
+	switch call.Command {
+	case "hset":
+		violations = schema.checkValues(map[string]string{payload.Field: payload.Value})
+	case "hdel":
+		violations = schema.checkDeleted(payload.Fields, nil)
+	case "docput":
+		violations = schema.checkValues(payload.Values)
+		for _, field := range schema.missingRequired(payload.Values) {
+			violations = append(violations, fmt.Sprintf("field %q is required", field))
+		}
+	case "docpatch":
+		// Fields set by the patch are deleted first.
+		violations = schema.checkValues(payload.Values)
+		violations = append(violations, schema.checkDeleted(payload.Fields, payload.Values)...)
+		violations = append(violations, v.checkRequired(call, schema, payload.Values, payload.Fields)...)
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	sort.Strings(violations)
+	schemaViolationsTotal.inc(schema.name, call.Command)
+	commandResponse := CommandResponse{Name: call.Command}
+	commandResponse.Success = false
+	commandResponse.ErrorCode = ErrorCodeUnprocessable
+	commandResponse.ErrorMessage = payload.Key + " violates schema " + schema.name + ": " + strings.Join(violations, "; ")
+	log.Error("[ERROR] " + commandResponse.ErrorMessage)
+	return &commandResponse
+}
+
+// checkValues describes how the written values violate the schema.
+func (schema *hashSchema) checkValues(values map[string]string) []string {
+	var violations []string
+	for field, value := range values {
+		constraints := schema.fields[field]
+		if constraints == nil {
+			if !schema.additionalFields && field != versionField() && field != docTypesField() {
+				violations = append(violations, fmt.Sprintf("field %q is not allowed", field))
+			}
+			continue
+		}
+		if violation := constraints.check(value); len(violation) > 0 {
+			violations = append(violations, fmt.Sprintf("field %q %v", field, violation))
+		}
+	}
+	return violations
+}
+
+func (field *fieldSchema) check(value string) string {
+	switch field.valueType {
+	case schemaTypeInteger:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Sprintf("must be an integer, got %q", value)
+		}
+	case schemaTypeNumber:
+		if !jsonNumberPattern.MatchString(value) {
+			return fmt.Sprintf("must be a number, got %q", value)
+		}
+	case schemaTypeBoolean:
+		if value != "true" && value != "false" {
+			return fmt.Sprintf("must be true or false, got %q", value)
+		}
+	}
+	if len(field.enum) > 0 && !containsString(field.enum, value) {
+		return fmt.Sprintf("must be one of %v, got %q", strings.Join(field.enum, ", "), value)
+	}
+	if field.maxLength > 0 && utf8.RuneCountInString(value) > field.maxLength {
+		return fmt.Sprintf("must be at most %v characters long, got %v", field.maxLength, utf8.RuneCountInString(value))
+	}
+	return ""
+}
+
+// checkDeleted describes the required fields deleted with the paths, the
+// fields of documents included, unless values sets them again.
+func (schema *hashSchema) checkDeleted(paths []string, values map[string]string) []string {
+	var violations []string
+	for field, constraints := range schema.fields {
+		if _, ok := values[field]; constraints.required && !ok && isDeletedPath(field, paths) {
+			violations = append(violations, fmt.Sprintf("field %q is required and cannot be deleted", field))
+		}
+	}
+	return violations
+}
+
+func isDeletedPath(field string, paths []string) bool {
+	for _, path := range paths {
+		if field == path || strings.HasPrefix(field, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// missingRequired lists the required fields values does not hold.
+func (schema *hashSchema) missingRequired(values map[string]string) []string {
+	var missing []string
+	for field, constraints := range schema.fields {
+		if _, ok := values[field]; constraints.required && !ok {
+			missing = append(missing, field)
+		}
+	}
+	return missing
+}
+
+// checkRequired describes the required fields that neither the patch nor
+// the hash holds, leaving out those the patch deletes, which checkDeleted
+// reports. The hash is read with HMGET ahead of the write, outside of it:
+// gowebdis refuses deletes of required fields, but a required field
+// deleted in between by docdel, a json command or another redis client is
+// missed and the write goes through.
+func (v *schemaValidation) checkRequired(call *Call, schema *hashSchema, values map[string]string, deleted []string) []string {
+	var missing []string
+	for _, field := range schema.missingRequired(values) {
+		if !isDeletedPath(field, deleted) {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	backend := backends[call.Backend]
+	if backend != nil && backend.client != nil {
+		existing, err := backend.client.HMGet(call.JsonPayload.Key, missing...).Result()
+		if err != nil {
+			// Redis will answer the write the same way.
+			log.Error("[ERROR] Cannot read required fields of " + call.JsonPayload.Key + ": " + err.Error())
+			return nil
+		}
+		var stillMissing []string
+		for idx, field := range missing {
+			if existing[idx] == nil {
+				stillMissing = append(stillMissing, field)
+			}
+		}
+		missing = stillMissing
+	}
+	violations := make([]string, len(missing))
+	for idx, field := range missing {
+		violations[idx] = fmt.Sprintf("field %q is required", field)
+	}
+	return violations
+}
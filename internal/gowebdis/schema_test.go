@@ -0,0 +1,154 @@
+package gowebdis
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+const testJSONSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "type": "object",
+  "properties": {
+    "name": {"type": "string", "maxLength": 5},
+    "age": {"type": "integer"},
+    "ratio": {"type": "number"},
+    "admin": {"type": "boolean"},
+    "status": {"enum": ["active", "banned"]},
+    "address.city": {"type": "string"}
+  },
+  "required": ["name", "address.city"],
+  "additionalProperties": false
+}`
+
+const testTypeMap = `fields:
+  name: {type: string, maxLength: 5, required: true}
+  age: integer
+  ratio: number
+  admin: boolean
+  status: {enum: [active, banned]}
+  address.city: {type: string, required: true}
+`
+
+// loadTestSchemas binds user:* to the JSON Schema and member:* to the type
+// map, which describe the same hashes.
+func loadTestSchemas(t *testing.T) *schemaValidation {
+	dir, err := ioutil.TempDir("", "schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jsonSchema := filepath.Join(dir, "user.json")
+	typeMap := filepath.Join(dir, "member.yaml")
+	if err := ioutil.WriteFile(jsonSchema, []byte(testJSONSchema), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(typeMap, []byte(testTypeMap), 0600); err != nil {
+		t.Fatal(err)
+	}
+	schemas, err := loadSchemas("user:*=" + jsonSchema + ",member:*=" + typeMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &schemaValidation{schemas: schemas}
+}
+
+// schemaViolation returns the message of the 422 refusing the command, or
+// nothing when the command is accepted.
+func schemaViolation(v *schemaValidation, command string, payload JsonPayload) string {
+	commandResponse := v.BeforeExecute(&Call{Backend: flagsBackendName, Command: command, JsonPayload: payload})
+	if commandResponse == nil || commandResponse.ErrorCode != ErrorCodeUnprocessable {
+		return ""
+	}
+	return commandResponse.ErrorMessage
+}
+
+func refusedBySchema(v *schemaValidation, command string, payload JsonPayload) bool {
+	return len(schemaViolation(v, command, payload)) > 0
+}
+
+func TestSchemaValues(t *testing.T) {
+	v := loadTestSchemas(t)
+	tests := []struct {
+		field   string
+		value   string
+		refused bool
+	}{
+		{"name", "ada", false},
+		{"name", "héllo", false},
+		{"name", "lovelace", true},
+		{"age", "36", false},
+		{"age", "36.5", true},
+		{"age", "old", true},
+		{"ratio", "-1.5e3", false},
+		{"ratio", "1.", true},
+		{"admin", "true", false},
+		{"admin", "yes", true},
+		{"status", "banned", false},
+		{"status", "deleted", true},
+		{"nickname", "ada", true},
+	}
+	for _, key := range []string{"user:1", "member:1"} {
+		for _, test := range tests {
+			payload := JsonPayload{Key: key, Field: test.field, Value: test.value}
+			if refused := refusedBySchema(v, "hset", payload); refused != test.refused {
+				t.Errorf("hset %v %v %q refused: %v, want %v", key, test.field, test.value, refused, test.refused)
+			}
+		}
+	}
+	if refusedBySchema(v, "hset", JsonPayload{Key: "other:1", Field: "nickname", Value: "ada"}) {
+		t.Error("hset of a key without schema refused")
+	}
+}
+
+func TestSchemaRequired(t *testing.T) {
+	v := loadTestSchemas(t)
+	viper.Set("doc-types-field", "_types")
+	defer viper.Set("doc-types-field", nil)
+	testRedis.FlushAll()
+
+	for _, key := range []string{"user:1", "member:1"} {
+		// Hashes are built one field at a time.
+		if refusedBySchema(v, "hset", JsonPayload{Key: key, Field: "age", Value: "36"}) {
+			t.Errorf("%v: hset of a hash missing required fields refused", key)
+		}
+		if !refusedBySchema(v, "hdel", JsonPayload{Key: key, Fields: []string{"age", "name"}}) {
+			t.Errorf("%v: hdel of a required field accepted", key)
+		}
+
+		document := map[string]string{"_types": "{}", "name": "ada", "address.city": "London"}
+		if refusedBySchema(v, "docput", JsonPayload{Key: key, Values: document}) {
+			t.Errorf("%v: complete document refused", key)
+		}
+		delete(document, "address.city")
+		if !refusedBySchema(v, "docput", JsonPayload{Key: key, Values: document}) {
+			t.Errorf("%v: document missing a required field accepted", key)
+		}
+
+		patch := JsonPayload{Key: key, Values: map[string]string{"_types": "{}", "age": "37"}, Fields: []string{"age"}}
+		if !refusedBySchema(v, "docpatch", patch) {
+			t.Errorf("%v: patch creating a document missing required fields accepted", key)
+		}
+		testRedis.HSet(key, "name", "ada")
+		testRedis.HSet(key, "address.city", "London")
+		if refusedBySchema(v, "docpatch", patch) {
+			t.Errorf("%v: patch of a complete document refused", key)
+		}
+		patch = JsonPayload{Key: key, Values: map[string]string{"_types": "{}"}, Fields: []string{"name"}}
+		if !refusedBySchema(v, "docpatch", patch) {
+			t.Errorf("%v: patch deleting a required field accepted", key)
+		}
+		patch = JsonPayload{Key: key, Values: map[string]string{"_types": "{}", "address": "unknown"}, Fields: []string{"address"}}
+		if violation := schemaViolation(v, "docpatch", patch); !strings.Contains(violation, `"address.city" is required and cannot be deleted`) {
+			t.Errorf("%v: patch replacing an object holding a required field refused with %q", key, violation)
+		}
+		patch = JsonPayload{Key: key, Values: map[string]string{"_types": "{}", "name": "grace"}, Fields: []string{"name"}}
+		if refusedBySchema(v, "docpatch", patch) {
+			t.Errorf("%v: patch replacing a required field refused", key)
+		}
+	}
+}
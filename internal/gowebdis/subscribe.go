@@ -0,0 +1,60 @@
+package gowebdis
+
+import (
+	"github.com/go-redis/redis/v7"
+	log "github.com/sirupsen/logrus"
+)
+
+var subscribers = newGauge("gowebdis_subscribers", "Number of open channel subscriptions.", "backend")
+
+// Subscription delivers the messages published on a channel of a backend
+// until it is closed.
+type Subscription struct {
+	backend *Backend
+	pubsub  *redis.PubSub
+}
+
+// Subscribe subscribes to a channel of the backend on behalf of the
+// identity of the options. The response is a failure when the subscription
+// is refused or redis cannot be reached.
+func Subscribe(backend *Backend, channel string, options CommandOptions) (*Subscription, CommandResponse) {
+	var commandResponse = CommandResponse{Name: "subscribe"}
+	err := backend.CheckCommand("subscribe", "", options.Identity)
+	if err != nil {
+		commandResponse.Success = false
+		commandResponse.ErrorCode = ErrorCodeForbidden
+		commandResponse.ErrorMessage = err.Error()
+		log.Error("[ERROR] " + commandResponse.ErrorMessage)
+		return nil, commandResponse
+	}
+	if backend.client == nil {
+		commandResponse.Success = false
+		commandResponse.ErrorMessage = "Cannot make redis connection"
+		log.Error("[ERROR] " + commandResponse.ErrorMessage)
+		return nil, commandResponse
+	}
+	if !backend.breaker.allow() {
+		return nil, unavailableResponse(backend, "subscribe")
+	}
+
+	pubsub := backend.client.Subscribe(channel)
+	_, err = pubsub.Receive()
+	if err != nil {
+		pubsub.Close()
+		return nil, failedResponse("subscribe", err)
+	}
+	subscribers.add(1, backend.Name)
+	log.Info("[INFO] Subscribed to channel " + channel + " of backend " + backend.Name)
+	commandResponse.Success = true
+	return &Subscription{backend: backend, pubsub: pubsub}, commandResponse
+}
+
+// Messages returns the channel receiving the published messages.
+func (subscription *Subscription) Messages() <-chan *redis.Message {
+	return subscription.pubsub.Channel()
+}
+
+func (subscription *Subscription) Close() error {
+	subscribers.add(-1, subscription.backend.Name)
+	return subscription.pubsub.Close()
+}
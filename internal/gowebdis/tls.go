@@ -0,0 +1,50 @@
+package gowebdis
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// newRedisTlsConfig returns nil when TLS is not enabled through --redis-tls
+// or a rediss:// URL.
+func newRedisTlsConfig(source settingSource, enabled bool) (*tls.Config, error) {
+	if !enabled {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         source.getString("redis-tls-server-name"),
+		InsecureSkipVerify: source.getBool("redis-tls-insecure-skip-verify"),
+	}
+
+	caFile := source.getString("redis-tls-ca")
+	if len(caFile) > 0 {
+		caBundle, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificates found in %v", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	certFile := source.getString("redis-tls-cert")
+	keyFile := source.getString("redis-tls-key")
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		if len(certFile) == 0 || len(keyFile) == 0 {
+			return nil, errors.New("both --redis-tls-cert and --redis-tls-key must be set")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
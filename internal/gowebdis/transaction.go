@@ -0,0 +1,157 @@
+package gowebdis
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	log "github.com/sirupsen/logrus"
+)
+
+// BatchCommand is one command of a batch or a transaction.
+type BatchCommand struct {
+	Command string `json:"command"`
+	JsonPayload
+}
+
+// RunTransaction runs the commands atomically in a MULTI/EXEC block on the
+// backend. The second response is a failure when the transaction could not
+// run at all, otherwise the first holds the response of every command. On
+// cluster backends the keys must share a hash slot for the block to be
+// atomic. Transactions read from the master and bypass the local cache.
+// Hooks may change the commands and refuse them but not answer them.
+func RunTransaction(backend *Backend, commands []BatchCommand, options CommandOptions) ([]CommandResponse, CommandResponse) {
+	var failure = CommandResponse{Name: "transaction"}
+	failure.Success = false
+	if len(commands) == 0 {
+		failure.ErrorMessage = "Transaction has no commands"
+		log.Error("[ERROR] " + failure.ErrorMessage)
+		return nil, failure
+	}
+	if len(options.IfMatch) > 0 || len(options.IdempotencyKey) > 0 {
+		failure.ErrorMessage = "If-Match and Idempotency-Key are not supported by transactions"
+		log.Error("[ERROR] " + failure.ErrorMessage)
+		return nil, failure
+	}
+	calls := make([]*Call, len(commands))
+	chains := make([]hookChain, len(commands))
+	commands = append([]BatchCommand(nil), commands...)
+	for idx, command := range commands {
+		calls[idx] = &Call{Backend: backend.Name, Command: command.Command, JsonPayload: command.JsonPayload, Options: options}
+		if answered := chains[idx].before(calls[idx]); answered != nil {
+			if answered.Success {
+				failure.ErrorMessage = fmt.Sprintf("command %v was answered by a hook, which transactions do not support", idx)
+			} else {
+				// Refused by a hook, e.g. schema validation.
+				failure.ErrorCode = answered.ErrorCode
+				failure.ErrorMessage = fmt.Sprintf("command %v: %v", idx, answered.ErrorMessage)
+			}
+			log.Error("[ERROR] " + failure.ErrorMessage)
+			return nil, failure
+		}
+		command = BatchCommand{Command: calls[idx].Command, JsonPayload: calls[idx].JsonPayload}
+		commands[idx] = command
+		registered, ok := LookupCommand(command.Command)
+		builtin, queueable := registered.(*builtinCommand)
+		if !ok {
+			failure.ErrorMessage = fmt.Sprintf("Does not support %v command", command.Command)
+		} else if !queueable {
+			failure.ErrorMessage = fmt.Sprintf("%v cannot run in a transaction", command.Command)
+		} else if err := builtin.Validate(command.JsonPayload); err != nil {
+			failure.ErrorMessage = fmt.Sprintf("command %v: %v", idx, err)
+		} else if err := backend.CheckCommand(command.Command, "", options.Identity); err != nil {
+			failure.ErrorCode = ErrorCodeForbidden
+			failure.ErrorMessage = err.Error()
+		} else if writesVersionField(command) {
+			failure.ErrorMessage = "'" + versionField() + "' is maintained by gowebdis and cannot be written"
+		}
+		if len(failure.ErrorMessage) > 0 {
+			log.Error("[ERROR] " + failure.ErrorMessage)
+			return nil, failure
+		}
+	}
+	if backend.client == nil {
+		failure.ErrorMessage = "Cannot make redis connection"
+		log.Error("[ERROR] " + failure.ErrorMessage)
+		return nil, failure
+	}
+	if !backend.breaker.allow() {
+		return nil, unavailableResponse(backend, "transaction")
+	}
+
+	start := time.Now()
+	cmds := make([]redis.Cmder, len(commands))
+	_, err := backend.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for idx, command := range commands {
+			cmds[idx] = queueCommand(pipe, command)
+		}
+		return nil
+	})
+	if err != nil && isConnectionFailure(err) {
+		return nil, failedResponse("transaction", err)
+	}
+
+	elapsed := time.Since(start) / time.Duration(len(commands))
+	responses := make([]CommandResponse, len(commands))
+	for idx, command := range commands {
+		responses[idx] = checkReplyLimits(backend, transactionResponse(command, cmds[idx]))
+		if !IsReadCommand(command.Command) && backend.cache != nil {
+			backend.cache.invalidate(command.Key)
+		}
+		if audit.audits(command.Command, command.Key) {
+			audit.record(backend, command.Command, command.JsonPayload, options, nil, responses[idx])
+		}
+		recordCommand(backend, command.Command, responses[idx], elapsed)
+		chains[idx].after(calls[idx], &responses[idx])
+		responses[idx] = checkReplyLimits(backend, responses[idx])
+	}
+	return responses, CommandResponse{Name: "transaction", Success: true}
+}
+
+func writesVersionField(command BatchCommand) bool {
+	field := versionField()
+	if len(field) == 0 {
+		return false
+	}
+	if command.Command == "hset" && command.Field == field {
+		return true
+	}
+	if _, ok := command.Values[field]; ok {
+		return true
+	}
+	for _, f := range command.Fields {
+		if (command.Command == "hdel" || command.Command == "docpatch") && f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func queueCommand(pipe redis.Pipeliner, command BatchCommand) redis.Cmder {
+	registered, _ := LookupCommand(command.Command)
+	return registered.(*builtinCommand).queue(pipe, command.JsonPayload)
+}
+
+// transactionResponse reads the reply of a command queued by queueCommand.
+func transactionResponse(command BatchCommand, cmd redis.Cmder) CommandResponse {
+	var commandResponse = CommandResponse{Name: command.Command}
+	if err := cmd.Err(); err != nil {
+		if _, ok := cmd.(*redis.Cmd); !ok {
+			return failedResponse(command.Command, err)
+		}
+	}
+	switch c := cmd.(type) {
+	case *redis.Cmd:
+		result, err := c.Result()
+		return versionedResponse(commandResponse, command.Key, "", result, err)
+	case *redis.StatusCmd:
+		commandResponse.StringVal = c.Val()
+	case *redis.IntCmd:
+		commandResponse.BoolVal = command.Command == "hset"
+		commandResponse.IntVal = c.Val()
+	case *redis.StringStringMapCmd:
+		commandResponse.MapVal = c.Val()
+	}
+	commandResponse.Success = true
+	return takeVersionField(commandResponse)
+}
@@ -0,0 +1,121 @@
+package gowebdis
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// applyRedisUrl overrides the connection setting with the values of a redis
+// URL and returns the mode implied by its scheme (empty when the scheme does
+// not imply one) and whether TLS is required. Supported forms are:
+//
+//	redis://[user:password@]host:port[/db][?option=value]
+//	rediss://[user:password@]host:port[/db][?option=value]
+//	unix://[user:password@]/path/to/socket[?db=n&option=value]
+//	redis-sentinel://[user:password@]host:port[,host:port]/master-name[/db][?option=value]
+//	redis-cluster://[user:password@]host:port[,host:port][?option=value]
+//
+// Options are named after the command line flags, e.g. dial-timeout=5 or
+// pool-size=20.
+func applyRedisUrl(setting *connectionSetting, rawUrl string) (string, bool, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", false, err
+	}
+
+	var mode string
+	var useTls bool
+	pathSegments := splitUrlPath(u.Path)
+
+	switch u.Scheme {
+	case "redis", "rediss":
+		useTls = u.Scheme == "rediss"
+		setting.Addrs = splitList(u.Host)
+		if len(pathSegments) > 1 {
+			return "", false, fmt.Errorf("unexpected path %v in redis URL", u.Path)
+		}
+		if len(pathSegments) == 1 {
+			setting.DB, err = parseDb(pathSegments[0])
+		}
+	case "unix":
+		mode = "host"
+		setting.Network = "unix"
+		setting.Addrs = []string{u.Path}
+	case "redis-sentinel":
+		mode = "sentinel"
+		setting.Addrs = splitList(u.Host)
+		if len(pathSegments) > 2 {
+			return "", false, fmt.Errorf("unexpected path %v in redis URL", u.Path)
+		}
+		if len(pathSegments) > 0 {
+			setting.MasterName = pathSegments[0]
+		}
+		if len(pathSegments) == 2 {
+			setting.DB, err = parseDb(pathSegments[1])
+		}
+	case "redis-cluster":
+		mode = "cluster"
+		setting.Addrs = splitList(u.Host)
+		if len(pathSegments) > 0 {
+			return "", false, fmt.Errorf("unexpected path %v in redis URL", u.Path)
+		}
+	default:
+		return "", false, fmt.Errorf("unsupported redis URL scheme %v", u.Scheme)
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	if u.User != nil {
+		setting.Username = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			setting.Password = password
+		}
+	}
+
+	intSettings := setting.intSettings()
+	for name, values := range u.Query() {
+		value := values[len(values)-1]
+		switch name {
+		case "master-name":
+			setting.MasterName = value
+		case "sentinel-password":
+			setting.SentinelPassword = value
+		case "tls":
+			useTls, err = strconv.ParseBool(value)
+			if err != nil {
+				return "", false, fmt.Errorf("invalid value %v for tls", value)
+			}
+		default:
+			field, ok := intSettings[name]
+			if !ok {
+				return "", false, fmt.Errorf("unsupported redis URL option %v", name)
+			}
+			*field, err = strconv.Atoi(value)
+			if err != nil {
+				return "", false, fmt.Errorf("invalid value %v for %v", value, name)
+			}
+		}
+	}
+	return mode, useTls, nil
+}
+
+func splitUrlPath(path string) []string {
+	var segments []string
+	for _, segment := range strings.Split(path, "/") {
+		if len(segment) > 0 {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
+
+func parseDb(value string) (int, error) {
+	db, err := strconv.Atoi(value)
+	if err != nil || db < 0 {
+		return 0, fmt.Errorf("invalid database number %v", value)
+	}
+	return db, nil
+}
@@ -0,0 +1,166 @@
+package gowebdis
+
+import (
+	"github.com/go-redis/redis/v7"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// When --version-field is set every hash write goes through these scripts,
+// which bump the version stored in that field atomically with the write
+// and reject the write when the version announced by the client through
+// If-Match is stale. ARGV[1] is the version field, ARGV[2] the expected
+// version: empty to skip the check, "*" to only require the key to exist,
+// and ARGV[3] --version-tombstone-ttl. Deleting every field of a hash
+// keeps its version field, so that versions are never reissued after the
+// hash is written again; a hash holding only its version field, a
+// tombstone, does not exist for clients. Scripts call settle once written
+// so that tombstones expire after --version-tombstone-ttl seconds and
+// revived hashes do not.
+const versionCheckScript = `
+local function isTombstone()
+	return redis.call('HLEN', KEYS[1]) == 1 and redis.call('HEXISTS', KEYS[1], ARGV[1]) == 1
+end
+local tombstoneTTL = tonumber(ARGV[3]) or 0
+local wasTombstone = ARGV[1] ~= '' and isTombstone()
+local function settle()
+	if ARGV[1] == '' or tombstoneTTL <= 0 then
+		return
+	end
+	if isTombstone() then
+		redis.call('EXPIRE', KEYS[1], tombstoneTTL)
+	elseif wasTombstone then
+		redis.call('PERSIST', KEYS[1])
+	end
+end
+local current = redis.call('HGET', KEYS[1], ARGV[1]) or '0'
+if ARGV[2] == '*' then
+	if redis.call('HLEN', KEYS[1]) <= redis.call('HEXISTS', KEYS[1], ARGV[1]) then
+		return {-1, current}
+	end
+elseif ARGV[2] ~= '' and ARGV[2] ~= current then
+	return {-1, current}
+end
+`
+
+var versionedHSetScript = redis.NewScript(versionCheckScript + `
+local added = redis.call('HSET', KEYS[1], ARGV[4], ARGV[5])
+local version = redis.call('HINCRBY', KEYS[1], ARGV[1], 1)
+settle()
+return {added, tostring(version)}
+`)
+
+var versionedHDelScript = redis.NewScript(versionCheckScript + `
+local removed = redis.call('HDEL', KEYS[1], unpack(ARGV, 4))
+if removed == 0 then
+	return {0, current}
+end
+local version = redis.call('HINCRBY', KEYS[1], ARGV[1], 1)
+settle()
+return {removed, tostring(version)}
+`)
+
+func versionField() string {
+	return viper.GetString("version-field")
+}
+
+// takeVersionField moves the version field of a hash read into Version, so
+// that replies only hold the fields written by clients.
+func takeVersionField(commandResponse CommandResponse) CommandResponse {
+	field := versionField()
+	version, ok := commandResponse.MapVal[field]
+	if len(field) == 0 || !ok {
+		return commandResponse
+	}
+	values := make(map[string]string, len(commandResponse.MapVal)-1)
+	for f, value := range commandResponse.MapVal {
+		if f != field {
+			values[f] = value
+		}
+	}
+	commandResponse.MapVal = values
+	commandResponse.Version = version
+	return commandResponse
+}
+
+func hSetVersioned(client redis.UniversalClient, key string, field string, value string, ifMatch string) CommandResponse {
+	var commandResponse = CommandResponse{Name: "hset"}
+	if field == versionField() {
+		return versionFieldError(commandResponse)
+	}
+	return runVersionedScript(commandResponse, client, versionedHSetScript, key, ifMatch, field, value)
+}
+
+func hDelVersioned(client redis.UniversalClient, key string, fields []string, ifMatch string) CommandResponse {
+	var commandResponse = CommandResponse{Name: "hdel"}
+	args := make([]interface{}, len(fields))
+	for idx, field := range fields {
+		if field == versionField() {
+			return versionFieldError(commandResponse)
+		}
+		args[idx] = field
+	}
+	return runVersionedScript(commandResponse, client, versionedHDelScript, key, ifMatch, args...)
+}
+
+func versionFieldError(commandResponse CommandResponse) CommandResponse {
+	commandResponse.Success = false
+	commandResponse.ErrorMessage = "'" + versionField() + "' is maintained by gowebdis and cannot be written"
+	log.Error("[ERROR] " + commandResponse.ErrorMessage)
+	return commandResponse
+}
+
+func runVersionedScript(commandResponse CommandResponse, client redis.UniversalClient, script *redis.Script, key string, ifMatch string, args ...interface{}) CommandResponse {
+	if client == nil {
+		commandResponse.Success = false
+		commandResponse.ErrorMessage = "Cannot make redis connection"
+		log.Error("[ERROR] " + commandResponse.ErrorMessage)
+		return commandResponse
+	}
+
+	result, err := script.Run(client, []string{key}, versionScriptArgs(ifMatch, args...)...).Result()
+	return versionedResponse(commandResponse, key, ifMatch, result, err)
+}
+
+func versionScriptArgs(ifMatch string, args ...interface{}) []interface{} {
+	return append([]interface{}{versionField(), ifMatch, viper.GetInt("version-tombstone-ttl")}, args...)
+}
+
+// versionedResponse reads the reply of a version script.
+func versionedResponse(commandResponse CommandResponse, key string, ifMatch string, result interface{}, err error) CommandResponse {
+	if err != nil {
+		commandResponse.Success = false
+		commandResponse.ErrorMessage = err.Error()
+		commandResponse.ErrorCode = failureCode(err)
+		log.Error("[ERROR] " + commandResponse.ErrorMessage)
+		return commandResponse
+	}
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		commandResponse.Success = false
+		commandResponse.ErrorMessage = "Unexpected reply of version script"
+		log.Error("[ERROR] " + commandResponse.ErrorMessage)
+		return commandResponse
+	}
+	count, _ := values[0].(int64)
+	version, _ := values[1].(string)
+	commandResponse.Version = version
+	if count < 0 {
+		commandResponse.Success = false
+		commandResponse.ErrorCode = ErrorCodePreconditionFailed
+		if ifMatch == "*" {
+			commandResponse.ErrorMessage = key + " does not exist"
+		} else {
+			commandResponse.ErrorMessage = "Version of " + key + " is v" + version + ", not v" + ifMatch
+		}
+		log.Error("[ERROR] " + commandResponse.ErrorMessage)
+		return commandResponse
+	}
+	commandResponse.Success = true
+	commandResponse.IntVal = count
+	if commandResponse.Name == "hset" {
+		commandResponse.BoolVal = true
+	}
+	log.Info("[INFO] " + commandResponse.Name + " " + key + " version " + version)
+	return commandResponse
+}
@@ -0,0 +1,66 @@
+package gowebdis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestVersionTombstoneTTL(t *testing.T) {
+	viper.Set("version-field", "_v")
+	viper.Set("doc-types-field", "$types")
+	viper.Set("version-tombstone-ttl", 60)
+	defer viper.Set("version-field", nil)
+	defer viper.Set("doc-types-field", nil)
+	defer viper.Set("version-tombstone-ttl", nil)
+	testRedis.FlushAll()
+	backend, err := ResolveBackend("", "tombstone:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(command string, payload JsonPayload) CommandResponse {
+		payload.Key = "tombstone:1"
+		commandResponse := RunRedisCommand(backend, command, payload, CommandOptions{})
+		if !commandResponse.Success {
+			t.Fatalf("%v: %v", command, commandResponse.ErrorMessage)
+		}
+		return commandResponse
+	}
+
+	tests := []struct {
+		command string
+		payload JsonPayload
+		ttl     time.Duration
+		version string
+	}{
+		{"hset", JsonPayload{Field: "name", Value: "ada"}, 0, "1"},
+		{"hdel", JsonPayload{Fields: []string{"name"}}, time.Minute, "2"},
+		{"hset", JsonPayload{Field: "name", Value: "grace"}, 0, "3"},
+		{"docdel", JsonPayload{}, time.Minute, "4"},
+		{"docput", JsonPayload{Values: map[string]string{"name": "ada", "$types": "{}"}}, 0, "5"},
+		{"docdel", JsonPayload{}, time.Minute, "6"},
+		{"docpatch", JsonPayload{Values: map[string]string{"name": "ada", "$types": "{}"}, Fields: []string{"name"}}, 0, "7"},
+	}
+	for _, test := range tests {
+		if version := run(test.command, test.payload).Version; version != test.version {
+			t.Errorf("%v wrote version %v, want %v", test.command, version, test.version)
+		}
+		if ttl := testRedis.TTL("tombstone:1"); ttl != test.ttl {
+			t.Errorf("%v left a TTL of %v, want %v", test.command, ttl, test.ttl)
+		}
+	}
+
+	// TTLs set by clients on hashes that are not tombstones are kept.
+	testRedis.SetTTL("tombstone:1", time.Hour)
+	run("hset", JsonPayload{Field: "email", Value: "ada@example.com"})
+	if ttl := testRedis.TTL("tombstone:1"); ttl != time.Hour {
+		t.Errorf("hset changed the TTL of a hash to %v", ttl)
+	}
+
+	viper.Set("version-tombstone-ttl", 0)
+	run("hdel", JsonPayload{Fields: []string{"name", "email"}})
+	if ttl := testRedis.TTL("tombstone:1"); ttl != time.Hour {
+		t.Errorf("hdel without tombstone TTL changed the TTL to %v", ttl)
+	}
+}
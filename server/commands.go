@@ -0,0 +1,133 @@
+package server
+
+import (
+	"github.com/codelity/gowebdis/internal/gowebdis"
+)
+
+// Command is a command served by the API. Custom commands implement it to
+// add domain-specific endpoints, e.g. one merging several hashes:
+//
+//	type profileCommand struct{}
+//
+//	func (profileCommand) Spec() server.CommandSpec {
+//		return server.CommandSpec{
+//			Name:     "profile",
+//			Summary:  "Get the profile and settings of a user.",
+//			ReadOnly: true,
+//			ReadKeys: func(payload server.Payload) []string {
+//				return []string{payload.Key, payload.Key + ":settings"}
+//			},
+//			Arguments: []server.ArgumentSpec{{Name: "key", Type: server.TypeString, Required: true}},
+//			Response:  server.ResponseSpec{Name: "profile", Type: server.TypeObject},
+//		}
+//	}
+//
+//	func (command profileCommand) Validate(payload server.Payload) error {
+//		return command.Spec().Validate(payload)
+//	}
+//
+//	func (profileCommand) Execute(client redis.UniversalClient, payload server.Payload, options server.CommandOptions) server.Response {
+//		profile, err := client.HGetAll(payload.Key).Result()
+//		...
+//		settings, err := client.HGetAll(payload.Key + ":settings").Result()
+//		...
+//		return server.Response{Success: true, MapVal: profile}
+//	}
+//
+//	func (profileCommand) Encode(response server.Response) map[string]interface{} {
+//		return map[string]interface{}{"profile": response.MapVal}
+//	}
+//
+// The policy, retries and audit log of the backend apply to custom
+// commands as to the built-in ones. Read commands are only cached and
+// coalesced when their spec declares every key they read with ReadKeys,
+// so that a write to any of them drops the cached reply. Custom commands
+// cannot run in transactions.
+type Command = gowebdis.Command
+
+type CommandSpec = gowebdis.CommandSpec
+type ArgumentSpec = gowebdis.ArgumentSpec
+type ResponseSpec = gowebdis.ResponseSpec
+
+// Payload is the JSON body of a command.
+type Payload = gowebdis.JsonPayload
+
+// Response is the result of a command. Failures set ErrorMessage and
+// optionally one of the error codes, which select the HTTP status.
+type Response = gowebdis.CommandResponse
+
+// CommandOptions carries the request metadata of a command, including the
+// identity of the caller.
+type CommandOptions = gowebdis.CommandOptions
+
+type Identity = gowebdis.Identity
+
+// Types of arguments and responses, named after JSON Schema types.
+const (
+	TypeString  = gowebdis.TypeString
+	TypeArray   = gowebdis.TypeArray
+	TypeBoolean = gowebdis.TypeBoolean
+	TypeInteger = gowebdis.TypeInteger
+	TypeObject  = gowebdis.TypeObject
+	TypeJSON    = gowebdis.TypeJSON
+)
+
+// Error codes of Response.
+const (
+	ErrorCodePreconditionFailed = gowebdis.ErrorCodePreconditionFailed
+	ErrorCodeUnavailable        = gowebdis.ErrorCodeUnavailable
+	ErrorCodeConflict           = gowebdis.ErrorCodeConflict
+	ErrorCodeUnprocessable      = gowebdis.ErrorCodeUnprocessable
+	ErrorCodeTooLarge           = gowebdis.ErrorCodeTooLarge
+	ErrorCodeForbidden          = gowebdis.ErrorCodeForbidden
+	ErrorCodeInternal           = gowebdis.ErrorCodeInternal
+)
+
+// PayloadKey returns the key of the payload, for CommandSpec.ReadKeys of
+// commands reading that key only.
+func PayloadKey(payload Payload) []string {
+	return gowebdis.PayloadKey(payload)
+}
+
+// RegisterCommand adds a command to the API, served at POST /<name> and,
+// when read-only, GET /read/<name>/<key>. It must be called before the
+// server starts; Options.Commands does so in New.
+func RegisterCommand(command Command) error {
+	return gowebdis.RegisterCommand(command)
+}
+
+// Call is a command on its way through the hooks.
+type Call = gowebdis.Call
+
+// PreExecuteHook runs before a command and may change it or answer it.
+type PreExecuteHook = gowebdis.PreExecuteHook
+
+// PostExecuteHook runs after a command and may change its response.
+type PostExecuteHook = gowebdis.PostExecuteHook
+
+// Hook registers pre- and post-execute hooks for some routes and commands,
+// ordered by Order:
+//
+//	server.AddHook(server.Hook{
+//		Order:    10,
+//		Routes:   []string{server.RouteCommand, server.RouteBatch},
+//		Commands: []string{"hset"},
+//		Before:   trimValues{},
+//	})
+type Hook = gowebdis.Hook
+
+// Routes of the API a hook can be limited to.
+const (
+	RouteCommand     = gowebdis.RouteCommand
+	RouteRead        = gowebdis.RouteRead
+	RouteBatch       = gowebdis.RouteBatch
+	RouteTransaction = gowebdis.RouteTransaction
+	RouteHealth      = gowebdis.RouteHealth
+	RouteDocument    = gowebdis.RouteDocument
+)
+
+// AddHook adds a hook around the commands of the API. It must be called
+// before the server starts; Options.Hooks does so in New.
+func AddHook(hook Hook) error {
+	return gowebdis.AddHook(hook)
+}
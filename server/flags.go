@@ -0,0 +1,108 @@
+package server
+
+import (
+	"github.com/spf13/pflag"
+)
+
+// AddFlags defines the settings of gowebdis on a flag set, as used by
+// `gowebdis start`. Options.Settings and the settings of a backend are
+// keyed by the same names.
+func AddFlags(flags *pflag.FlagSet) {
+	flags.String("redis-url", "", "Redis URL (redis://, rediss://, unix://, redis-sentinel:// or redis-cluster://), overrides connection flags")
+	flags.String("mode", "", "Connection mode: standalone, sentinel or cluster (default inferred from host list)")
+	flags.String("default-backend", "default", "Backend used when a request does not select one")
+	flags.String("backend-header", "X-Gowebdis-Backend", "Request header selecting a backend by name")
+	flags.String("host", "", "Redis host list (format <host>:<port> seperated by comma")
+	flags.String("master-name", "", "master name of sentinel")
+	flags.String("sentinel-address", "", "master name of sentinel")
+	flags.String("username", "", "ACL username (Redis 6+)")
+	flags.String("password", "", "Conection password")
+	flags.String("read-policy", "master-only", "Where read commands go: master-only, replica-preferred or latency-based")
+	flags.String("replica-address", "", "Replica list (format <host>:<port> seperated by comma), discovered through sentinel when empty")
+	flags.Int("replica-check-interval", 5, "Seconds between replica health and lag checks")
+	flags.Int("max-replication-lag", 10, "Maximum replication lag in seconds for a replica to serve reads (-1 disables the check)")
+	flags.Bool("cache", false, "Cache read replies in process")
+	flags.Int("cache-max-memory", 64, "Memory limit of the read cache in MB")
+	flags.Int("cache-ttl", 300, "Seconds a cached reply lives while client tracking is active")
+	flags.Int("cache-fallback-ttl", 2, "Seconds a cached reply lives when client tracking is unavailable")
+	flags.Bool("cache-tracking", true, "Invalidate cached replies with redis client tracking (Redis 6+)")
+	flags.String("cache-key-patterns", "", "Key patterns to cache seperated by comma (default all keys)")
+	flags.String("cache-exclude-patterns", "", "Key patterns never cached seperated by comma")
+	flags.Bool("coalesce", true, "Share one redis round trip between identical concurrent reads")
+	flags.String("coalesce-exclude-commands", "", "Read commands never coalesced seperated by comma")
+	flags.Int("circuit-breaker-failure-threshold", 5, "Consecutive connection failures opening the circuit breaker, 0 disables it")
+	flags.Int("circuit-breaker-probe-interval", 5, "Seconds to wait before probing redis again while the circuit breaker is open")
+	flags.Int64("max-body-size", 1048576, "Maximum size in bytes of a request body, 0 for no limit")
+	flags.Int("max-args", 1024, "Maximum number of fields of a command, 0 for no limit")
+	flags.Int("max-value-size", 524288, "Maximum size in bytes of a key, field or value, 0 for no limit")
+	flags.Int("max-batch-length", 100, "Maximum number of commands of a batch or transaction, 0 for no limit")
+	flags.Int("max-reply-elements", 10000, "Maximum number of fields, or JSON array elements, of a reply, 0 for no limit; hgetall checks the length of the hash with HLEN before reading it")
+	flags.Int("max-reply-size", 8388608, "Maximum size in bytes of a reply once decompressed and decrypted, 0 for no limit")
+	flags.String("command-allow", "", "Commands, \"command subcommand\" or @flag allowed on the backend seperated by comma (default all)")
+	flags.String("command-deny", "", "Commands, \"command subcommand\" or @flag denied on the backend seperated by comma")
+	flags.String("admin-role", "admin", "Role required to run commands flagged admin and to use the admin routes")
+	flags.String("admin-routes", "/metrics,/cache/stats", "Routes restricted to the admin role seperated by comma, among /metrics, /cache/stats, /openapi.json and /docs")
+	flags.String("rename-commands", "", "Commands renamed on the redis servers as name=renamed seperated by comma, an empty name disables the command")
+	flags.String("audit-file", "", "JSON-lines file recording write commands")
+	flags.Int64("audit-file-max-size", 100, "Size in MB at which the audit file is rotated, 0 disables rotation")
+	flags.Int("audit-file-max-backups", 5, "Number of rotated audit files kept")
+	flags.String("audit-stream", "", "Redis stream recording write commands on their backend")
+	flags.Int64("audit-stream-max-len", 100000, "Approximate maximum length of the audit stream")
+	flags.String("audit-key-patterns", "", "Key patterns whose writes are audited seperated by comma (default all keys)")
+	flags.String("audit-redact-fields", "", "Field patterns whose values are redacted in the audit log seperated by comma")
+	flags.Bool("audit-diff", false, "Record the values of written fields before and after hset and hdel")
+	flags.String("encryption-keyring", "", "Keyring file of field encryption, enables it")
+	flags.String("encrypted-fields", "", "Hash fields stored encrypted as key-pattern=field-pattern seperated by comma")
+	flags.String("encryption-decrypt-roles", "pii", "Roles allowed to read encrypted fields seperated by comma, others get masked values")
+	flags.String("encryption-mask", "****", "Value returned for encrypted fields to callers without a decrypt role")
+	flags.String("compression", "", "Hash values stored compressed as key-pattern=algorithm seperated by comma, algorithm being zstd, snappy or gzip; hashes no longer matching a pattern are read as stored")
+	flags.Int("compression-min-size", 1024, "Size in bytes from which hash values are compressed")
+	flags.String("schemas", "", "Schema files, JSON Schema or YAML type maps, validating hset, hdel and documents as key-pattern=file seperated by comma. Required fields cannot be deleted and are checked on documents only, as hset writes one field; document patches are checked against the hash just ahead of the write, not atomically with it")
+	flags.String("docs-script-url", "https://cdn.redoc.ly/redoc/v2.1.5/bundles/redoc.standalone.js", "URL of the Redoc bundle loaded by /docs, pinned to a version")
+	flags.String("docs-script-integrity", "", "Subresource Integrity hash of the bundle at --docs-script-url, e.g. sha384-<base64 digest>, checked by browsers loading /docs")
+	flags.String("docs-script-file", "", "Redoc bundle served by gowebdis at /docs/redoc.standalone.js and loaded by /docs instead of --docs-script-url")
+	flags.String("idempotency-header", "Idempotency-Key", "Request header carrying the idempotency key of a write")
+	flags.Int("idempotency-window", 86400, "Seconds the result of a write is replayed to requests with the same idempotency key")
+	flags.Int("idempotency-pending-ttl", 30, "Seconds a write in progress holds its idempotency key, answering duplicates with 409, in case its result is never stored")
+	flags.String("idempotency-key-prefix", "gowebdis:idempotency:", "Prefix of the redis keys storing results of idempotent writes")
+	flags.String("json-module", "auto", "Whether json commands use the RedisJSON module: auto detects it with MODULE LIST, native or emulated. Emulated writes are not atomic, they read the document and write it back if unchanged, failing with 409 after 10 tries")
+	flags.String("doc-types-field", "$types", "Hash field recording the types of the values of JSON documents")
+	flags.String("version-field", "", "Hash field holding the version of each hash, bumped on every write, checked against If-Match and used as ETag of reads. Hashes emptied by writes keep this field as a tombstone so that versions are never reissued")
+	flags.Int("version-tombstone-ttl", 0, "Seconds before the tombstone of a hash emptied by writes expires, 0 to keep tombstones forever. Versions restart from 1 once a tombstone expired")
+	flags.Int("cache-control-max-age", 0, "max-age in seconds of read replies served over GET")
+	flags.Bool("cache-control-from-ttl", false, "Derive max-age of read replies from the remaining TTL of the key")
+	flags.String("read-from-header", "X-Gowebdis-Read-From", "Request header forcing reads to the master when set to \"master\"")
+	flags.String("sentinel-password", "", "Password of sentinel nodes")
+	flags.Bool("redis-tls", false, "Connect to redis over TLS")
+	flags.String("redis-tls-ca", "", "CA bundle used to verify the redis server certificate")
+	flags.String("redis-tls-cert", "", "Client certificate presented to redis")
+	flags.String("redis-tls-key", "", "Client private key presented to redis")
+	flags.String("redis-tls-server-name", "", "Server name used to verify the redis server certificate")
+	flags.Bool("redis-tls-insecure-skip-verify", false, "Skip verification of the redis server certificate")
+	flags.Int("db", 0, "Database number")
+	flags.Int("max-retries", -1, "Maximum retries of idempotent commands after a connection failure")
+	flags.Int("pool-size", 10, "Pool size")
+	flags.Int("min-idle-conns", 3, "Minimum pool size")
+	flags.Int("min-retry-backoff", -1, "Minimum retry backoff")
+	flags.Int("max-retry-backoff", -1, "Maximum retry backoff")
+	flags.Int("dial-timeout", -1, "Dial timeout in seconds")
+	flags.Int("read-timeout", -1, "Read timeout in seconds")
+	flags.Int("write-timeout", -1, "Write timeout")
+	flags.Int("max-conn-age", -1, "Maximum connection age")
+	flags.Int("pool-timeout", -1, "Pool timeout")
+	flags.Int("idle-timeout", 900, "Idle timeout")
+	flags.Int("idle-check-frequency", 900, "Idle check frequency")
+	flags.String("listen", "", "Listen address, <host>:<port> or unix:<socket path> (default :$PORT)")
+	flags.String("tls-cert", "", "TLS certificate file, reloaded when changed")
+	flags.String("tls-key", "", "TLS private key file, reloaded when changed")
+	flags.String("tls-client-ca", "", "CA bundle used to verify client certificates (enables mTLS)")
+	flags.String("tls-min-version", "1.2", "Minimum TLS version (1.0, 1.1, 1.2 or 1.3)")
+	flags.String("tls-cipher-suites", "", "Allowed TLS 1.2 cipher suites seperated by comma")
+	flags.Bool("h2c", false, "Serve plaintext HTTP/2 (h2c) when TLS is disabled")
+	flags.Int("server-read-timeout", -1, "HTTP server read timeout in seconds")
+	flags.Int("server-read-header-timeout", 10, "HTTP server read header timeout in seconds")
+	flags.Int("server-write-timeout", -1, "HTTP server write timeout in seconds")
+	flags.Int("server-idle-timeout", 120, "HTTP server idle timeout in seconds")
+	flags.Int("shutdown-delay", 0, "Seconds to wait after failing readiness before draining")
+	flags.Int("shutdown-grace-period", 30, "Seconds to wait for in-flight requests to drain on shutdown")
+}
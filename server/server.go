@@ -0,0 +1,262 @@
+// Package server embeds the gowebdis HTTP API in another Go program,
+// without the gowebdis command line:
+//
+//	srv, err := server.New(server.Options{
+//		Backends: map[string]server.Backend{
+//			"default": {RedisURL: "redis://localhost:6379/0"},
+//		},
+//	})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer srv.Close()
+//	http.Handle("/redis/", http.StripPrefix("/redis", srv.Handler()))
+//
+// Backends and settings are process wide, so a process runs at most one
+// Server at a time. New writes the options to the global viper instance,
+// overwriting the settings of the same names a host program may keep
+// there, and Close restores them. Close also removes the hooks of the
+// options, while commands stay registered: a later New must not pass them
+// again.
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/codelity/gowebdis/api"
+	"github.com/codelity/gowebdis/internal/gowebdis"
+)
+
+// Options configures a Server. Settings missing from Options keep the
+// defaults of `gowebdis start`.
+type Options struct {
+	// Backends are the redis deployments served, by name.
+	Backends map[string]Backend
+	// DefaultBackend serves requests selecting no backend, by default the
+	// only backend when there is one.
+	DefaultBackend string
+	// Routes send keys to backends by prefix, the first match wins.
+	Routes []Route
+	// Tokens are the bearer tokens accepted. Requests without a token run
+	// anonymously.
+	Tokens []Token
+	// Middleware runs after authentication, before the commands.
+	Middleware []gin.HandlerFunc
+	// Group, when set, is the gin router group the API is mounted on
+	// instead of being served by Handler. Backends are then selected with
+	// the backend header only.
+	Group *gin.RouterGroup
+	// Settings sets any setting of `gowebdis start` by flag name, e.g.
+	// "version-field" or "max-body-size".
+	Settings map[string]interface{}
+	// Commands are registered with RegisterCommand.
+	Commands []Command
+	// Hooks are added with AddHook.
+	Hooks []Hook
+}
+
+// Backend is a redis deployment served by the API.
+type Backend struct {
+	// RedisURL is the address of the deployment, as --redis-url.
+	RedisURL string
+	// Roles restricts the backend to identities with one of the roles.
+	Roles []string
+	// Settings overrides settings for this backend by flag name, e.g.
+	// "pool-size".
+	Settings map[string]interface{}
+}
+
+type Route struct {
+	KeyPrefix string
+	Backend   string
+}
+
+// Token is a bearer token and the identity it authenticates.
+type Token struct {
+	Token    string
+	Identity string
+	Roles    []string
+}
+
+// Server serves the gowebdis API over the backends of its options.
+type Server struct {
+	handler http.Handler
+	// overwritten holds the viper settings New replaced, restored by
+	// Close.
+	overwritten map[string]interface{}
+}
+
+var mutex sync.Mutex
+var started bool
+
+// New connects to the backends, failing when one cannot be reached, and
+// mounts the API on Options.Group when set. Commands and hooks are only
+// registered once the backends are connected, so that New can be called
+// again after it failed.
+func New(options Options) (*Server, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if started {
+		return nil, errors.New("a gowebdis server was already started in this process")
+	}
+	if len(options.Backends) == 0 {
+		return nil, errors.New("no backend configured")
+	}
+	err := gowebdis.ValidateCommands(options.Commands)
+	if err != nil {
+		return nil, err
+	}
+	for _, hook := range options.Hooks {
+		err := gowebdis.ValidateHook(hook)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	flags := pflag.NewFlagSet("gowebdis", pflag.ContinueOnError)
+	AddFlags(flags)
+	flags.VisitAll(func(flag *pflag.Flag) {
+		viper.SetDefault(flag.Name, flag.DefValue)
+	})
+	overwritten := map[string]interface{}{}
+	err = applyOptions(flags, options, overwritten)
+	if err == nil {
+		err = gowebdis.InitConnectionSetting()
+	}
+	if err != nil {
+		restoreSettings(overwritten)
+		return nil, err
+	}
+	started = true
+
+	// Validated above, registration cannot fail.
+	for _, command := range options.Commands {
+		RegisterCommand(command)
+	}
+	for _, hook := range options.Hooks {
+		AddHook(hook)
+	}
+
+	server := &Server{handler: http.NotFoundHandler(), overwritten: overwritten}
+	if options.Group != nil {
+		api.RegisterRoutes(options.Group, options.Middleware...)
+	} else {
+		router := gin.New()
+		router.Use(gin.Recovery())
+		api.RegisterRoutes(router, options.Middleware...)
+		server.handler = api.Handler(router)
+	}
+	api.MarkReady()
+	return server, nil
+}
+
+// applyOptions sets the options as viper settings, which the backends read
+// like the config file of `gowebdis start`, recording the values it
+// replaces in overwritten.
+func applyOptions(flags *pflag.FlagSet, options Options, overwritten map[string]interface{}) error {
+	err := checkSettings(flags, options.Settings)
+	if err != nil {
+		return err
+	}
+	set := func(name string, value interface{}) {
+		if _, ok := overwritten[name]; !ok {
+			overwritten[name] = viper.Get(name)
+		}
+		viper.Set(name, value)
+	}
+	for name, value := range options.Settings {
+		set(name, value)
+	}
+
+	backends := map[string]interface{}{}
+	for name, backend := range options.Backends {
+		err := checkSettings(flags, backend.Settings)
+		if err != nil {
+			return fmt.Errorf("backend %v: %v", name, err)
+		}
+		config := map[string]interface{}{}
+		for setting, value := range backend.Settings {
+			config[setting] = value
+		}
+		if len(backend.RedisURL) > 0 {
+			config["redis-url"] = backend.RedisURL
+		}
+		config["auth"] = map[string]interface{}{"roles": backend.Roles}
+		backends[name] = config
+	}
+	set("backends", backends)
+
+	defaultBackend := options.DefaultBackend
+	if len(defaultBackend) == 0 && len(options.Backends) == 1 {
+		for name := range options.Backends {
+			defaultBackend = name
+		}
+	}
+	if len(defaultBackend) > 0 {
+		set("default-backend", defaultBackend)
+	}
+
+	routes := make([]map[string]interface{}, 0, len(options.Routes))
+	for _, route := range options.Routes {
+		routes = append(routes, map[string]interface{}{"key-prefix": route.KeyPrefix, "backend": route.Backend})
+	}
+	set("routes", routes)
+
+	tokens := make([]map[string]interface{}, 0, len(options.Tokens))
+	for _, token := range options.Tokens {
+		tokens = append(tokens, map[string]interface{}{"token": token.Token, "identity": token.Identity, "roles": token.Roles})
+	}
+	set("auth.tokens", tokens)
+	return nil
+}
+
+// restoreSettings sets back the viper settings replaced by applyOptions.
+// Settings that were unset are set to nil, which viper reads as unset.
+func restoreSettings(overwritten map[string]interface{}) {
+	for name, value := range overwritten {
+		viper.Set(name, value)
+	}
+}
+
+func checkSettings(flags *pflag.FlagSet, settings map[string]interface{}) error {
+	for name := range settings {
+		if flags.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %v", name)
+		}
+	}
+	return nil
+}
+
+// Handler returns the API as an http.Handler serving the same paths as
+// `gowebdis start`, including the /backend/{name} prefix. It serves nothing
+// when the API is mounted on Options.Group.
+func (server *Server) Handler() http.Handler {
+	return server.handler
+}
+
+// Close fails the readiness probe, ends subscriptions, closes the
+// connections to the backends and restores the viper settings New
+// replaced. The Server cannot be used afterwards, but New can start
+// another one.
+func (server *Server) Close() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if server.overwritten == nil {
+		// Already closed, another Server may be running.
+		return nil
+	}
+	api.Drain()
+	err := gowebdis.CloseConnection()
+	gowebdis.ResetConnectionSetting()
+	restoreSettings(server.overwritten)
+	server.overwritten = nil
+	started = false
+	return err
+}
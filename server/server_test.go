@@ -0,0 +1,133 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/spf13/viper"
+)
+
+type echoCommand struct{}
+
+func (echoCommand) Spec() CommandSpec {
+	return CommandSpec{
+		Name:     "echo",
+		Summary:  "Return the value of the payload.",
+		ReadOnly: true,
+		Arguments: []ArgumentSpec{
+			{Name: "key", Type: TypeString, Required: true},
+			{Name: "value", Type: TypeString, Required: true},
+		},
+		Response: ResponseSpec{Name: "stringValue", Type: TypeString},
+	}
+}
+
+func (command echoCommand) Validate(payload Payload) error {
+	return command.Spec().Validate(payload)
+}
+
+func (echoCommand) Execute(client redis.UniversalClient, payload Payload, options CommandOptions) Response {
+	return Response{Success: true, StringVal: payload.Value}
+}
+
+func (echoCommand) Encode(response Response) map[string]interface{} {
+	return map[string]interface{}{"stringValue": response.StringVal}
+}
+
+// shout upper-cases the replies of echo.
+type shout struct{}
+
+func (shout) AfterExecute(call *Call, response *Response) {
+	response.StringVal = strings.ToUpper(response.StringVal) + "!"
+}
+
+func TestNewAgainAfterFailure(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	options := Options{
+		Backends: map[string]Backend{"default": {RedisURL: "redis://127.0.0.1:1/0"}},
+		Commands: []Command{echoCommand{}},
+		Hooks:    []Hook{{Commands: []string{"echo"}, After: shout{}}},
+		Settings: map[string]interface{}{"max-retries": 0},
+	}
+	if _, err := New(options); err == nil {
+		t.Fatal("New succeeded without redis")
+	}
+
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer redisServer.Close()
+	engine := gin.New()
+	options.Backends = map[string]Backend{"default": {RedisURL: "redis://" + redisServer.Addr() + "/0"}}
+	options.Group = engine.Group("/redis")
+	srv, err := New(options)
+	if err != nil {
+		t.Fatalf("New failed after a failed New: %v", err)
+	}
+	defer srv.Close()
+
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/redis/echo", strings.NewReader(`{"key":"k","value":"hi"}`)))
+	if recorder.Code != 200 || strings.TrimSpace(recorder.Body.String()) != `{"stringValue":"HI!"}` {
+		t.Errorf("echo replied %v %q", recorder.Code, recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if recorder.Code != 404 {
+		t.Errorf("API is mounted outside of the group: %v", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if recorder.Code != 404 {
+		t.Errorf("Handler serves the API mounted on a group: %v", recorder.Code)
+	}
+}
+
+func TestNewAfterClose(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer redisServer.Close()
+	viper.Set("version-field", "_host")
+	defer viper.Set("version-field", nil)
+
+	options := Options{
+		Backends: map[string]Backend{"default": {RedisURL: "redis://" + redisServer.Addr() + "/0"}},
+		Hooks:    []Hook{{Commands: []string{"hset"}, After: shout{}}},
+		Settings: map[string]interface{}{"version-field": "_v"},
+	}
+	for idx := 0; idx < 2; idx++ {
+		srv, err := New(options)
+		if err != nil {
+			t.Fatalf("New %v: %v", idx, err)
+		}
+		if field := viper.GetString("version-field"); field != "_v" {
+			t.Errorf("New %v set version-field %q", idx, field)
+		}
+		recorder := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if recorder.Code != 200 {
+			t.Errorf("healthz of server %v replied %v", idx, recorder.Code)
+		}
+		if err := srv.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if field := viper.GetString("version-field"); field != "_host" {
+			t.Errorf("Close left version-field %q", field)
+		}
+		if _, err := New(Options{}); err == nil || strings.Contains(err.Error(), "already started") {
+			t.Errorf("New without backends after Close = %v", err)
+		}
+	}
+	if err := (&Server{}).Close(); err != nil {
+		t.Errorf("Close of a closed server: %v", err)
+	}
+}